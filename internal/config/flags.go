@@ -0,0 +1,71 @@
+package config
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+)
+
+// stringsFlag collects a repeatable flag into a list. The first occurrence
+// on the command line replaces the list loaded from the config file.
+type stringsFlag struct {
+	dst *[]string
+	set bool
+}
+
+// StringsVar defines a repeatable string flag on fs that fills *dst.
+func StringsVar(fs *flag.FlagSet, dst *[]string, name, usage string) {
+	fs.Var(&stringsFlag{dst: dst}, name, usage)
+}
+
+func (f *stringsFlag) String() string {
+	if f.dst == nil {
+		return ""
+	}
+	return strings.Join(*f.dst, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	if !f.set {
+		*f.dst = nil
+		f.set = true
+	}
+	*f.dst = append(*f.dst, value)
+	return nil
+}
+
+// optionalFlag is a string flag that, like a boolean flag, may be given
+// without a value.
+type optionalFlag struct {
+	dst     *string
+	on, off string
+}
+
+// OptionalVar defines a string flag on fs that fills *dst. Given alone, or
+// as =true, it sets on, and as =false it sets off; any other value is kept
+// as it is, to be validated with the rest of the configuration.
+func OptionalVar(fs *flag.FlagSet, dst *string, name, on, off, usage string) {
+	fs.Var(&optionalFlag{dst: dst, on: on, off: off}, name, usage)
+}
+
+func (f *optionalFlag) String() string {
+	if f.dst == nil {
+		return ""
+	}
+	return *f.dst
+}
+
+func (f *optionalFlag) Set(value string) error {
+	switch on, err := strconv.ParseBool(value); {
+	case err != nil:
+		*f.dst = value
+	case on:
+		*f.dst = f.on
+	default:
+		*f.dst = f.off
+	}
+	return nil
+}
+
+// IsBoolFlag lets the flag be given without a value.
+func (f *optionalFlag) IsBoolFlag() bool { return true }
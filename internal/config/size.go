@@ -0,0 +1,116 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ByteSize is a number of bytes, written as a plain number or with a unit
+// such as "64MiB" or "100MB". It implements flag.Value.
+type ByteSize int64
+
+// byteUnits maps the accepted unit suffixes to their size in bytes. Longer
+// suffixes come first so that "MiB" is not read as "B".
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// ParseByteSize parses s as a ByteSize.
+func ParseByteSize(s string) (ByteSize, error) {
+	number, multiplier := strings.TrimSpace(s), int64(1)
+	for _, unit := range byteUnits {
+		if rest, ok := strings.CutSuffix(number, unit.suffix); ok {
+			number, multiplier = strings.TrimSpace(rest), unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected a number of bytes or a size such as 64MiB", s)
+	}
+	return ByteSize(n * float64(multiplier)), nil
+}
+
+// String renders b with the largest binary unit that divides it.
+func (b ByteSize) String() string {
+	for _, unit := range slices.Backward(byteUnits[:4]) {
+		if b != 0 && int64(b)%unit.size == 0 {
+			return strconv.FormatInt(int64(b)/unit.size, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+// Set parses value into b.
+func (b *ByteSize) Set(value string) error {
+	size, err := ParseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// UnmarshalYAML accepts a plain number or a size with a unit.
+func (b *ByteSize) UnmarshalYAML(node *yaml.Node) error {
+	return b.Set(node.Value)
+}
+
+// Bandwidth is a transfer rate in bytes per second, written as a size with
+// an optional "ps" or "/s" suffix such as "100MBps" or "50MiB/s". It
+// implements flag.Value.
+type Bandwidth int64
+
+// ParseBandwidth parses s as a Bandwidth.
+func ParseBandwidth(s string) (Bandwidth, error) {
+	size := strings.TrimSpace(s)
+	if rest, ok := strings.CutSuffix(size, "/s"); ok {
+		size = rest
+	} else if rest, ok := strings.CutSuffix(size, "ps"); ok {
+		size = rest
+	}
+	n, err := ParseByteSize(size)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bandwidth %q, expected a number of bytes per second or a rate such as 100MBps", s)
+	}
+	return Bandwidth(n), nil
+}
+
+// String renders b with the largest decimal unit that divides it, or else
+// as a ByteSize.
+func (b Bandwidth) String() string {
+	if b == 0 {
+		return "0"
+	}
+	for _, unit := range slices.Backward(byteUnits[4:8]) {
+		if int64(b)%unit.size == 0 {
+			return strconv.FormatInt(int64(b)/unit.size, 10) + unit.suffix + "/s"
+		}
+	}
+	return ByteSize(b).String() + "/s"
+}
+
+// Set parses value into b.
+func (b *Bandwidth) Set(value string) error {
+	bandwidth, err := ParseBandwidth(value)
+	if err != nil {
+		return err
+	}
+	*b = bandwidth
+	return nil
+}
+
+// UnmarshalYAML accepts a plain number or a rate with a unit.
+func (b *Bandwidth) UnmarshalYAML(node *yaml.Node) error {
+	return b.Set(node.Value)
+}
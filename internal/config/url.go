@@ -0,0 +1,105 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SSLModes lists the supported values of Postgres.SSLMode.
+var SSLModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// urlConflicts lists the flags that cannot be combined with -db-url.
+var urlConflicts = []string{"db-host", "db-port", "db-user", "password-file", "connect-timeout", "sslmode", "sslrootcert", "sslcert", "sslkey"}
+
+// applyURL replaces the discrete connection settings with those parsed from
+// c.Postgres.URL. setFlags holds the flags given on the command line, which
+// are rejected when they would be silently overridden by the URI.
+func (c *Config) applyURL(setFlags map[string]bool) error {
+	var conflicts []string
+	for _, name := range urlConflicts {
+		if setFlags[name] {
+			conflicts = append(conflicts, "-"+name)
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("-db-url cannot be combined with %s", strings.Join(conflicts, ", "))
+	}
+
+	u, err := url.Parse(c.Postgres.URL)
+	if err != nil {
+		return fmt.Errorf("invalid database URL %s: %w", redactURL(c.Postgres.URL), err)
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return fmt.Errorf("invalid database URL %s: scheme must be postgres:// or postgresql://", redactURL(c.Postgres.URL))
+	}
+
+	if host := u.Hostname(); host != "" {
+		c.Postgres.Host = host
+	}
+	if port := u.Port(); port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil {
+			return fmt.Errorf("invalid database URL port %q: %w", port, err)
+		}
+		c.Postgres.Port = n
+	}
+	if u.User != nil {
+		if user := u.User.Username(); user != "" {
+			c.Postgres.User = user
+		}
+		if password, ok := u.User.Password(); ok {
+			c.Postgres.Password = password
+		}
+	}
+	if database := strings.TrimPrefix(u.Path, "/"); database != "" {
+		c.Postgres.Database = database
+	}
+
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		switch key {
+		case "host":
+			// postgres:///db?host=/var/run/postgresql selects a Unix socket
+			c.Postgres.Host = value
+		case "sslmode":
+			c.Postgres.SSLMode = value
+		case "sslrootcert":
+			c.Postgres.SSLRootCert = value
+		case "sslcert":
+			c.Postgres.SSLCert = value
+		case "sslkey":
+			c.Postgres.SSLKey = value
+		case "connect_timeout":
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid database URL connect_timeout %q: %w", value, err)
+			}
+			c.Timeouts.Connect = time.Duration(seconds) * time.Second
+		default:
+			return fmt.Errorf("unsupported database URL parameter %q", key)
+		}
+	}
+	return nil
+}
+
+// setFlags returns the names of the flags given on the command line.
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// redactURL returns rawURL with any password replaced, for printing.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "<invalid>"
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,108 @@
+package naming
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Named key layouts accepted by ParseLayout.
+const (
+	// FlatLayout keeps every backup of a run directly below the prefix.
+	FlatLayout = "{prefix}/{filename}"
+
+	// HierarchicalLayout groups backups by server, database and date.
+	HierarchicalLayout = "{prefix}/{host}/{database}/{yyyy}/{mm}/{dd}/{filename}"
+)
+
+var layoutPlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+var layoutFields = map[string]bool{
+	"{prefix}": true, "{host}": true, "{database}": true,
+	"{yyyy}": true, "{mm}": true, "{dd}": true, "{filename}": true,
+}
+
+// Layout places backup names within the bucket.
+type Layout struct {
+	text string
+}
+
+// ParseLayout parses a key layout: "flat", "hierarchical" or a custom
+// pattern built from the {prefix}, {host}, {database}, {yyyy}, {mm}, {dd}
+// and {filename} placeholders. The pattern must end with {filename}.
+func ParseLayout(text string) (Layout, error) {
+	switch text {
+	case "flat":
+		text = FlatLayout
+	case "hierarchical":
+		text = HierarchicalLayout
+	}
+
+	for _, placeholder := range layoutPlaceholder.FindAllString(text, -1) {
+		if !layoutFields[placeholder] {
+			return Layout{}, fmt.Errorf("invalid key layout %q: unknown placeholder %s", text, placeholder)
+		}
+	}
+	if !strings.HasSuffix(text, "{filename}") || strings.Count(text, "{filename}") != 1 {
+		return Layout{}, fmt.Errorf("invalid key layout %q: it must end with {filename}", text)
+	}
+	return Layout{text: text}, nil
+}
+
+// String returns the layout pattern.
+func (l Layout) String() string {
+	return l.text
+}
+
+// Key returns the S3 key of the backup called filename of database on host,
+// taken at t.
+func (l Layout) Key(prefix, host, database string, t time.Time, filename string) string {
+	t = t.UTC()
+	return renderLayout(l.text, map[string]string{
+		"{prefix}":   prefix,
+		"{host}":     host,
+		"{database}": database,
+		"{yyyy}":     t.Format("2006"),
+		"{mm}":       t.Format("01"),
+		"{dd}":       t.Format("02"),
+		"{filename}": filename,
+	})
+}
+
+// DatabasePrefix returns the key prefix below which every backup of database
+// on host is stored, or false when the layout does not group backups by
+// database ahead of the date or filename.
+func (l Layout) DatabasePrefix(prefix, host, database string) (string, bool) {
+	i := strings.Index(l.text, "{database}")
+	if i < 0 {
+		return "", false
+	}
+	head := l.text[:i+len("{database}")]
+	for _, placeholder := range []string{"{yyyy}", "{mm}", "{dd}"} {
+		if strings.Contains(head, placeholder) {
+			return "", false
+		}
+	}
+	return renderLayout(head, map[string]string{
+		"{prefix}":   prefix,
+		"{host}":     host,
+		"{database}": database,
+	}) + "/", true
+}
+
+// renderLayout substitutes values into pattern and drops the empty path
+// segments left by empty values.
+func renderLayout(pattern string, values map[string]string) string {
+	rendered := layoutPlaceholder.ReplaceAllStringFunc(pattern, func(placeholder string) string {
+		return values[placeholder]
+	})
+
+	var segments []string
+	for _, segment := range strings.Split(rendered, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,179 @@
+// Package naming turns backup filename templates into object names and
+// parses those names back into their fields.
+package naming
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// DefaultTemplate produces the historical dbname_backup_timestamp.ext names.
+const DefaultTemplate = "{{.Database}}_backup_{{.Timestamp}}{{.Extension}}"
+
+// TimestampLayout is the time layout of Fields.Timestamp.
+const TimestampLayout = "20060102_150405"
+
+// Fields are the values available to a filename template.
+type Fields struct {
+	Database  string
+	Host      string
+	Port      string
+	Timestamp string
+	Format    string
+	Extension string
+}
+
+// fieldPatterns holds the regular expression each field matches when a name
+// is parsed back. Database is deliberately lazy so that literal text after
+// it in the template decides where it ends.
+var fieldPatterns = map[string]string{
+	"Database":  `[^/]+?`,
+	"Host":      `[^/]+?`,
+	"Port":      `[0-9]+`,
+	"Timestamp": `[0-9]{8}_[0-9]{6}`,
+	"Format":    `[a-z]+`,
+	"Extension": `(?:\.[A-Za-z0-9]+)+`,
+}
+
+// Template is a parsed filename template.
+type Template struct {
+	text    string
+	tmpl    *template.Template
+	pattern *regexp.Regexp
+}
+
+// Parse parses and validates a filename template. The template must
+// reference {{.Database}} so that databases cannot overwrite each other, and
+// must produce a relative path.
+func Parse(text string) (*Template, error) {
+	tmpl, err := template.New("filename").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filename template %q: %w", text, err)
+	}
+	t := &Template{text: text, tmpl: tmpl}
+
+	// Render the template with a marker per field; the literal text between
+	// the markers becomes the skeleton of the parsing expression.
+	markers := Fields{}
+	for _, name := range fieldNames() {
+		setField(&markers, name, "\x00"+name+"\x00")
+	}
+	rendered, err := t.render(markers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filename template %q: %w", text, err)
+	}
+	if !strings.Contains(rendered, "\x00Database\x00") {
+		return nil, fmt.Errorf("invalid filename template %q: it must contain {{.Database}}", text)
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	seen := make(map[string]bool)
+	for i, part := range strings.Split(rendered, "\x00") {
+		if i%2 == 0 {
+			expr.WriteString(regexp.QuoteMeta(part))
+			continue
+		}
+		if seen[part] {
+			fmt.Fprintf(&expr, "(?:%s)", fieldPatterns[part])
+			continue
+		}
+		seen[part] = true
+		fmt.Fprintf(&expr, "(?P<%s>%s)", part, fieldPatterns[part])
+	}
+	expr.WriteString("$")
+	if t.pattern, err = regexp.Compile(expr.String()); err != nil {
+		return nil, fmt.Errorf("invalid filename template %q: %w", text, err)
+	}
+
+	// Make sure a realistic name is a safe relative path
+	sample, err := t.Name(Fields{Database: "db", Host: "host", Port: "5432", Timestamp: "20060102_150405", Format: "custom", Extension: ".dump"})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := t.Match(sample); !ok {
+		return nil, fmt.Errorf("invalid filename template %q: names it produces cannot be parsed back", text)
+	}
+	return t, nil
+}
+
+// String returns the template text.
+func (t *Template) String() string {
+	return t.text
+}
+
+// Name renders the object name for f.
+func (t *Template) Name(f Fields) (string, error) {
+	name, err := t.render(f)
+	if err != nil {
+		return "", fmt.Errorf("failed to render filename template %q: %w", t.text, err)
+	}
+	if name == "" || strings.HasPrefix(name, "/") || path.Clean(name) != name || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("filename template %q produced unsafe name %q", t.text, name)
+	}
+	return name, nil
+}
+
+// MatchKey parses an S3 key whose final path components were produced by
+// the template, ignoring any leading prefix such as the backup run.
+func (t *Template) MatchKey(key string) (Fields, bool) {
+	for {
+		if f, ok := t.Match(key); ok {
+			return f, true
+		}
+		i := strings.Index(key, "/")
+		if i < 0 {
+			return Fields{}, false
+		}
+		key = key[i+1:]
+	}
+}
+
+// Match parses a name produced by the template back into its fields.
+func (t *Template) Match(name string) (Fields, bool) {
+	m := t.pattern.FindStringSubmatch(name)
+	if m == nil {
+		return Fields{}, false
+	}
+	var f Fields
+	for i, group := range t.pattern.SubexpNames() {
+		if group != "" {
+			setField(&f, group, m[i])
+		}
+	}
+	return f, true
+}
+
+func (t *Template) render(f Fields) (string, error) {
+	var b strings.Builder
+	if err := t.tmpl.Execute(&b, f); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func fieldNames() []string {
+	return []string{"Database", "Host", "Port", "Timestamp", "Format", "Extension"}
+}
+
+func setField(f *Fields, name, value string) {
+	switch name {
+	case "Database":
+		f.Database = value
+	case "Host":
+		f.Host = value
+	case "Port":
+		f.Port = value
+	case "Timestamp":
+		f.Timestamp = value
+	case "Format":
+		f.Format = value
+	case "Extension":
+		f.Extension = value
+	default:
+		panic("naming: unknown field " + name)
+	}
+}
@@ -0,0 +1,222 @@
+// Package postgres connects to the PostgreSQL server and builds the client
+// commands (pg_dump, pg_restore, ...) used by the pgbackup subcommands.
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"dbbackup/internal/config"
+
+	_ "github.com/lib/pq"
+)
+
+// ConnString returns the lib/pq connection string for dbName on the server in
+// pg. An empty password is left out so that peer authentication works over
+// Unix sockets.
+func ConnString(pg config.Postgres, timeouts config.Timeouts, dbName string) string {
+	params := []string{
+		"host=" + quote(pg.Host),
+		fmt.Sprintf("port=%d", pg.Port),
+		"user=" + quote(pg.User),
+		"dbname=" + quote(dbName),
+		"sslmode=" + quote(sslMode(pg)),
+	}
+	if pg.Password != "" {
+		params = append(params, "password="+quote(pg.Password))
+	}
+	if pg.SSLRootCert != "" {
+		params = append(params, "sslrootcert="+quote(pg.SSLRootCert))
+	}
+	if pg.SSLCert != "" {
+		params = append(params, "sslcert="+quote(pg.SSLCert), "sslkey="+quote(pg.SSLKey))
+	}
+	if timeouts.Connect > 0 {
+		params = append(params, fmt.Sprintf("connect_timeout=%d", int(timeouts.Connect.Seconds())))
+	}
+	return strings.Join(params, " ")
+}
+
+// quote escapes value for use in a key=value connection string.
+func quote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// Open returns a handle to dbName on the server in pg.
+func Open(pg config.Postgres, timeouts config.Timeouts, dbName string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", ConnString(pg, timeouts, dbName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	return db, nil
+}
+
+// ServerVersion returns the server's version number, e.g. 160002 for 16.2.
+func ServerVersion(ctx context.Context, pg config.Postgres, timeouts config.Timeouts) (int, error) {
+	db, err := Open(pg, timeouts, pg.Database)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var version int
+	if err := db.QueryRowContext(ctx, "SHOW server_version_num").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to query server version: %w", err)
+	}
+	return version, nil
+}
+
+// ServerRelease returns the server's version string, e.g. "16.2".
+func ServerRelease(ctx context.Context, pg config.Postgres, timeouts config.Timeouts) (string, error) {
+	db, err := Open(pg, timeouts, pg.Database)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	var release string
+	if err := db.QueryRowContext(ctx, "SHOW server_version").Scan(&release); err != nil {
+		return "", fmt.Errorf("failed to query server version: %w", err)
+	}
+	// Packaged servers append their distribution, e.g. "16.2 (Debian 16.2-1)"
+	release, _, _ = strings.Cut(release, " ")
+	return release, nil
+}
+
+// Command returns a command running the PostgreSQL client program name
+// against the server in pg. The connection arguments are placed before args.
+//
+// The password is never exported to the environment: it is written to a
+// temporary 0600 password file that only this command's PGPASSFILE points
+// at. The returned cleanup function removes that file and must be called
+// once the command has finished. Without a password libpq falls back to
+// $PGPASSFILE or ~/.pgpass as usual.
+//
+// Cancelling ctx kills the command together with any processes it started.
+func Command(ctx context.Context, pg config.Postgres, timeouts config.Timeouts, name string, args ...string) (*exec.Cmd, func(), error) {
+	connArgs := []string{"-h", pg.Host, "-p", fmt.Sprintf("%d", pg.Port), "-U", pg.User}
+	cmd := exec.CommandContext(ctx, name, append(connArgs, args...)...)
+	setProcessGroup(cmd)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), sslEnv(pg)...)
+	if timeouts.Connect > 0 {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("PGCONNECT_TIMEOUT=%d", int(timeouts.Connect.Seconds())))
+	}
+
+	cleanup := func() {}
+	if pg.Password != "" {
+		passFile, err := writePassFile(pg.Password)
+		if err != nil {
+			return nil, nil, err
+		}
+		cmd.Env = append(cmd.Env, "PGPASSFILE="+passFile)
+		cleanup = func() { os.Remove(passFile) }
+	}
+	return cmd, cleanup, nil
+}
+
+// writePassFile writes password to a new temporary pgpass file readable only
+// by the current user and returns its path.
+func writePassFile(password string) (string, error) {
+	file, err := os.CreateTemp("", "pgbackup-*.pgpass")
+	if err != nil {
+		return "", fmt.Errorf("failed to create password file: %w", err)
+	}
+	defer file.Close()
+
+	// The file is scoped to a single command, so the entry matches any
+	// host, port, database and user
+	password = strings.ReplaceAll(password, `\`, `\\`)
+	password = strings.ReplaceAll(password, `:`, `\:`)
+	err = file.Chmod(0o600)
+	if err == nil {
+		_, err = fmt.Fprintf(file, "*:*:*:*:%s\n", password)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to write password file: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// sslEnv returns the libpq environment variables that make a client program
+// use the same TLS settings as the lib/pq connection.
+func sslEnv(pg config.Postgres) []string {
+	env := []string{"PGSSLMODE=" + sslMode(pg)}
+	if pg.SSLRootCert != "" {
+		env = append(env, "PGSSLROOTCERT="+pg.SSLRootCert)
+	}
+	if pg.SSLCert != "" {
+		env = append(env, "PGSSLCERT="+pg.SSLCert, "PGSSLKEY="+pg.SSLKey)
+	}
+	return env
+}
+
+// sslMode returns the SSL mode to connect with. TLS does not apply to Unix
+// domain sockets, so they always use "disable".
+func sslMode(pg config.Postgres) string {
+	if pg.IsSocket() {
+		return "disable"
+	}
+	return pg.SSLMode
+}
+
+// toolVersionPattern extracts the version and its major part from the
+// output of a client program's --version, e.g. "pg_dump (PostgreSQL) 16.2".
+var toolVersionPattern = regexp.MustCompile(`\(PostgreSQL\) (([0-9]+)\S*)`)
+
+// ToolVersion returns the major version of the client program name.
+func ToolVersion(ctx context.Context, name string) (int, error) {
+	m, err := toolVersion(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(m[2])
+}
+
+// ToolRelease returns the version string of the client program name, e.g.
+// "16.2".
+func ToolRelease(ctx context.Context, name string) (string, error) {
+	m, err := toolVersion(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return m[1], nil
+}
+
+func toolVersion(ctx context.Context, name string) ([]string, error) {
+	out, err := exec.CommandContext(ctx, name, "--version").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run %s --version: %w", name, err)
+	}
+	m := toolVersionPattern.FindStringSubmatch(string(out))
+	if m == nil {
+		return nil, fmt.Errorf("unrecognised %s version %q", name, strings.TrimSpace(string(out)))
+	}
+	return m, nil
+}
+
+// CommandLine renders cmd's arguments for logging, quoting arguments that
+// contain spaces and hiding the password should it appear in any of them.
+func CommandLine(cmd *exec.Cmd, pg config.Postgres) string {
+	args := make([]string, len(cmd.Args))
+	for i, arg := range cmd.Args {
+		if pg.Password != "" {
+			arg = strings.ReplaceAll(arg, pg.Password, "<redacted>")
+		}
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"") {
+			arg = strconv.Quote(arg)
+		}
+		args[i] = arg
+	}
+	return strings.Join(args, " ")
+}
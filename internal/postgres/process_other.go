@@ -0,0 +1,9 @@
+//go:build !unix
+
+package postgres
+
+import "os/exec"
+
+// setProcessGroup leaves cmd as it is; cancelling its context kills only the
+// client program itself.
+func setProcessGroup(cmd *exec.Cmd) {}
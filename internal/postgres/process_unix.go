@@ -0,0 +1,18 @@
+//go:build unix
+
+package postgres
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup runs cmd in a process group of its own and makes the
+// cancellation of its context kill the whole group, so that the worker
+// processes of a parallel pg_dump or pg_restore stop with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
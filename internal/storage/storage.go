@@ -0,0 +1,93 @@
+// Package storage creates the S3 and KMS clients shared by the pgbackup
+// subcommands.
+package storage
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+
+	"dbbackup/internal/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// NewClient returns an S3 client for the bucket described by cfg, using the
+// credentials selected by creds. The identity behind the credentials is
+// logged so that a misconfigured profile is obvious.
+func NewClient(ctx context.Context, cfg config.S3, creds config.AWS) (*s3.Client, error) {
+	awsCfg, err := loadConfig(ctx, cfg.Region, creds)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.InsecureSkipVerify {
+		awsCfg.HTTPClient = awshttp.NewBuildableClient().WithTransportOptions(func(t *http.Transport) {
+			t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		})
+	}
+
+	// STS is not available on S3-compatible servers such as MinIO
+	if cfg.Endpoint == "" {
+		logCallerIdentity(ctx, awsCfg)
+	} else {
+		log.Printf("Using S3 endpoint %s", cfg.Endpoint)
+	}
+
+	// Create S3 client
+	return s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+		o.UsePathStyle = cfg.ForcePathStyle
+	}), nil
+}
+
+// NewKMSClient returns a KMS client for region, using the credentials
+// selected by creds.
+func NewKMSClient(ctx context.Context, region string, creds config.AWS) (*kms.Client, error) {
+	awsCfg, err := loadConfig(ctx, region, creds)
+	if err != nil {
+		return nil, err
+	}
+	return kms.NewFromConfig(awsCfg), nil
+}
+
+// loadConfig loads the AWS configuration for region with the credentials
+// selected by creds.
+func loadConfig(ctx context.Context, region string, creds config.AWS) (aws.Config, error) {
+	opts := []func(*awsconfig.LoadOptions) error{awsconfig.WithRegion(region)}
+	if creds.Profile != "" {
+		opts = append(opts, awsconfig.WithSharedConfigProfile(creds.Profile))
+	}
+	if creds.CredentialsFile != "" {
+		opts = append(opts, awsconfig.WithSharedCredentialsFiles([]string{creds.CredentialsFile}))
+	}
+	if creds.AccessKeyID != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(creds.AccessKeyID, creds.SecretAccessKey, "")))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("unable to load AWS config: %w", err)
+	}
+	return awsCfg, nil
+}
+
+// logCallerIdentity logs the account and ARN the credentials in awsCfg belong to.
+func logCallerIdentity(ctx context.Context, awsCfg aws.Config) {
+	identity, err := sts.NewFromConfig(awsCfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		log.Printf("Warning: unable to determine AWS identity: %v", err)
+		return
+	}
+	log.Printf("Using AWS identity %s (account %s)", aws.ToString(identity.Arn), aws.ToString(identity.Account))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"dbbackup/internal/config"
+	"dbbackup/internal/postgres"
+)
+
+// analyzeDatabase gathers the planner statistics of the freshly restored
+// dbName as -post-analyze has it: with ANALYZE, or with vacuumdb
+// --analyze-in-stages, which makes rough statistics available after its
+// first stage. It is bounded by -analyze-timeout.
+func analyzeDatabase(ctx context.Context, cfg *config.Config, dbLog *databaseLog, dbName string) (err error) {
+	if timeout := cfg.Timeouts.Analyze; timeout > 0 {
+		cause := fmt.Errorf("timed out after %s", timeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, timeout, cause)
+		defer cancel()
+		defer func() {
+			if err != nil && context.Cause(ctx) == cause {
+				err = fmt.Errorf("%w: %w", cause, err)
+			}
+		}()
+	}
+
+	started := time.Now()
+	switch cfg.Restore.PostAnalyze {
+	case "stages":
+		cmd, cleanup, err := postgres.Command(ctx, cfg.Postgres, cfg.Timeouts, "vacuumdb", "--analyze-in-stages", "-d", dbName)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		stderr := &errorLines{w: dbLog.stderr}
+		cmd.Stderr = stderr
+		defer dbLog.stderr.Flush()
+		dbLog.out.Printf("Running %s\n", postgres.CommandLine(cmd, cfg.Postgres))
+		if err := cmd.Run(); err != nil {
+			return stderr.wrap(fmt.Errorf("failed to analyze database %s: %w", dbName, err))
+		}
+	default:
+		db, err := postgres.Open(cfg.Postgres, cfg.Timeouts, dbName)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		dbLog.out.Printf("Running ANALYZE in database %s\n", dbName)
+		if _, err := db.ExecContext(ctx, "ANALYZE"); err != nil {
+			return fmt.Errorf("failed to analyze database %s: %w", dbName, err)
+		}
+	}
+	dbLog.out.Printf("Analyzed database %s in %s\n", dbName, time.Since(started).Round(time.Millisecond))
+	return nil
+}
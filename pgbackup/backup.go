@@ -0,0 +1,1323 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dbbackup/internal/config"
+	"dbbackup/internal/naming"
+	"dbbackup/internal/postgres"
+	"dbbackup/internal/storage"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func runBackup(ctx context.Context, args []string) error {
+	// Each backup run gets its own epoch-second prefix unless one is configured
+	defaults := config.Defaults()
+	defaults.S3.Prefix = fmt.Sprintf("%d", time.Now().Unix())
+
+	var force bool
+	cfg, err := loadConfig("backup", "Backs up every non-template database to S3.", args, defaults,
+		func(fs *flag.FlagSet, c *config.Config) {
+			config.StringsVar(fs, &c.Backup.Databases, "database", "back up only this database, skipping discovery and filters (repeatable)")
+			config.StringsVar(fs, &c.Backup.Owners, "owner", "back up only databases owned by this role (repeatable)")
+			fs.BoolFunc("no-default-excludes", "also back up the system databases of managed services, such as rdsadmin", func(value string) error {
+				noDefaultExcludes, err := strconv.ParseBool(value)
+				c.Backup.DefaultExcludes = !noDefaultExcludes
+				return err
+			})
+			fs.DurationVar(&c.Timeouts.Run, "run-timeout", c.Timeouts.Run, "maximum time for the whole run, after which running backups are cancelled and the rest are not attempted; 0 waits indefinitely")
+			fs.DurationVar(&c.Timeouts.Database, "db-timeout", c.Timeouts.Database, "maximum time for the dump and upload of each database, 0 waits indefinitely")
+			fs.IntVar(&c.Backup.Concurrency, "concurrency", c.Backup.Concurrency, "number of databases to back up at once")
+			fs.DurationVar(&c.Backup.PauseBetween, "pause-between", c.Backup.PauseBetween, "pause before each database after a worker's first, to spare the server's I/O")
+			fs.StringVar(&c.Backup.Order, "order", c.Backup.Order, "order to back up databases in: name, smallest-first or largest-first")
+			config.StringsVar(fs, &c.Backup.Priority, "priority", "back up this database before all others not given with -priority (repeatable)")
+			fs.BoolVar(&c.Backup.SkipUnchanged, "skip-unchanged", c.Backup.SkipUnchanged, "skip databases with no writes since their latest backup below the prefix")
+			fs.DurationVar(&c.Backup.SkipIfBackedUpWithin, "skip-if-backed-up-within", c.Backup.SkipIfBackedUpWithin, "skip databases with a backup below the prefix uploaded less than this long ago, e.g. 24h")
+			fs.BoolVar(&force, "force", false, "back up every database, even with -skip-unchanged or -skip-if-backed-up-within")
+			fs.BoolVar(&c.Backup.Dedupe, "dedupe", c.Backup.Dedupe, "skip uploading dumps identical to the latest backup of their database below the prefix")
+			fs.BoolFunc("no-disk-check", "dump databases larger than the free space of the work directory, for dumps known to be smaller", func(value string) error {
+				noDiskCheck, err := strconv.ParseBool(value)
+				c.Backup.DiskCheck = !noDiskCheck
+				return err
+			})
+			fs.Var(&c.S3.MaxObjectSize, "max-object-size", "split backups larger than this into numbered part objects, e.g. 50GB; 0 uploads each backup as one object")
+			fs.StringVar(&c.Local.Dir, "keep-local", c.Local.Dir, "move each uploaded dump into a directory per database below this one, for quick restores")
+			fs.IntVar(&c.Local.Count, "keep-local-count", c.Local.Count, "number of local copies to keep for each database with -keep-local")
+			fs.BoolVar(&c.Backup.KeepFailedUploads, "keep-failed-uploads", c.Backup.KeepFailedUploads, "keep the dumps whose upload failed in the work directory, to upload them by hand")
+			fs.BoolVar(&c.Backup.Strict, "strict", c.Backup.Strict, "fail the run instead of skipping databases the user cannot connect to")
+			registerOnErrorFlag(fs, c)
+			fs.StringVar(&c.Dump.Format, "format", c.Dump.Format, "pg_dump output format: "+strings.Join(config.DumpFormats, ", "))
+			fs.IntVar(&c.Dump.Jobs, "jobs", c.Dump.Jobs, "parallel pg_dump workers for directory-format dumps")
+			fs.BoolVar(&c.Dump.SchemaOnly, "schema-only", c.Dump.SchemaOnly, "dump object definitions only, marking the backups .schema")
+			fs.BoolVar(&c.Dump.DataOnly, "data-only", c.Dump.DataOnly, "dump table data only, marking the backups .data")
+			config.StringsVar(fs, &c.Dump.Tables.IncludeSchemas, "include-schema", "only dump schemas matching this pg_dump pattern (repeatable)")
+			config.StringsVar(fs, &c.Dump.Tables.ExcludeSchemas, "exclude-schema", "do not dump schemas matching this pg_dump pattern (repeatable)")
+			config.StringsVar(fs, &c.Dump.Tables.IncludeTables, "include-table", "only dump tables matching this pg_dump pattern (repeatable)")
+			config.StringsVar(fs, &c.Dump.Tables.ExcludeTables, "exclude-table", "do not dump tables matching this pg_dump pattern, e.g. public.audit_log (repeatable)")
+			config.StringsVar(fs, &c.Dump.Tables.ExcludeTableData, "exclude-table-data", "dump the definition but not the rows of tables matching this pg_dump pattern, e.g. '*.events_*' (repeatable)")
+			fs.BoolVar(&c.Dump.Blobs, "include-blobs", c.Dump.Blobs, "include large objects in dumps")
+			fs.BoolFunc("no-blobs", "leave large objects out of dumps", func(value string) error {
+				noBlobs, err := strconv.ParseBool(value)
+				c.Dump.Blobs = !noBlobs
+				return err
+			})
+			fs.BoolVar(&c.Dump.Globals, "globals", c.Dump.Globals, "back up roles and tablespaces with pg_dumpall --globals-only; disable where managed services forbid it")
+			fs.BoolVar(&c.Dump.SerializableDeferrable, "serializable-deferrable", c.Dump.SerializableDeferrable, "wait for a snapshot that is guaranteed consistent without blocking writers")
+			fs.StringVar(&c.Dump.Snapshot, "snapshot", c.Dump.Snapshot, "use this exported snapshot for the dump; it belongs to the database that exported it, which -database must name alone")
+			config.StringsVar(fs, &c.Dump.ExtraArgs, "pg-dump-arg", "extra argument passed verbatim to pg_dump, e.g. --no-comments (repeatable)")
+			fs.BoolVar(&c.Dump.Clean, "clean", c.Dump.Clean, "make plain-format dumps drop objects before recreating them (--clean --if-exists)")
+			fs.StringVar(&c.Dump.Compress, "compress", c.Dump.Compress, "compress dumps before upload: "+strings.Join(config.Compressions, ", "))
+			fs.IntVar(&c.Dump.CompressLevel, "compress-level", c.Dump.CompressLevel, "compression level, 1-9 for gzip and 1-22 for zstd; 0 uses the default")
+			fs.Var(&c.Dump.MinSize, "min-dump-size", "size below which a dump is taken for failed and not uploaded, e.g. 1MiB; empty dumps always are")
+			registerEncryptionFlags(fs, c)
+			registerUploadFlags(fs, c)
+			fs.StringVar(&c.S3.StorageClass, "storage-class", c.S3.StorageClass, "S3 storage class of the backups, e.g. STANDARD_IA or GLACIER_IR; empty uses STANDARD")
+			config.StringsVar(fs, &c.S3.Tags, "s3-tag", "key=value tag added to every uploaded object, next to the automatic database, host and retention-class tags (repeatable)")
+			fs.StringVar(&c.Dump.PgDumpCompression, "dump-compress", c.Dump.PgDumpCompression, "pg_dump compression of custom-format dumps: none, 0-9, or gzip, lz4 or zstd with optional :level (PostgreSQL 16+); empty keeps pg_dump's default")
+		})
+	if err != nil {
+		return err
+	}
+	if err := checkEncryption(cfg.Encryption); err != nil {
+		return &usageError{err}
+	}
+	if err := checkStorageClass(cfg.S3.StorageClass); err != nil {
+		return &usageError{err}
+	}
+	if cfg.Dump.Snapshot != "" && len(cfg.Backup.Databases) != 1 {
+		return &usageError{errors.New("-snapshot can only be imported into the database that exported it, which -database must name alone")}
+	}
+	if force {
+		cfg.Backup.SkipUnchanged = false
+		cfg.Backup.SkipIfBackedUpWithin = 0
+	}
+
+	// Bound the whole run, e.g. to a nightly backup window
+	if cfg.Timeouts.Run > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, cfg.Timeouts.Run, errRunTimeout)
+		defer cancel()
+	}
+
+	// Perform backups for all databases
+	return backupAllDatabasesToS3(ctx, cfg)
+}
+
+// errRunTimeout reports that a backup run outlasted -run-timeout.
+var errRunTimeout = errors.New("run timeout exceeded")
+
+// managedDatabases are the system databases that managed PostgreSQL services
+// create for themselves. The service user cannot dump them.
+var managedDatabases = []string{
+	"rdsadmin",          // Amazon RDS and Aurora
+	"azure_maintenance", // Azure Database for PostgreSQL
+	"azure_sys",         // Azure Database for PostgreSQL
+	"cloudsqladmin",     // Google Cloud SQL
+	"alloydbadmin",      // Google AlloyDB
+	"alloydbmetadata",   // Google AlloyDB
+}
+
+// databaseInfo is a database found on the server.
+type databaseInfo struct {
+	name       string
+	owner      string
+	canConnect bool
+
+	// size is the database's size in bytes, or -1 when it cannot be read
+	// for lack of the connect privilege.
+	size int64
+
+	// position is the database's place in the backup order, from 1.
+	position int
+
+	// managed is set for a managed service's system database that the
+	// default exclusions leave out.
+	managed bool
+
+	// collation is the database's default collation, and collationVersion
+	// the version of the library providing it, such as glibc's, which
+	// servers before PostgreSQL 15 do not tell.
+	collation, collationVersion string
+}
+
+func getDatabaseList(ctx context.Context, pg config.Postgres, timeouts config.Timeouts, backup config.Backup) ([]databaseInfo, error) {
+	// Connect to the PostgreSQL server
+	db, err := postgres.Open(pg, timeouts, pg.Database)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	// A misspelt owner would silently select nothing
+	if err := checkRolesExist(ctx, db, backup.Owners); err != nil {
+		return nil, err
+	}
+
+	// Query the list of databases
+	// pg_database_size needs the connect privilege on the database
+	var version int
+	if err := db.QueryRowContext(ctx, "SHOW server_version_num").Scan(&version); err != nil {
+		return nil, fmt.Errorf("failed to query server version: %w", err)
+	}
+	rows, err := db.QueryContext(ctx, `SELECT datname, pg_get_userbyid(datdba), has_database_privilege(current_user, datname, 'CONNECT'),
+		CASE WHEN has_database_privilege(current_user, datname, 'CONNECT') THEN pg_database_size(datname) ELSE -1 END,
+		datcollate, `+collationVersionColumn(version)+`
+		FROM pg_database WHERE datistemplate = false;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query databases: %w", err)
+	}
+	defer rows.Close()
+
+	var databases []databaseInfo
+	for rows.Next() {
+		var info databaseInfo
+		if err := rows.Scan(&info.name, &info.owner, &info.canConnect, &info.size, &info.collation, &info.collationVersion); err != nil {
+			return nil, fmt.Errorf("failed to scan database name: %w", err)
+		}
+		info.managed = backup.DefaultExcludes && slices.Contains(managedDatabases, info.name)
+		databases = append(databases, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query databases: %w", err)
+	}
+
+	return databases, nil
+}
+
+// checkRolesExist returns an error naming every role in names that does not
+// exist on the server.
+func checkRolesExist(ctx context.Context, db *sql.DB, names []string) error {
+	var missing []string
+	for _, name := range names {
+		var exists bool
+		if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)", name).Scan(&exists); err != nil {
+			return fmt.Errorf("failed to look up role %s: %w", name, err)
+		}
+		if !exists {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("roles do not exist: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkDatabasesExist returns an error naming every database in names that
+// does not exist on the server.
+func checkDatabasesExist(ctx context.Context, pg config.Postgres, timeouts config.Timeouts, names []string) error {
+	db, err := postgres.Open(pg, timeouts, pg.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var missing []string
+	for _, name := range names {
+		var exists bool
+		if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)", name).Scan(&exists); err != nil {
+			return fmt.Errorf("failed to look up database %s: %w", name, err)
+		}
+		if !exists {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("databases do not exist: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// dumpFormats maps each configured dump format to pg_dump's -F value and the
+// extension of the backup file. Directory-format dumps are uploaded as a tar
+// archive of the directory. Custom-format dumps have always been named .sql,
+// so plain SQL scripts get their own .plain.sql extension.
+var dumpFormats = map[string]struct{ flag, ext string }{
+	"custom":    {"c", ".sql"},
+	"tar":       {"t", ".tar"},
+	"directory": {"d", ".dir.tar"},
+	"plain":     {"p", ".plain.sql"},
+}
+
+// hostLabel names the server in backup names and keys; socket directories
+// are not meaningful there and are reported as "local".
+func hostLabel(pg config.Postgres) string {
+	if pg.IsSocket() {
+		return "local"
+	}
+	return pg.Host
+}
+
+// contentMarkers holds the marker placed ahead of the extension of backups
+// that do not hold a full dump.
+var contentMarkers = map[string]string{
+	"full":        "",
+	"schema-only": ".schema",
+	"data-only":   ".data",
+}
+
+// dumpContent reports what the configured dumps contain.
+func dumpContent(dump config.Dump) string {
+	switch {
+	case dump.SchemaOnly:
+		return "schema-only"
+	case dump.DataOnly:
+		return "data-only"
+	}
+	return "full"
+}
+
+// backupName renders the object name of a backup of dbName taken at now.
+func backupName(cfg *config.Config, tmpl *naming.Template, dbName string, settings config.Database, now time.Time) (string, error) {
+	return tmpl.Name(naming.Fields{
+		Database:  dbName,
+		Host:      hostLabel(cfg.Postgres),
+		Port:      strconv.Itoa(cfg.Postgres.Port),
+		Timestamp: now.Format(naming.TimestampLayout),
+		Format:    settings.Format,
+		Extension: contentMarkers[dumpContent(cfg.Dump)] + dumpFormats[settings.Format].ext,
+	})
+}
+
+// pgDumpCompressArgs maps the configured pg_dump compression onto the
+// arguments understood by a pg_dump of the given major version. Versions
+// before 16 only support gzip levels through -Z.
+func pgDumpCompressArgs(setting string, version int) ([]string, error) {
+	switch {
+	case setting == "":
+		return nil, nil
+	case setting == "none":
+		return []string{"-Z", "0"}, nil
+	case version >= 16:
+		return []string{"--compress=" + setting}, nil
+	}
+
+	method, level, _ := strings.Cut(setting, ":")
+	if len(method) == 1 {
+		method, level = "gzip", method
+	}
+	if method != "gzip" {
+		return nil, fmt.Errorf("pg_dump compression %q requires pg_dump 16 or later, found %d", setting, version)
+	}
+	if level == "" {
+		return nil, nil
+	}
+	return []string{"-Z", level}, nil
+}
+
+// dumpedFile is a dump written to the work directory.
+type dumpedFile struct {
+	path   string
+	sha256 string // of the file
+
+	// dumpSHA256 digests pg_dump's output without its creation time, and
+	// is empty for directory-format dumps.
+	dumpSHA256 string
+
+	// partSHA256s digests each part of the file, when the backup may be
+	// split into parts of -max-object-size.
+	partSHA256s []string
+}
+
+// backupDatabase dumps dbName into backupFilePath, in the work directory.
+func backupDatabase(ctx context.Context, cfg *config.Config, dbLog *databaseLog, dbName, backupFilePath string, settings config.Database, dumpArgs []string, dataKey []byte) (dumpedFile, error) {
+	args := pgDumpArgs(cfg, settings, dumpArgs)
+
+	// The dump is streamed into the file to digest it as it is written
+	file, err := createDigestFile(backupFilePath)
+	if err != nil {
+		return dumpedFile{}, err
+	}
+	defer file.Close()
+	file.partSize = int64(cfg.S3.MaxObjectSize)
+
+	check := newDumpCheck(settings.Format)
+	switch {
+	case settings.Format == "directory":
+		if settings.Jobs > 0 {
+			args = append(args, "-j", strconv.Itoa(settings.Jobs))
+		}
+		err = dumpDirectory(ctx, cfg, dbLog, args, dbName, settings.MinSize, file, dataKey)
+	case cfg.Dump.Compress != "none" || cfg.Encryption.Scheme != "none":
+		err = dumpCompressed(ctx, cfg, dbLog, append(args, dbName), settings.MinSize, check, file, dataKey)
+	default:
+		// Run the pg_dump command to backup the database
+		check.w = file
+		if err = runPgDump(ctx, cfg, dbLog, append(args, dbName), check); err == nil {
+			err = check.verify(settings.MinSize)
+		}
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(backupFilePath)
+		return dumpedFile{}, err
+	}
+
+	dumped := dumpedFile{path: backupFilePath, sha256: file.Sum(), partSHA256s: file.PartSums()}
+	if settings.Format != "directory" {
+		dumped.dumpSHA256 = check.Sum()
+	}
+	return dumped, nil
+}
+
+// pgDumpArgs returns the arguments, ahead of the database name, that
+// pg_dump dumps a database with settings with: its format and contents,
+// dumpArgs, then the configured extra arguments.
+func pgDumpArgs(cfg *config.Config, settings config.Database, dumpArgs []string) []string {
+	format := dumpFormats[settings.Format]
+	args := append([]string{"-F", format.flag}, dumpArgs...)
+	switch {
+	case cfg.Dump.SchemaOnly:
+		args = append(args, "-s")
+	case cfg.Dump.DataOnly:
+		args = append(args, "-a")
+	}
+	args = append(args, tableFilterArgs(settings.Tables)...)
+	if cfg.Dump.Blobs {
+		// pg_dump leaves large objects out of filtered dumps unless asked
+		args = append(args, "-b")
+	} else {
+		args = append(args, "-B")
+	}
+	if settings.Format == "plain" && cfg.Dump.Clean {
+		args = append(args, "--clean", "--if-exists")
+	}
+	if cfg.Dump.SerializableDeferrable {
+		// Verbose output tells when the snapshot was acquired
+		args = append(args, "--serializable-deferrable", "-v")
+	}
+	if cfg.Dump.Snapshot != "" {
+		args = append(args, "--snapshot="+cfg.Dump.Snapshot)
+	}
+	args = append(args, cfg.Dump.ExtraArgs...)
+	return args
+}
+
+// runPgDump runs pg_dump with args, logging the command line and pg_dump's
+// messages to dbLog. The dump is written to stdout when it is non-nil.
+func runPgDump(ctx context.Context, cfg *config.Config, dbLog *databaseLog, args []string, stdout io.Writer) error {
+	cmd, cleanup, err := postgres.Command(ctx, cfg.Postgres, cfg.Timeouts, "pg_dump", args...)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if stdout != nil {
+		cmd.Stdout = stdout
+	}
+	cmd.Stderr = dbLog.stderr
+	defer dbLog.stderr.Flush()
+	var timer *snapshotTimer
+	if cfg.Dump.SerializableDeferrable {
+		timer = &snapshotTimer{w: cmd.Stderr, start: time.Now()}
+		cmd.Stderr = timer
+	}
+
+	dbLog.out.Printf("Running %s\n", postgres.CommandLine(cmd, cfg.Postgres))
+	err = cmd.Run()
+	if timer != nil {
+		timer.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to backup database: %w", err)
+	}
+	if timer != nil && !timer.acquired.IsZero() {
+		dbLog.out.Printf("pg_dump waited %s to acquire a serializable deferrable snapshot\n", timer.acquired.Sub(timer.start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// snapshotTimer receives pg_dump's verbose output. It records when the
+// first progress message, which pg_dump prints once its snapshot is taken,
+// arrives and passes only errors, warnings, their details and hints, and
+// unrecognised lines on to w.
+type snapshotTimer struct {
+	w        io.Writer
+	start    time.Time
+	acquired time.Time
+	partial  []byte
+}
+
+func (t *snapshotTimer) Write(p []byte) (int, error) {
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := t.partial[:i+1]
+		t.partial = t.partial[i+1:]
+		if t.follow(string(bytes.TrimRight(line, "\r\n"))) {
+			continue
+		}
+		if _, err := t.w.Write(line); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+// Flush passes on a last line pg_dump did not end with a newline.
+func (t *snapshotTimer) Flush() error {
+	if len(t.partial) == 0 {
+		return nil
+	}
+	_, err := t.Write([]byte("\n"))
+	return err
+}
+
+// follow records the time of the first progress message and reports
+// whether line is one, which is left out of the output.
+func (t *snapshotTimer) follow(line string) bool {
+	message, ok := strings.CutPrefix(line, "pg_dump: ")
+	if !ok {
+		return false
+	}
+	for _, prefix := range []string{"error:", "warning:", "detail:", "hint:"} {
+		if strings.HasPrefix(message, prefix) {
+			return false
+		}
+	}
+	if t.acquired.IsZero() {
+		t.acquired = time.Now()
+	}
+	return true
+}
+
+// dumpCompressed streams pg_dump's output through the configured compressor
+// and encryptor into file, so the plain dump never touches the disk. The
+// output is checked by check on its way through.
+func dumpCompressed(ctx context.Context, cfg *config.Config, dbLog *databaseLog, args []string, minSize config.ByteSize, check *dumpCheck, file io.Writer, dataKey []byte) error {
+	w, err := encodeWriter(file, cfg, dataKey)
+	if err != nil {
+		return err
+	}
+
+	// The writer is closed on failure too, as a zstd encoder holds
+	// goroutines and buffers until it is
+	check.w = w
+	if err := runPgDump(ctx, cfg, dbLog, args, check); err != nil {
+		w.Close()
+		return err
+	}
+	if err := check.verify(minSize); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// tableFilterArgs returns the pg_dump arguments applying filters.
+func tableFilterArgs(filters config.TableFilters) []string {
+	var args []string
+	for _, pattern := range filters.IncludeSchemas {
+		args = append(args, "--schema="+pattern)
+	}
+	for _, pattern := range filters.ExcludeSchemas {
+		args = append(args, "--exclude-schema="+pattern)
+	}
+	for _, pattern := range filters.IncludeTables {
+		args = append(args, "--table="+pattern)
+	}
+	for _, pattern := range filters.ExcludeTables {
+		args = append(args, "--exclude-table="+pattern)
+	}
+	for _, pattern := range filters.ExcludeTableData {
+		args = append(args, "--exclude-table-data="+pattern)
+	}
+	return args
+}
+
+// dumpDirectory dumps dbName into a scratch directory in the work directory,
+// checks it and archives it, compressed and encrypted as configured, into
+// file. The directory is removed afterwards.
+func dumpDirectory(ctx context.Context, cfg *config.Config, dbLog *databaseLog, args []string, dbName string, minSize config.ByteSize, file io.Writer, dataKey []byte) error {
+	scratch, err := os.MkdirTemp(cfg.WorkDir, workFilePrefix+"dump-*")
+	if err != nil {
+		return fmt.Errorf("failed to create dump directory: %w", err)
+	}
+	defer os.RemoveAll(scratch)
+	dumpDir := filepath.Join(scratch, "dump")
+
+	// Run the pg_dump command to backup the database
+	if err := runPgDump(ctx, cfg, dbLog, append(args, "-f", dumpDir, dbName), nil); err != nil {
+		return err
+	}
+	if err := checkDumpDirectory(dumpDir, minSize); err != nil {
+		return err
+	}
+
+	// Archive the dump directory into a single file for upload
+	w, err := encodeWriter(file, cfg, dataKey)
+	if err != nil {
+		return err
+	}
+	if err := tarDirectory(dumpDir, w); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func backupAllDatabasesToS3(ctx context.Context, cfg *config.Config) error {
+	started := time.Now().UTC()
+	runID := newRunID(started)
+	fmt.Printf("Backup run %s\n", runID)
+	if err := prepareWorkDir(cfg); err != nil {
+		return err
+	}
+
+	// Check the recipients before dumping anything
+	if cfg.Encryption.Scheme == "age" || cfg.Encryption.Scheme == "gpg" {
+		if _, err := encryptWriter(io.Discard, cfg.Encryption, nil); err != nil {
+			return err
+		}
+	}
+
+	s3Client, err := storage.NewClient(ctx, cfg.S3, cfg.AWS)
+	if err != nil {
+		return err
+	}
+	var kmsClient *kms.Client
+	if cfg.Encryption.Scheme == "kms" {
+		if kmsClient, err = storage.NewKMSClient(ctx, cfg.S3.Region, cfg.AWS); err != nil {
+			return err
+		}
+	}
+
+	tmpl, err := naming.Parse(cfg.Dump.FilenameTemplate)
+	if err != nil {
+		return err
+	}
+	layout, err := naming.ParseLayout(cfg.S3.KeyLayout)
+	if err != nil {
+		return err
+	}
+
+	// Serializable deferrable transactions need PostgreSQL 9.1
+	if cfg.Dump.SerializableDeferrable {
+		version, err := postgres.ServerVersion(ctx, cfg.Postgres, cfg.Timeouts)
+		if err != nil {
+			return err
+		}
+		if version < 90100 {
+			return fmt.Errorf("-serializable-deferrable requires PostgreSQL 9.1 or later, server is %d", version)
+		}
+	}
+
+	// Translate pg_dump's compression for the installed pg_dump
+	var compressArgs []string
+	if cfg.Dump.PgDumpCompression != "" {
+		version, err := postgres.ToolVersion(ctx, "pg_dump")
+		if err != nil {
+			return err
+		}
+		if compressArgs, err = pgDumpCompressArgs(cfg.Dump.PgDumpCompression, version); err != nil {
+			return err
+		}
+	}
+
+	// Record where the backups come from in their metadata
+	provenance, err := backupProvenance(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	runManifest := &manifest{
+		RunID:   runID,
+		Started: started,
+		Host:    hostLabel(cfg.Postgres),
+	}
+
+	summary := &runSummary{title: "Backup"}
+	summary.setting("run", runID)
+	summary.setting("pg_dump compression", describePgDumpCompression(compressArgs))
+	summary.setting("compression", describeCompression(cfg.Dump.Compress, cfg.Dump.CompressLevel))
+	summary.setting("content", dumpContent(cfg.Dump))
+	summary.setting("encryption", cfg.Encryption.Scheme)
+	summary.setting("storage class", cmp.Or(cfg.S3.StorageClass, "STANDARD"))
+	if cfg.S3.UploadBandwidthLimit > 0 {
+		summary.setting("upload limit", cfg.S3.UploadBandwidthLimit.String())
+	}
+
+	// Backup the roles and tablespaces the databases refer to
+	if cfg.Dump.Globals {
+		globals, err := backupGlobals(ctx, cfg, s3Client, kmsClient, provenance, runID)
+		if err != nil {
+			log.Printf("Failed to backup globals: %v", err)
+			summary.setting("globals", "failed")
+		} else {
+			runManifest.Globals = globals
+			summary.setting("globals", globals)
+		}
+	}
+
+	// Get the list of databases, unless they were named on the command line
+	named := len(cfg.Backup.Databases) > 0
+	var databases []databaseInfo
+	if named {
+		if err := checkDatabasesExist(ctx, cfg.Postgres, cfg.Timeouts, cfg.Backup.Databases); err != nil {
+			return err
+		}
+		// Discover without owner checks or exclusions to learn the sizes
+		all, err := getDatabaseList(ctx, cfg.Postgres, cfg.Timeouts, config.Backup{})
+		if err != nil {
+			return err
+		}
+		for _, database := range all {
+			if slices.Contains(cfg.Backup.Databases, database.name) {
+				databases = append(databases, database)
+			}
+		}
+	} else {
+		if databases, err = getDatabaseList(ctx, cfg.Postgres, cfg.Timeouts, cfg.Backup); err != nil {
+			return err
+		}
+		if len(cfg.Backup.Owners) > 0 {
+			fmt.Printf("Backing up databases owned by: %s\n", strings.Join(cfg.Backup.Owners, ", "))
+			summary.setting("owners", strings.Join(cfg.Backup.Owners, ", "))
+		}
+	}
+	orderDatabases(databases, cfg.Backup.Order, cfg.Backup.Priority)
+
+	// Decide which databases to backup
+	var selected []databaseInfo
+	var errs []error
+	for _, database := range databases {
+		dbName := database.name
+		if database.managed {
+			summary.skip(dbName, "excluded (managed service)")
+			continue
+		}
+		if !named && !cfg.Filters.Selected(dbName) {
+			summary.skip(dbName, "excluded by filters")
+			continue
+		}
+		if !named && len(cfg.Backup.Owners) > 0 && !slices.Contains(cfg.Backup.Owners, database.owner) {
+			summary.skip(dbName, "not owned by "+strings.Join(cfg.Backup.Owners, " or "))
+			continue
+		}
+		if !named && !database.canConnect {
+			if cfg.Backup.Strict {
+				log.Printf("Failed to backup database %s: no connect privilege", dbName)
+				summary.fail(dbName)
+				errs = append(errs, fmt.Errorf("database %s: no connect privilege", dbName))
+			} else {
+				summary.skip(dbName, "no connect privilege")
+			}
+			continue
+		}
+		database.position = len(selected) + 1
+		selected = append(selected, database)
+	}
+
+	// Report the order, noting priority databases that are not backed up
+	var prioritized []string
+	for _, dbName := range cfg.Backup.Priority {
+		if slices.ContainsFunc(selected, func(database databaseInfo) bool { return database.name == dbName }) {
+			prioritized = append(prioritized, dbName)
+		} else {
+			log.Printf("Priority database %s is not backed up in this run", dbName)
+		}
+	}
+	if len(prioritized) > 0 {
+		summary.setting("order", fmt.Sprintf("priority (%s), then %s", strings.Join(prioritized, ", "), cfg.Backup.Order))
+	} else {
+		summary.setting("order", cfg.Backup.Order)
+	}
+	for _, database := range selected {
+		summary.queue(database.name)
+	}
+
+	// Find the backups the dumps may be identical to
+	var previous map[string]types.Object
+	if cfg.Backup.Dedupe || cfg.Backup.SkipUnchanged || cfg.Backup.SkipIfBackedUpWithin > 0 {
+		if previous, err = latestBackups(ctx, s3Client, cfg, tmpl); err != nil {
+			return err
+		}
+	}
+
+	// Backup the databases, cfg.Backup.Concurrency at a time
+	run := &backupRun{
+		cfg:          cfg,
+		runID:        runID,
+		s3Client:     s3Client,
+		kmsClient:    kmsClient,
+		tmpl:         tmpl,
+		layout:       layout,
+		compressArgs: compressArgs,
+		provenance:   provenance,
+		total:        len(selected),
+		previous:     previous,
+		summary:      summary,
+		manifest:     runManifest,
+		names:        make(map[string]string),
+		errs:         errs,
+	}
+	summary.setting("concurrency", strconv.Itoa(cfg.Backup.Concurrency))
+	summary.setting("on error", cfg.OnError)
+
+	// With -on-error abort the first failure cancels the rest of the run,
+	// the backups in progress included; databases -strict already failed
+	// stop it before it starts
+	if cfg.OnError == "abort" {
+		var abort context.CancelCauseFunc
+		ctx, abort = context.WithCancelCause(ctx)
+		defer abort(nil)
+		run.abort = abort
+		if len(errs) > 0 {
+			abort(fmt.Errorf("%w after database %s failed", errRunAborted, summary.failed[0]))
+		}
+	}
+	if cfg.Backup.PauseBetween > 0 {
+		summary.setting("pause between", cfg.Backup.PauseBetween.String())
+	}
+	queue := make(chan databaseInfo, cfg.Backup.Concurrency)
+	var wg sync.WaitGroup
+	for range cfg.Backup.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			first := true
+			for database := range queue {
+				if !first && cfg.Backup.PauseBetween > 0 {
+					fmt.Printf("Pausing %s before backing up database %s\n", cfg.Backup.PauseBetween, database.name)
+					pause(ctx, cfg.Backup.PauseBetween)
+				}
+				first = false
+				if ctx.Err() != nil {
+					run.abandon(database.name)
+					continue
+				}
+				run.backup(ctx, database)
+			}
+		}()
+	}
+queue:
+	for i, database := range selected {
+		select {
+		case queue <- database:
+		case <-ctx.Done():
+			for _, database := range selected[i:] {
+				run.abandon(database.name)
+			}
+			break queue
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	// Record what the run uploaded
+	runManifest.Finished = time.Now().UTC()
+	if err := uploadManifest(context.WithoutCancel(ctx), s3Client, cfg.S3, objectTags(cfg, "", cfg.Retention.Days), runManifest); err != nil {
+		log.Printf("Failed to upload manifest: %v", err)
+	}
+
+	summary.print(os.Stdout)
+	switch cause := context.Cause(ctx); {
+	case cause == errRunTimeout:
+		run.errs = append(run.errs, fmt.Errorf("%w after %s, %d databases not attempted", errRunTimeout, cfg.Timeouts.Run, len(summary.notAttempted)))
+	case errors.Is(cause, errRunAborted):
+		run.errs = append(run.errs, fmt.Errorf("%w, %d databases not attempted", cause, len(summary.notAttempted)))
+	}
+	return errors.Join(run.errs...)
+}
+
+// backupRun holds the state shared by the workers of a backup run.
+type backupRun struct {
+	cfg          *config.Config
+	runID        string
+	s3Client     *s3.Client
+	kmsClient    *kms.Client
+	tmpl         *naming.Template
+	layout       naming.Layout
+	compressArgs []string
+	provenance   map[string]string // metadata recording where the backups come from
+	total        int               // databases selected for backup
+
+	// previous holds the latest earlier backup of each database, to
+	// deduplicate against or to find recently backed up and unchanged
+	// databases by; it is only read once the workers start.
+	previous map[string]types.Object
+
+	// abort cancels the run at the first failure under -on-error abort,
+	// and is nil otherwise
+	abort context.CancelCauseFunc
+
+	// mu guards the fields below
+	mu       sync.Mutex
+	summary  *runSummary
+	manifest *manifest
+	names    map[string]string // backup name to database
+	reserved int64             // work directory bytes claimed by dumps in progress
+	errs     []error
+}
+
+// backup backs up a single database and records the outcome.
+func (r *backupRun) backup(ctx context.Context, database databaseInfo) {
+	dbLog := newDatabaseLog(database.name, r.cfg.Backup.Concurrency > 1)
+	entry, err := r.backupAndUpload(ctx, dbLog, database)
+	if err != nil && context.Cause(ctx) == errRunTimeout {
+		err = fmt.Errorf("%w: %w", errRunTimeout, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var skip *skipError
+	if errors.As(err, &skip) {
+		r.summary.skip(database.name, skip.reason)
+		return
+	}
+	if err != nil {
+		dbLog.err.Printf("Failed to backup database %s: %v", database.name, err)
+		r.summary.fail(database.name)
+		r.errs = append(r.errs, fmt.Errorf("database %s: %w", database.name, err))
+		if r.abort != nil {
+			r.abort(fmt.Errorf("%w after database %s failed", errRunAborted, database.name))
+		}
+		return
+	}
+	r.summary.succeed(database.name)
+	r.manifest.Backups = append(r.manifest.Backups, entry)
+}
+
+// backupAndUpload dumps a single database and uploads the dump, returning
+// its manifest entry.
+func (r *backupRun) backupAndUpload(ctx context.Context, dbLog *databaseLog, database databaseInfo) (_ manifestEntry, err error) {
+	cfg, dbName := r.cfg, database.name
+	settings, overridden := cfg.ForDatabase(dbName)
+	source := "defaults"
+	if overridden {
+		source = "databases." + dbName
+	}
+	dbLog.out.Printf("Backing up database %d of %d: %s (size=%s, format=%s, jobs=%d, retention-days=%d, timeout=%s, from %s)\n", database.position, r.total, dbName, formatSize(database.size), settings.Format, settings.Jobs, settings.RetentionDays, settings.Timeout, source)
+	if !settings.Tables.IsZero() {
+		dbLog.out.Printf("Dumping part of database %s: %s\n", dbName, settings.Tables)
+	}
+
+	// Bound the dump and upload; expiry kills pg_dump and aborts the upload
+	if settings.Timeout > 0 {
+		timeout := fmt.Errorf("timed out after %s", settings.Timeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, settings.Timeout, timeout)
+		defer cancel()
+		defer func() {
+			if err != nil && context.Cause(ctx) == timeout {
+				err = fmt.Errorf("%w: %w", timeout, err)
+			}
+		}()
+	}
+
+	// Skip the database when an earlier run backed it up recently
+	if window := cfg.Backup.SkipIfBackedUpWithin; window > 0 {
+		if previous, ok := r.previous[dbName]; ok && time.Since(aws.ToTime(previous.LastModified)) < window {
+			dbLog.out.Printf("Database %s was backed up to s3://%s/%s at %s, within %s\n", dbName, cfg.S3.Bucket, aws.ToString(previous.Key),
+				aws.ToTime(previous.LastModified).Local().Format(time.DateTime), window)
+			return manifestEntry{}, &skipError{"backed up within " + window.String()}
+		}
+	}
+
+	// Skip the database when nothing changed since its last backup
+	markers, err := changeMarkers(ctx, cfg, dbName)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	if markers != "" {
+		dbLog.out.Printf("Change markers of %s: %s\n", dbName, markers)
+	}
+	if cfg.Backup.SkipUnchanged && r.unchanged(ctx, dbLog, dbName, settings, markers) {
+		return manifestEntry{}, &skipError{"unchanged since the last backup"}
+	}
+
+	// Make sure the dump fits in the work directory
+	release, err := r.reserveSpace(dbLog, database)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	defer release()
+
+	// Name the backup, refusing names that would overwrite another database's backup
+	now := time.Now()
+	name, err := backupName(cfg, r.tmpl, dbName, settings, now)
+	if err != nil {
+		return manifestEntry{}, fmt.Errorf("failed to name backup: %w", err)
+	}
+	name += compressionSuffixes[cfg.Dump.Compress] + encryptionSuffixes[cfg.Encryption.Scheme]
+	if err := r.claimName(name, dbName); err != nil {
+		return manifestEntry{}, err
+	}
+
+	s3Key := r.layout.Key(cfg.S3.Prefix, hostLabel(cfg.Postgres), dbName, now, name)
+
+	// Identify the key the backup is encrypted with, getting a data key of
+	// its own from KMS
+	dataKey, encryptionMetadata, err := newEncryption(ctx, r.kmsClient, cfg.Encryption, kmsEncryptionContext(dbName, s3Key))
+	if err != nil {
+		return manifestEntry{}, err
+	}
+
+	// Backup the database; pg_dump only compresses custom and directory
+	// archives internally, plain scripts would become gzip files
+	var dumpArgs []string
+	if settings.Format == "custom" || settings.Format == "directory" {
+		dumpArgs = r.compressArgs
+	}
+	dumped, err := backupDatabase(ctx, cfg, dbLog, dbName, workPath(cfg.WorkDir, r.runID, name), settings, dumpArgs, dataKey)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	backupFilePath, digest := dumped.path, dumped.sha256
+	keep := false
+	defer func() {
+		if !keep {
+			os.Remove(backupFilePath) // Clean up the file after uploading
+		}
+	}()
+	finished := time.Now()
+	dbLog.out.Printf("SHA-256 of %s: %s\n", name, digest)
+
+	// Upload the backup to S3
+	metadata := r.settingsMetadata(settings)
+	metadata["sha256"] = digest
+	metadata["database"] = dbName
+	metadata["started"] = now.UTC().Format(time.RFC3339)
+	metadata["finished"] = finished.UTC().Format(time.RFC3339)
+	if markers != "" {
+		metadata["change-markers"] = markers
+	}
+	if dumped.dumpSHA256 != "" {
+		metadata["dump-sha256"] = dumped.dumpSHA256
+	}
+	if database.collation != "" {
+		metadata["collation"] = database.collation
+	}
+	if database.collationVersion != "" {
+		metadata["collation-version"] = database.collationVersion
+	}
+	maps.Copy(metadata, r.provenance)
+	maps.Copy(metadata, encryptionMetadata)
+
+	// Point at the previous backup instead when the dump is unchanged
+	if cfg.Backup.Dedupe {
+		if entry, ok := r.deduplicate(ctx, dbLog, dbName, settings, metadata); ok {
+			return entry, nil
+		}
+	}
+
+	info, err := os.Stat(backupFilePath)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	tags := objectTags(cfg, dbName, settings.RetentionDays)
+	progress := newProgressReporter(cfg, dbLog.out, dbName)
+	var attempts, parts int
+	if maxSize := int64(cfg.S3.MaxObjectSize); maxSize > 0 && info.Size() > maxSize {
+		parts = len(dumped.partSHA256s)
+		attempts, err = uploadSplit(ctx, r.s3Client, backupFilePath, info.Size(), dumped.partSHA256s, cfg.S3, s3Key, metadata, tags, progress)
+	} else {
+		attempts, err = uploadToS3(ctx, r.s3Client, backupFilePath, cfg.S3, s3Key, metadata, tags, progress)
+	}
+	r.mu.Lock()
+	r.summary.uploaded(dbName, attempts)
+	r.mu.Unlock()
+	if err != nil {
+		// Keep the dump, which may have taken hours, for a manual upload
+		if cfg.Backup.KeepFailedUploads {
+			if uploadPath, keepErr := keepFailedUpload(backupFilePath, cfg.S3.Bucket, s3Key, metadata, tags); keepErr != nil {
+				dbLog.err.Printf("Failed to keep %s: %v", backupFilePath, keepErr)
+			} else {
+				keep = true
+				dbLog.err.Printf("Kept %s to be uploaded to s3://%s/%s by hand, with the metadata and tags in %s", backupFilePath, cfg.S3.Bucket, s3Key, uploadPath)
+			}
+		}
+		return manifestEntry{}, err
+	}
+
+	// Keep the dump on local disk too, for quick restores
+	if cfg.Local.Dir != "" {
+		if err := keepLocalCopy(dbLog, cfg.Local, dbName, backupFilePath, s3Key); err != nil {
+			dbLog.err.Printf("Warning: %v", err)
+		} else {
+			keep = true
+		}
+	}
+	return manifestEntry{
+		Database:    dbName,
+		Key:         s3Key,
+		Size:        info.Size(),
+		SHA256:      digest,
+		Format:      settings.Format,
+		Content:     dumpContent(cfg.Dump),
+		Compression: cfg.Dump.Compress,
+		Blobs:       cfg.Dump.Blobs,
+		Encryption:  cfg.Encryption.Scheme,
+		Partial:     !settings.Tables.IsZero(),
+		Tables:      settings.Tables,
+		Parts:       parts,
+	}, nil
+}
+
+// settingsMetadata returns the metadata recording what a backup with
+// settings holds and how it is stored.
+func (r *backupRun) settingsMetadata(settings config.Database) map[string]string {
+	return map[string]string{
+		"format":            settings.Format,
+		"content":           dumpContent(r.cfg.Dump),
+		"compression":       r.cfg.Dump.Compress,
+		"compression-level": strconv.Itoa(r.cfg.Dump.CompressLevel),
+		"partial":           strconv.FormatBool(!settings.Tables.IsZero()),
+		"blobs":             strconv.FormatBool(r.cfg.Dump.Blobs),
+		"encryption":        r.cfg.Encryption.Scheme,
+	}
+}
+
+// backupFields lists the metadata that must match for a backup to stand in
+// for another: what it holds and how it is stored.
+var backupFields = []string{"format", "content", "partial", "blobs", "compression", "encryption"}
+
+// previousBackup returns the latest earlier backup of dbName when it can
+// stand in for a new one. A backup within a day of the end of its retention
+// cannot, so that a fresh copy is taken before it is pruned.
+func (r *backupRun) previousBackup(dbLog *databaseLog, dbName string, settings config.Database) (types.Object, bool) {
+	previous, ok := r.previous[dbName]
+	if !ok {
+		return types.Object{}, false
+	}
+	if settings.RetentionDays > 0 && time.Since(aws.ToTime(previous.LastModified)) > time.Duration(settings.RetentionDays-1)*24*time.Hour {
+		dbLog.out.Printf("Previous backup s3://%s/%s is due to be pruned\n", r.cfg.S3.Bucket, aws.ToString(previous.Key))
+		return types.Object{}, false
+	}
+	return previous, true
+}
+
+// deduplicate returns the manifest entry of the latest backup of dbName
+// when the dump with metadata is identical to it, reporting false when the
+// dump has to be uploaded.
+func (r *backupRun) deduplicate(ctx context.Context, dbLog *databaseLog, dbName string, settings config.Database, metadata map[string]string) (manifestEntry, bool) {
+	if metadata["dump-sha256"] == "" {
+		return manifestEntry{}, false
+	}
+	previous, ok := r.previousBackup(dbLog, dbName, settings)
+	if !ok {
+		return manifestEntry{}, false
+	}
+	s3Key := aws.ToString(previous.Key)
+	previousMetadata, err := headS3Object(ctx, r.s3Client, r.cfg.S3.Bucket, s3Key, "")
+	if err != nil {
+		dbLog.err.Printf("Warning: failed to compare with the previous backup, uploading the dump: %v", err)
+		return manifestEntry{}, false
+	}
+	if previousMetadata["dump-sha256"] == "" {
+		dbLog.out.Printf("Previous backup s3://%s/%s records no dump digest, uploading the dump\n", r.cfg.S3.Bucket, s3Key)
+		return manifestEntry{}, false
+	}
+	for _, field := range append(backupFields, "dump-sha256") {
+		if previousMetadata[field] != metadata[field] {
+			return manifestEntry{}, false
+		}
+	}
+
+	dbLog.out.Printf("Dump of %s is identical to s3://%s/%s, skipping the upload\n", dbName, r.cfg.S3.Bucket, s3Key)
+	r.mu.Lock()
+	r.summary.dedupe(dbName)
+	r.mu.Unlock()
+	return manifestEntry{
+		Database:     dbName,
+		Key:          s3Key,
+		Size:         aws.ToInt64(previous.Size),
+		SHA256:       previousMetadata["sha256"],
+		Format:       settings.Format,
+		Content:      metadata["content"],
+		Compression:  metadata["compression"],
+		Blobs:        r.cfg.Dump.Blobs,
+		Encryption:   metadata["encryption"],
+		Partial:      !settings.Tables.IsZero(),
+		Tables:       settings.Tables,
+		Deduplicated: true,
+	}, true
+}
+
+// latestBackups returns the most recent backup of each database below the
+// prefix.
+func latestBackups(ctx context.Context, s3Client *s3.Client, cfg *config.Config, tmpl *naming.Template) (map[string]types.Object, error) {
+	objects, err := listS3Objects(ctx, s3Client, cfg.S3.Bucket, cfg.S3.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]types.Object)
+	for _, object := range objects {
+		s3Key := aws.ToString(object.Key)
+		if isManifestKey(s3Key) || isGlobalsKey(s3Key) {
+			continue
+		}
+		fields, ok := matchBackupKey(tmpl, s3Key)
+		if !ok {
+			continue
+		}
+		if current, ok := latest[fields.Database]; !ok || aws.ToTime(object.LastModified).After(aws.ToTime(current.LastModified)) {
+			latest[fields.Database] = object
+		}
+	}
+	return latest, nil
+}
+
+// failedUpload records where a kept dump was to be uploaded, and with which
+// metadata and tags; the metadata of a KMS-encrypted dump holds the only
+// copy of its wrapped data key.
+type failedUpload struct {
+	Bucket   string            `json:"bucket"`
+	Key      string            `json:"key"`
+	Metadata map[string]string `json:"metadata"`
+	Tags     map[string]string `json:"tags"`
+}
+
+// keepFailedUpload writes the upload of the dump backupFilePath, which
+// failed, next to it and returns the path of the file written.
+func keepFailedUpload(backupFilePath, s3Bucket, s3Key string, metadata, tags map[string]string) (string, error) {
+	data, err := json.MarshalIndent(failedUpload{s3Bucket, s3Key, metadata, tags}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	uploadPath := backupFilePath + ".upload.json"
+	if err := os.WriteFile(uploadPath, append(data, '\n'), 0o600); err != nil {
+		return "", err
+	}
+	return uploadPath, nil
+}
+
+// backupProvenance returns the object metadata that records which server,
+// and which versions of PostgreSQL, pg_dump and pgbackup, the backups of a
+// run come from.
+func backupProvenance(ctx context.Context, cfg *config.Config) (map[string]string, error) {
+	serverVersion, err := postgres.ServerRelease(ctx, cfg.Postgres, cfg.Timeouts)
+	if err != nil {
+		return nil, err
+	}
+	pgDumpVersion, err := postgres.ToolRelease(ctx, "pg_dump")
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"source-host":     hostLabel(cfg.Postgres),
+		"source-port":     strconv.Itoa(cfg.Postgres.Port),
+		"server-version":  serverVersion,
+		"pg-dump-version": pgDumpVersion,
+		"tool-version":    toolVersion(),
+	}, nil
+}
+
+// pause waits for d or until ctx is done, whichever comes first.
+func pause(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// abandon records that the run ended before dbName was backed up.
+func (r *backupRun) abandon(dbName string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.summary.abandon(dbName)
+}
+
+// claimName reserves the backup name for dbName, failing when another
+// database of the run already uses it.
+func (r *backupRun) claimName(name, dbName string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if other, ok := r.names[name]; ok {
+		return fmt.Errorf("backup name %s collides with database %s", name, other)
+	}
+	r.names[name] = dbName
+	return nil
+}
+
+// orderDatabases sorts databases in place into the backup order: those in
+// priority first, in the given order, then the others by order. Databases of
+// unknown size are backed up last by smallest-first and largest-first.
+func orderDatabases(databases []databaseInfo, order string, priority []string) {
+	rank := func(name string) int {
+		if i := slices.Index(priority, name); i >= 0 {
+			return i
+		}
+		return len(priority)
+	}
+	slices.SortStableFunc(databases, func(a, b databaseInfo) int {
+		if c := cmp.Compare(rank(a.name), rank(b.name)); c != 0 {
+			return c
+		}
+		if order != "name" && a.size != b.size {
+			switch {
+			case a.size < 0:
+				return 1
+			case b.size < 0:
+				return -1
+			case order == "largest-first":
+				return cmp.Compare(b.size, a.size)
+			default:
+				return cmp.Compare(a.size, b.size)
+			}
+		}
+		return strings.Compare(a.name, b.name)
+	})
+}
+
+// formatSize renders a size in bytes for humans, e.g. 1.5 GiB.
+func formatSize(size int64) string {
+	if size < 0 {
+		return "unknown"
+	}
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// describePgDumpCompression renders the pg_dump compression arguments for
+// the run summary.
+func describePgDumpCompression(args []string) string {
+	if len(args) == 0 {
+		return "pg_dump default"
+	}
+	return strings.Join(args, " ")
+}
+
+// describeCompression renders the compression applied before upload for the
+// run summary.
+func describeCompression(compression string, level int) string {
+	if compression == "none" || level == 0 {
+		return compression
+	}
+	return fmt.Sprintf("%s (level %d)", compression, level)
+}
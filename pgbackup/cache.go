@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"dbbackup/internal/config"
+)
+
+// downloadCache keeps downloaded objects in a directory across restores,
+// so that restoring the same backup again only costs a HeadObject. Each
+// object has a directory named after a digest of its bucket and key,
+// holding a single file named after the ETag it was downloaded at. Files
+// are used as links or copies and evicted least recently used first once
+// they add up to more than limit bytes.
+type downloadCache struct {
+	dir   string
+	limit int64 // 0 for no limit
+
+	// mu keeps evictions from racing each other
+	mu sync.Mutex
+}
+
+// newDownloadCache returns the cache in dir, or nil when dir is empty.
+func newDownloadCache(dir string, limit config.ByteSize) *downloadCache {
+	if dir == "" {
+		return nil
+	}
+	return &downloadCache{dir: dir, limit: int64(limit)}
+}
+
+// download places s3Key at dst, from the cache when the object's ETag is
+// the one cached and from S3 otherwise, keeping the download for later.
+// Without a cache it just downloads the object.
+func (c *downloadCache) download(ctx context.Context, s3Client *s3.Client, s3Cfg config.S3, s3Key, dst string) error {
+	if c == nil {
+		return downloadFromS3(ctx, s3Client, s3Cfg, s3Key, "", dst)
+	}
+	head, err := headCachedObject(ctx, s3Client, s3Cfg, s3Key)
+	if err != nil {
+		return err
+	}
+	etag := strings.Trim(aws.ToString(head.ETag), `"`)
+	entryDir := c.entryDir(s3Cfg.Bucket, s3Key)
+	cached := filepath.Join(entryDir, etag)
+
+	// Use the cached file when it is whole
+	if info, err := os.Stat(cached); err == nil && info.Size() == aws.ToInt64(head.ContentLength) {
+		now := time.Now()
+		if err := os.Chtimes(cached, now, now); err != nil {
+			log.Printf("Warning: failed to mark cached download %s as used: %v", cached, err)
+		}
+		if err := linkOrCopy(cached, dst); err != nil {
+			return fmt.Errorf("failed to use cached download %s: %w", cached, err)
+		}
+		fmt.Printf("Using cached download of s3://%s/%s (ETag %s) from %s\n", s3Cfg.Bucket, s3Key, etag, cached)
+		return nil
+	}
+
+	// Download into the cache, replacing the object's earlier ETags, and
+	// make room for it
+	if err := os.RemoveAll(entryDir); err != nil {
+		return fmt.Errorf("failed to remove stale cached download %s: %w", entryDir, err)
+	}
+	if err := os.MkdirAll(entryDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create cache directory %s: %w", entryDir, err)
+	}
+	partial := cached + ".partial"
+	if err := downloadFromS3(ctx, s3Client, s3Cfg, s3Key, "", partial); err != nil {
+		os.RemoveAll(entryDir)
+		return err
+	}
+	if err := os.Rename(partial, cached); err != nil {
+		os.RemoveAll(entryDir)
+		return fmt.Errorf("failed to cache download of s3://%s/%s: %w", s3Cfg.Bucket, s3Key, err)
+	}
+	c.evict(cached)
+	if err := linkOrCopy(cached, dst); err != nil {
+		return fmt.Errorf("failed to use cached download %s: %w", cached, err)
+	}
+	return nil
+}
+
+// headCachedObject reads the ETag and size of s3Key, retrying errors that
+// may be transient like the downloads it decides on.
+func headCachedObject(ctx context.Context, s3Client *s3.Client, s3Cfg config.S3, s3Key string) (*s3.HeadObjectOutput, error) {
+	for attempt := 1; ; attempt++ {
+		head, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(s3Cfg.Bucket),
+			Key:    aws.String(s3Key),
+		})
+		if err == nil {
+			return head, nil
+		}
+		if attempt >= s3Cfg.DownloadAttempts || !isRetryable(err) {
+			if attempt > 1 {
+				return nil, fmt.Errorf("failed to read metadata of s3://%s/%s after %d attempts: %w", s3Cfg.Bucket, s3Key, attempt, err)
+			}
+			return nil, fmt.Errorf("failed to read metadata of s3://%s/%s: %w", s3Cfg.Bucket, s3Key, err)
+		}
+		delay := uploadBackoff(s3Cfg.DownloadBackoff, attempt)
+		log.Printf("Attempt %d of %d to read metadata of s3://%s/%s failed, retrying in %s: %v", attempt, s3Cfg.DownloadAttempts, s3Cfg.Bucket, s3Key, delay.Round(time.Millisecond), err)
+		pause(ctx, delay)
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("failed to read metadata of s3://%s/%s: %w", s3Cfg.Bucket, s3Key, err)
+		}
+	}
+}
+
+// forget removes the cached download of s3Key, such as one that failed
+// its checksum.
+func (c *downloadCache) forget(s3Bucket, s3Key string) {
+	if c == nil {
+		return
+	}
+	if err := os.RemoveAll(c.entryDir(s3Bucket, s3Key)); err != nil {
+		log.Printf("Warning: failed to remove cached download of s3://%s/%s: %v", s3Bucket, s3Key, err)
+	}
+}
+
+// entryDir returns the directory holding the cached download of s3Key.
+func (c *downloadCache) entryDir(s3Bucket, s3Key string) string {
+	sum := sha256.Sum256([]byte(s3Bucket + "/" + s3Key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// cachedFile is a file of the cache, as found by evict.
+type cachedFile struct {
+	path string
+	size int64
+	used time.Time
+}
+
+// evict removes the least recently used files of the cache until the rest
+// fit within its limit, keeping the file keep even when it does not fit on
+// its own. Downloads still in progress are left alone.
+func (c *downloadCache) evict(keep string) {
+	if c.limit == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var files []cachedFile
+	var total int64
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(path, ".partial") {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil // removed meanwhile
+		}
+		files = append(files, cachedFile{path, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		log.Printf("Warning: failed to read download cache %s: %v", c.dir, err)
+		return
+	}
+	slices.SortFunc(files, func(a, b cachedFile) int { return a.used.Compare(b.used) })
+	for _, f := range files {
+		if total <= c.limit {
+			break
+		}
+		if f.path == keep {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Dir(f.path)); err != nil {
+			log.Printf("Warning: failed to evict cached download %s: %v", f.path, err)
+			continue
+		}
+		fmt.Printf("Evicted cached download %s (%s)\n", f.path, formatSize(f.size))
+		total -= f.size
+	}
+}
+
+// cacheDescription describes the download cache of a run for its summary.
+func cacheDescription(restoreCfg config.Restore) string {
+	if restoreCfg.CacheDir == "" || restoreCfg.NoCache || strings.HasPrefix(restoreCfg.Source, "dir:") {
+		return "off"
+	}
+	return fmt.Sprintf("%s, limit %s", restoreCfg.CacheDir, prefetchBudget(restoreCfg.CacheSize))
+}
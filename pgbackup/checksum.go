@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"slices"
+)
+
+// digestFile is a backup file being written that computes the SHA-256 of
+// its contents on the way, so the digest needs no second pass over the file.
+// With a partSize, it also digests each partSize bytes of the file, the
+// parts it is uploaded in when it is too large for a single object.
+type digestFile struct {
+	file *os.File
+	hash hash.Hash
+
+	partSize    int64
+	partHash    hash.Hash // of the part being written, nil between parts
+	partWritten int64
+	partSums    []string // of the parts written in full
+}
+
+// createDigestFile creates the file path for writing.
+func createDigestFile(path string) (*digestFile, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create backup file: %w", err)
+	}
+	return &digestFile{file: file, hash: sha256.New()}, nil
+}
+
+func (f *digestFile) Write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+	f.hash.Write(p[:n])
+	if f.partSize > 0 {
+		f.digestParts(p[:n])
+	}
+	return n, err
+}
+
+// digestParts digests p into the parts being written.
+func (f *digestFile) digestParts(p []byte) {
+	for len(p) > 0 {
+		if f.partHash == nil {
+			f.partHash = sha256.New()
+		}
+		k := min(int64(len(p)), f.partSize-f.partWritten)
+		f.partHash.Write(p[:k])
+		f.partWritten += k
+		p = p[k:]
+		if f.partWritten == f.partSize {
+			f.partSums = append(f.partSums, hex.EncodeToString(f.partHash.Sum(nil)))
+			f.partHash, f.partWritten = nil, 0
+		}
+	}
+}
+
+// Close closes the file; closing it again is harmless.
+func (f *digestFile) Close() error {
+	if err := f.file.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return fmt.Errorf("failed to write backup file: %w", err)
+	}
+	return nil
+}
+
+// Sum returns the hex-encoded SHA-256 of the data written so far.
+func (f *digestFile) Sum() string {
+	return hex.EncodeToString(f.hash.Sum(nil))
+}
+
+// PartSums returns the hex-encoded SHA-256 of each part of the data written
+// so far, the last of which may be short.
+func (f *digestFile) PartSums() []string {
+	if f.partHash == nil {
+		return slices.Clone(f.partSums)
+	}
+	return append(slices.Clone(f.partSums), hex.EncodeToString(f.partHash.Sum(nil)))
+}
+
+// sha256Hex returns the hex-encoded SHA-256 of data.
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// fileSHA256 returns the hex-encoded SHA-256 of the file at path.
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"dbbackup/internal/config"
+	"dbbackup/internal/postgres"
+)
+
+// collationVersionColumn returns the expression selecting the version of
+// the library providing a database's collation from pg_database, on a
+// server of version, or an empty string where the server cannot tell.
+func collationVersionColumn(version int) string {
+	if version < 150000 {
+		return "''"
+	}
+	return "COALESCE(pg_database_collation_actual_version(oid), '')"
+}
+
+// releaseMajor returns the major version of release as a number ordering
+// major versions, e.g. 1600 for "16.2" and 906 for "9.6.24", whose major
+// versions had two parts, or 0 when it cannot be read.
+func releaseMajor(release string) int {
+	parts := strings.SplitN(release, ".", 3)
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0
+	}
+	if major >= 10 {
+		return major * 100
+	}
+	if len(parts) < 2 {
+		return 0
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0
+	}
+	return major*100 + minor
+}
+
+// serverCollation is the collation of a database of the target server.
+type serverCollation struct {
+	name, version string
+}
+
+// checkCompatibility describes what restoring the backups of sources on
+// the target server, of release, may silently break: backups of a newer
+// server than the target, taken with a newer pg_dump than the local
+// pg_restore reads, or of a database whose collation differs, in name or
+// in the version of the library providing it, from the one it is restored
+// with. That is the collation of the existing target database, or of the
+// database it is created with.
+func checkCompatibility(ctx context.Context, cfg *config.Config, release string, targets []string, sources map[string][]restoreSource) ([]string, error) {
+	db, err := postgres.Open(cfg.Postgres, cfg.Timeouts, cfg.Postgres.Database)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var version int
+	if err := db.QueryRowContext(ctx, "SHOW server_version_num").Scan(&version); err != nil {
+		return nil, fmt.Errorf("failed to query server version: %w", err)
+	}
+	rows, err := db.QueryContext(ctx, "SELECT datname, datcollate, "+collationVersionColumn(version)+" FROM pg_database")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query databases: %w", err)
+	}
+	defer rows.Close()
+	collations := make(map[string]serverCollation)
+	for rows.Next() {
+		var name string
+		var c serverCollation
+		if err := rows.Scan(&name, &c.name, &c.version); err != nil {
+			return nil, fmt.Errorf("failed to scan database collation: %w", err)
+		}
+		collations[name] = c
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query databases: %w", err)
+	}
+
+	// pg_restore refuses archives of a newer pg_dump than its own; without
+	// pg_restore archives fail to restore anyway
+	pgRestore, _ := postgres.ToolRelease(ctx, "pg_restore")
+
+	var warnings []string
+	warn := func(format string, args ...any) {
+		if w := fmt.Sprintf(format, args...); !slices.Contains(warnings, w) {
+			warnings = append(warnings, w)
+		}
+	}
+	for _, target := range targets {
+		// A target that is kept is restored with its own collation, one
+		// that is created with that of the options or the template
+		restored, exists := collations[target]
+		if !exists || cfg.Restore.DropExisting {
+			restored = collations[cmp.Or(cfg.Restore.Create.Template, "template1")]
+			if cfg.Restore.Create.Locale != "" {
+				restored = serverCollation{name: cfg.Restore.Create.Locale}
+			}
+		}
+
+		for _, b := range sources[target] {
+			metadata := b.metadata
+			if source := metadata["server-version"]; releaseMajor(source) > releaseMajor(release) && releaseMajor(release) > 0 {
+				warn("database %s was backed up from PostgreSQL %s, newer than the target's %s; its dump may use features the target lacks", b.database, source, release)
+			}
+			if pgDump := metadata["pg-dump-version"]; releaseMajor(pgDump) > releaseMajor(pgRestore) && releaseMajor(pgRestore) > 0 {
+				warn("database %s was backed up with pg_dump %s, newer than the local pg_restore %s, which may not read it", b.database, pgDump, pgRestore)
+			}
+			collation := metadata["collation"]
+			switch {
+			case collation == "" || restored.name == "":
+			case collation != restored.name:
+				warn("database %s was backed up with collation %s and is restored into %s with collation %s, which may sort text differently", b.database, collation, target, restored.name)
+			case metadata["collation-version"] != "" && restored.version != "" && metadata["collation-version"] != restored.version:
+				warn("collation %s of database %s had version %s where it was backed up and has version %s on the target; indexes on text may need REINDEX", collation, b.database, metadata["collation-version"], restored.version)
+			}
+		}
+	}
+	return warnings, nil
+}
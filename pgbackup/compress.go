@@ -0,0 +1,142 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"dbbackup/internal/naming"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressionSuffixes maps each compression mode to the suffix appended to
+// the names of objects it produced.
+var compressionSuffixes = map[string]string{
+	"none": "",
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+// compressWriter returns a writer that compresses into w with compression
+// at level, 0 meaning the compression's default. Closing it flushes the
+// compressed stream but does not close w.
+func compressWriter(w io.Writer, compression string, level int) (io.WriteCloser, error) {
+	switch compression {
+	case "none":
+		return nopWriteCloser{w}, nil
+	case "gzip":
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case "zstd":
+		if level == 0 {
+			return zstd.NewWriter(w)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// decompressReader returns a reader of the data compressed in r.
+func decompressReader(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+}
+
+// compressionForKey returns the compression of the object called key,
+// judging by its suffix, and the key without that suffix.
+func compressionForKey(key string) (string, string) {
+	for compression, suffix := range compressionSuffixes {
+		if suffix != "" && strings.HasSuffix(key, suffix) {
+			return compression, strings.TrimSuffix(key, suffix)
+		}
+	}
+	return "none", key
+}
+
+// matchBackupKey parses the backup key with tmpl, ignoring any compression
+// and encryption suffixes added after the template was rendered.
+func matchBackupKey(tmpl *naming.Template, key string) (naming.Fields, bool) {
+	_, key = encryptionForKey(key)
+	_, key = compressionForKey(key)
+	return tmpl.MatchKey(key)
+}
+
+// legacyBackupName matches the names backups were given before there was a
+// filename template, database_backup_YYYYMMDD_HHMMSS, followed by whatever
+// extension they were stored with.
+var legacyBackupName = regexp.MustCompile(`^(.+)_backup_[0-9]{8}_[0-9]{6}(\.[A-Za-z0-9.]+)?$`)
+
+// databaseForKey returns the database of a backup uploaded without database
+// metadata, parsing its key with tmpl or else as a legacy name. It reports
+// false when neither yields a name.
+func databaseForKey(tmpl *naming.Template, key string) (string, bool) {
+	if fields, ok := matchBackupKey(tmpl, key); ok && fields.Database != "" {
+		return fields.Database, true
+	}
+	if m := legacyBackupName.FindStringSubmatch(path.Base(key)); m != nil {
+		return m[1], true
+	}
+	return "", false
+}
+
+// unwrapFile decrypts src with scheme, using identityFiles or dataKey as
+// decryptReader does, and decompresses it with compression into dst in a
+// single pass, so that only the dump itself is written out. keyID is the
+// key the backup records it is encrypted to, named when none of the
+// identities opens it.
+func unwrapFile(src, dst, scheme, compression string, identityFiles []string, dataKey []byte, keyID string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %w", err)
+	}
+	defer in.Close()
+
+	var r io.Reader = in
+	if scheme != "none" {
+		if r, err = decryptReader(in, scheme, identityFiles, dataKey); err != nil {
+			return keyRequiredError(scheme, keyID, fmt.Errorf("failed to decrypt %s: %w", src, err))
+		}
+	}
+	if compression != "none" {
+		dec, err := decompressReader(r, compression)
+		if err != nil {
+			return fmt.Errorf("failed to decompress %s: %w", src, err)
+		}
+		defer dec.Close()
+		r = dec
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %w", dst, err)
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to unwrap %s: %w", src, err)
+	}
+	return out.Close()
+}
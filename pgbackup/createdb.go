@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"dbbackup/internal/config"
+	"dbbackup/internal/postgres"
+
+	"github.com/lib/pq"
+)
+
+// createMissingDatabase creates dbName with the configured options unless
+// the server already has it, reporting whether it did.
+func createMissingDatabase(ctx context.Context, cfg *config.Config, dbLog *databaseLog, dbName string) (bool, error) {
+	db, err := postgres.Open(cfg.Postgres, cfg.Timeouts, cfg.Postgres.Database)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)", dbName).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to look up database %s: %w", dbName, err)
+	}
+	if exists {
+		return false, nil
+	}
+	statement := createDatabaseStatement(dbName, cfg.Restore.Create)
+	if _, err := db.ExecContext(ctx, statement); err != nil {
+		return false, err
+	}
+	dbLog.out.Printf("Created database %s: %s\n", dbName, statement)
+	return true, nil
+}
+
+// createDatabaseStatement returns the CREATE DATABASE statement for dbName
+// with the options set in create. CREATE DATABASE takes no parameters, so
+// names and values are quoted here.
+func createDatabaseStatement(dbName string, create config.CreateDatabase) string {
+	statement := []string{"CREATE DATABASE", pq.QuoteIdentifier(dbName)}
+	if create.Owner != "" {
+		statement = append(statement, "OWNER", pq.QuoteIdentifier(create.Owner))
+	}
+	if create.Template != "" {
+		statement = append(statement, "TEMPLATE", pq.QuoteIdentifier(create.Template))
+	}
+	if create.Encoding != "" {
+		statement = append(statement, "ENCODING", pq.QuoteLiteral(create.Encoding))
+	}
+	if create.Locale != "" {
+		statement = append(statement, "LOCALE", pq.QuoteLiteral(create.Locale))
+	}
+	if create.LocaleProvider != "" {
+		// Checked to be libc or icu when the config was loaded
+		statement = append(statement, "LOCALE_PROVIDER", create.LocaleProvider)
+	}
+	if create.ICULocale != "" {
+		statement = append(statement, "ICU_LOCALE", pq.QuoteLiteral(create.ICULocale))
+	}
+	return strings.Join(statement, " ")
+}
+
+// dropDatabase terminates the sessions connected to dbName and drops it,
+// returning how many sessions were terminated. PostgreSQL 13 and later drop
+// with FORCE, which also ends sessions that connected in between; earlier
+// servers first stop the database accepting connections.
+func dropDatabase(ctx context.Context, cfg *config.Config, dbLog *databaseLog, dbName string) (int, error) {
+	if dbName == cfg.Postgres.Database {
+		return 0, fmt.Errorf("cannot drop database %s, which the restore connects to; set postgres.database to another", dbName)
+	}
+	db, err := postgres.Open(cfg.Postgres, cfg.Timeouts, cfg.Postgres.Database)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)", dbName).Scan(&exists); err != nil {
+		return 0, fmt.Errorf("failed to look up database %s: %w", dbName, err)
+	}
+	if !exists {
+		return 0, nil
+	}
+	var version int
+	if err := db.QueryRowContext(ctx, "SHOW server_version_num").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to query server version: %w", err)
+	}
+
+	quoted := pq.QuoteIdentifier(dbName)
+	if version < 130000 {
+		if _, err := db.ExecContext(ctx, "ALTER DATABASE "+quoted+" ALLOW_CONNECTIONS false"); err != nil {
+			return 0, fmt.Errorf("failed to close database %s to new connections: %w", dbName, err)
+		}
+	}
+	var terminated int
+	err = db.QueryRowContext(ctx, `SELECT count(*) FILTER (WHERE pg_terminate_backend(pid))
+		FROM pg_stat_activity WHERE datname = $1 AND pid <> pg_backend_pid()`, dbName).Scan(&terminated)
+	if err != nil {
+		return 0, fmt.Errorf("failed to terminate the sessions of database %s: %w", dbName, err)
+	}
+	drop := "DROP DATABASE " + quoted
+	if version >= 130000 {
+		drop += " WITH (FORCE)"
+	}
+	if _, err := db.ExecContext(ctx, drop); err != nil {
+		return terminated, fmt.Errorf("failed to drop database %s: %w", dbName, err)
+	}
+	dbLog.out.Printf("Dropped database %s, terminating %d sessions\n", dbName, terminated)
+	return terminated, nil
+}
+
+// checkRestoreRole checks that role exists on the server and that the
+// connecting role may switch to it, creating it and granting it to the
+// connecting role with create.
+func checkRestoreRole(ctx context.Context, cfg *config.Config, role string, create bool) error {
+	db, err := postgres.Open(cfg.Postgres, cfg.Timeouts, cfg.Postgres.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)", role).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to look up role %s: %w", role, err)
+	}
+	if !exists {
+		if !create {
+			return fmt.Errorf("role %s does not exist on the server; create it or pass -create-role", role)
+		}
+		quoted := pq.QuoteIdentifier(role)
+		if _, err := db.ExecContext(ctx, "CREATE ROLE "+quoted+" NOLOGIN"); err != nil {
+			return fmt.Errorf("failed to create role %s: %w", role, err)
+		}
+		if _, err := db.ExecContext(ctx, "GRANT "+quoted+" TO CURRENT_USER"); err != nil {
+			return fmt.Errorf("failed to grant role %s to %s: %w", role, cfg.Postgres.User, err)
+		}
+		fmt.Printf("Created role %s and granted it to %s\n", role, cfg.Postgres.User)
+	}
+
+	var member bool
+	if err := db.QueryRowContext(ctx, "SELECT pg_has_role(current_user, $1, 'MEMBER')", role).Scan(&member); err != nil {
+		return fmt.Errorf("failed to check membership of role %s: %w", role, err)
+	}
+	if !member {
+		return fmt.Errorf("role %s cannot switch to role %s; grant it with GRANT %s TO %s", cfg.Postgres.User, role, pq.QuoteIdentifier(role), pq.QuoteIdentifier(cfg.Postgres.User))
+	}
+	return nil
+}
+
+// checkTablespaces checks that the tablespaces objects are moved to exist
+// on the server, before anything is restored.
+func checkTablespaces(ctx context.Context, cfg *config.Config) error {
+	remaps, _ := config.ParseTablespaceRemaps(cfg.Restore.RemapTablespaces) // checked when the config was loaded
+	if len(remaps) == 0 {
+		return nil
+	}
+	db, err := postgres.Open(cfg.Postgres, cfg.Timeouts, cfg.Postgres.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var missing []string
+	for _, from := range slices.Sorted(maps.Keys(remaps)) {
+		var exists bool
+		if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_tablespace WHERE spcname = $1)", remaps[from]).Scan(&exists); err != nil {
+			return fmt.Errorf("failed to look up tablespace %s: %w", remaps[from], err)
+		}
+		if !exists {
+			missing = append(missing, fmt.Sprintf("%s (for %s)", remaps[from], from))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("tablespaces %s do not exist on the server; create them with CREATE TABLESPACE, or pass -no-tablespaces", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"dbbackup/internal/config"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// encryptionSuffixes maps each encryption scheme to the suffix appended,
+// after any compression suffix, to the names of objects it produced.
+var encryptionSuffixes = map[string]string{
+	"none": "",
+	"age":  ".age",
+	"gpg":  ".gpg",
+	"kms":  ".kms",
+}
+
+// encryptWriter returns a writer that encrypts into w for the recipients of
+// enc, or with dataKey for KMS encryption. Closing it finishes the encrypted
+// stream but does not close w.
+func encryptWriter(w io.Writer, enc config.Encryption, dataKey []byte) (io.WriteCloser, error) {
+	switch enc.Scheme {
+	case "none":
+		return nopWriteCloser{w}, nil
+	case "kms":
+		return newGCMWriter(w, dataKey)
+	case "age":
+		recipients, err := age.ParseRecipients(strings.NewReader(strings.Join(enc.Recipients, "\n")))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse age recipients: %w", err)
+		}
+		return age.Encrypt(w, recipients...)
+	case "gpg":
+		var recipients openpgp.EntityList
+		for _, path := range enc.Recipients {
+			keys, err := readKeyRing(path)
+			if err != nil {
+				return nil, err
+			}
+			recipients = append(recipients, keys...)
+		}
+		return openpgp.Encrypt(w, recipients, nil, &openpgp.FileHints{IsBinary: true}, nil)
+	default:
+		return nil, fmt.Errorf("unsupported encryption %q", enc.Scheme)
+	}
+}
+
+// decryptReader returns a reader of the data encrypted in r with scheme,
+// using any of the identities or private keys in identityFiles, or dataKey
+// for KMS encryption.
+func decryptReader(r io.Reader, scheme string, identityFiles []string, dataKey []byte) (io.Reader, error) {
+	if len(identityFiles) == 0 && scheme != "kms" {
+		return nil, fmt.Errorf("backup is encrypted with %s but no identity file was given (-identity)", scheme)
+	}
+	switch scheme {
+	case "kms":
+		return newGCMReader(r, dataKey)
+	case "age":
+		var identities []age.Identity
+		for _, path := range identityFiles {
+			parsed, err := readIdentities(path)
+			if err != nil {
+				return nil, err
+			}
+			identities = append(identities, parsed...)
+		}
+		return age.Decrypt(r, identities...)
+	case "gpg":
+		var keys openpgp.EntityList
+		for _, path := range identityFiles {
+			parsed, err := readKeyRing(path)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, parsed...)
+		}
+		md, err := openpgp.ReadMessage(r, keys, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		return md.UnverifiedBody, nil
+	default:
+		return nil, fmt.Errorf("unsupported encryption %q", scheme)
+	}
+}
+
+// keyRequiredError explains err when it is a failure to decrypt a backup for
+// want of its key, naming keyID, the key the backup records it is encrypted
+// to with scheme.
+func keyRequiredError(scheme, keyID string, err error) error {
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) || errors.Is(err, pgperrors.ErrKeyIncorrect) {
+		return fmt.Errorf("no identity file given (-identity) holds the %s key the backup is encrypted to, %s: %w", scheme, keyIDOrUnknown(keyID), err)
+	}
+	return err
+}
+
+// readIdentities reads the age identities in path.
+func readIdentities(path string) ([]age.Identity, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open identity file: %w", err)
+	}
+	defer file.Close()
+	identities, err := age.ParseIdentities(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse identity file %s: %w", path, err)
+	}
+	return identities, nil
+}
+
+// readKeyRing reads the OpenPGP keys in path, armored or binary.
+func readKeyRing(path string) (openpgp.EntityList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	if err != nil {
+		keys, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key file %s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// encryptionKeyID identifies the keys that decrypt backups encrypted to the
+// recipients of enc: the age recipients themselves, or the fingerprints of
+// the GPG public keys.
+func encryptionKeyID(enc config.Encryption) (string, error) {
+	if enc.Scheme != "gpg" {
+		return strings.Join(enc.Recipients, ","), nil
+	}
+	var fingerprints []string
+	for _, path := range enc.Recipients {
+		keys, err := readKeyRing(path)
+		if err != nil {
+			return "", err
+		}
+		for _, key := range keys {
+			fingerprints = append(fingerprints, fmt.Sprintf("%X", key.PrimaryKey.Fingerprint))
+		}
+	}
+	return strings.Join(fingerprints, ","), nil
+}
+
+// newEncryption returns the object metadata that records how a backup is
+// encrypted under enc, including the identifier of its key, along with the
+// data key of its own that KMS generates for it with encryptionContext.
+func newEncryption(ctx context.Context, kmsClient *kms.Client, enc config.Encryption, encryptionContext map[string]string) ([]byte, map[string]string, error) {
+	switch enc.Scheme {
+	case "none":
+		return nil, map[string]string{"encryption": "none"}, nil
+	case "kms":
+		dataKey, metadata, err := generateDataKey(ctx, kmsClient, enc.KMSKeyID, encryptionContext)
+		if err != nil {
+			return nil, nil, err
+		}
+		metadata["encryption"] = "kms"
+		return dataKey, metadata, nil
+	default:
+		keyID, err := encryptionKeyID(enc)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, map[string]string{"encryption": enc.Scheme, "key-id": keyID}, nil
+	}
+}
+
+// registerEncryptionFlags binds the flags choosing how uploads are
+// encrypted, shared by the commands that upload backups.
+func registerEncryptionFlags(fs *flag.FlagSet, c *config.Config) {
+	fs.StringVar(&c.Encryption.Scheme, "encrypt", c.Encryption.Scheme, "encrypt backups before upload: "+strings.Join(config.EncryptionSchemes, ", "))
+	fs.StringVar(&c.Encryption.KMSKeyID, "kms-key-id", c.Encryption.KMSKeyID, "KMS key ID, ARN or alias generating the data keys of -encrypt kms")
+	config.StringsVar(fs, &c.Encryption.Recipients, "recipient", "age recipient (age1...) or GPG public key file to encrypt backups to (repeatable)")
+	fs.StringVar(&c.S3.SSE, "sse", c.S3.SSE, "server-side encryption of uploaded objects: AES256 or aws:kms; empty uses the bucket default")
+	fs.StringVar(&c.S3.SSEKMSKeyID, "sse-kms-key-id", c.S3.SSEKMSKeyID, "KMS key ID or ARN of -sse aws:kms; empty uses the AWS managed key")
+}
+
+// checkEncryption reports an encryption scheme given without its key.
+func checkEncryption(enc config.Encryption) error {
+	switch {
+	case enc.Scheme == "kms" && enc.KMSKeyID == "":
+		return errors.New("-encrypt kms requires -kms-key-id")
+	case (enc.Scheme == "age" || enc.Scheme == "gpg") && len(enc.Recipients) == 0:
+		return fmt.Errorf("-encrypt %s requires at least one -recipient", enc.Scheme)
+	}
+	return nil
+}
+
+// encryptionForKey returns the encryption of the object called key, judging
+// by its suffix, and the key without that suffix.
+func encryptionForKey(key string) (string, string) {
+	for scheme, suffix := range encryptionSuffixes {
+		if suffix != "" && strings.HasSuffix(key, suffix) {
+			return scheme, strings.TrimSuffix(key, suffix)
+		}
+	}
+	return "none", key
+}
+
+// encodeWriter returns a writer that compresses and then encrypts into w as
+// cfg configures, with dataKey for KMS encryption. Closing it finishes both
+// streams but does not close w.
+func encodeWriter(w io.Writer, cfg *config.Config, dataKey []byte) (io.WriteCloser, error) {
+	encrypted, err := encryptWriter(w, cfg.Encryption, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := compressWriter(encrypted, cfg.Dump.Compress, cfg.Dump.CompressLevel)
+	if err != nil {
+		return nil, err
+	}
+	return &encodingWriter{compressed, encrypted}, nil
+}
+
+type encodingWriter struct {
+	io.WriteCloser
+	encrypted io.WriteCloser
+}
+
+func (w *encodingWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return fmt.Errorf("failed to compress backup: %w", err)
+	}
+	if err := w.encrypted.Close(); err != nil {
+		return fmt.Errorf("failed to encrypt backup: %w", err)
+	}
+	return nil
+}
+
+// reencryptFile decrypts src, encrypted as enc.Scheme with identityFiles or
+// oldDataKey, and encrypts it again into dst for the recipients of enc or
+// with dataKey. It returns the SHA-256 of dst.
+func reencryptFile(src, dst string, enc config.Encryption, identityFiles []string, oldDataKey, dataKey []byte) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", fmt.Errorf("failed to open encrypted backup: %w", err)
+	}
+	defer in.Close()
+	r, err := decryptReader(in, enc.Scheme, identityFiles, oldDataKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s: %w", src, err)
+	}
+
+	out, err := createDigestFile(dst)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	w, err := encryptWriter(out, enc, dataKey)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return "", fmt.Errorf("failed to re-encrypt %s: %w", src, err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("failed to re-encrypt %s: %w", src, err)
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	return out.Sum(), nil
+}
+
+// decryptFile decrypts src, encrypted with scheme, into dst.
+func decryptFile(src, dst, scheme string, identityFiles []string, dataKey []byte) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open encrypted backup: %w", err)
+	}
+	defer in.Close()
+
+	r, err := decryptReader(in, scheme, identityFiles, dataKey)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s: %w", src, err)
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %w", dst, err)
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to decrypt %s: %w", src, err)
+	}
+	return out.Close()
+}
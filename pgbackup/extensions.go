@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/lib/pq"
+
+	"dbbackup/internal/config"
+	"dbbackup/internal/postgres"
+)
+
+// createExtension matches the statement pg_dump creates an extension with,
+// capturing its name.
+var createExtension = regexp.MustCompile(`^CREATE EXTENSION (?:IF NOT EXISTS )?` + roleIdentifier + `(?: WITH SCHEMA .*)?;$`)
+
+// extension is an extension a backup creates, with the statement it
+// creates it with.
+type extension struct {
+	name, statement string
+}
+
+// referencedExtensions returns the extensions the backup at path, in
+// format, creates. Archives list them in their table of contents; their
+// statements are then read through pg_restore -L with a list of those
+// entries written to listPath, without connecting.
+func referencedExtensions(ctx context.Context, cfg *config.Config, format, path, listPath string) ([]extension, error) {
+	if format == "plain" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return scanExtensions(file)
+	}
+
+	entries, err := readTOC(ctx, cfg, format, path)
+	if err != nil {
+		return nil, err
+	}
+	entries = slices.DeleteFunc(entries, func(e tocEntry) bool { return e.desc != "EXTENSION" })
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	if err := writeTOCList(listPath, entries); err != nil {
+		return nil, err
+	}
+	defer os.Remove(listPath)
+	args := []string{"-f", "-", "-L", listPath}
+	if format == "directory" {
+		args = append(args, "-F", "d")
+	}
+	cmd, cleanup, err := postgres.Command(ctx, cfg.Postgres, cfg.Timeouts, "pg_restore", append(args, path)...)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to list the extensions of %s: %w: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+	return scanExtensions(&stdout)
+}
+
+// scanExtensions returns the extensions the SQL script r creates, skipping
+// the rows of COPY blocks.
+func scanExtensions(r io.Reader) ([]extension, error) {
+	var extensions []extension
+	br := bufio.NewReader(r)
+	copying := false
+	for {
+		line, err := br.ReadBytes('\n')
+		if copying {
+			copying = !bytes.Equal(line, []byte("\\.\n"))
+		} else if bytes.HasPrefix(line, []byte("COPY ")) && bytes.HasSuffix(line, []byte("FROM stdin;\n")) {
+			copying = true
+		} else {
+			statement := strings.TrimSuffix(string(line), "\n")
+			if m := createExtension.FindStringSubmatch(statement); m != nil {
+				name := m[1]
+				if strings.HasPrefix(name, `"`) {
+					name = strings.ReplaceAll(name[1:len(name)-1], `""`, `"`)
+				}
+				extensions = append(extensions, extension{name, statement})
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return extensions, nil
+		}
+		if err != nil {
+			return extensions, err
+		}
+	}
+}
+
+// checkExtensions fails, naming them, when the server cannot install some
+// of extensions, which pg_restore would otherwise only find out about
+// statement by statement. With create it then creates those dbName lacks,
+// returning their names; one that fails to be created is left for the
+// restore to create.
+func checkExtensions(ctx context.Context, cfg *config.Config, dbLog *databaseLog, dbName string, extensions []extension, create bool) (created []string, err error) {
+	names := make([]string, len(extensions))
+	for i, ext := range extensions {
+		names[i] = ext.name
+	}
+	server, err := postgres.Open(cfg.Postgres, cfg.Timeouts, cfg.Postgres.Database)
+	if err != nil {
+		return nil, err
+	}
+	defer server.Close()
+	available, err := queryNames(ctx, server, "SELECT name FROM pg_available_extensions WHERE name = ANY($1)", pq.Array(names))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the available extensions: %w", err)
+	}
+	var missing []string
+	for _, name := range names {
+		if !slices.Contains(available, name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("extensions not available on %s: %s; install them on the server first", describeServer(cfg.Postgres), strings.Join(missing, ", "))
+	}
+	dbLog.out.Printf("The server provides the extensions database %s needs: %s\n", dbName, strings.Join(names, ", "))
+	if !create {
+		return nil, nil
+	}
+
+	db, err := postgres.Open(cfg.Postgres, cfg.Timeouts, dbName)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	installed, err := queryNames(ctx, db, "SELECT extname FROM pg_extension WHERE extname = ANY($1)", pq.Array(names))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the extensions of database %s: %w", dbName, err)
+	}
+	for _, ext := range extensions {
+		if slices.Contains(installed, ext.name) {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, ext.statement); err != nil {
+			dbLog.err.Printf("Warning: failed to create extension %s in database %s: %v", ext.name, dbName, err)
+			continue
+		}
+		dbLog.out.Printf("Created extension %s in database %s\n", ext.name, dbName)
+		created = append(created, ext.name)
+	}
+	return created, nil
+}
+
+// queryNames returns the single text column query returns.
+func queryNames(ctx context.Context, db *sql.DB, query string, args ...any) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+
+	"dbbackup/internal/config"
+)
+
+// errRetrievalPending reports that backups archived in S3 are still being
+// retrieved, so that the restore is to be retried once they are.
+var errRetrievalPending = errors.New("archived backups are being retrieved")
+
+// glacierPollInterval is how often -glacier wait checks on retrievals.
+const glacierPollInterval = time.Minute
+
+// archiveStorageClasses are the storage classes listed objects must be
+// retrieved from, or may have to be in the case of INTELLIGENT_TIERING,
+// before they can be downloaded.
+var archiveStorageClasses = []types.ObjectStorageClass{
+	types.ObjectStorageClassGlacier, types.ObjectStorageClassDeepArchive, types.ObjectStorageClassIntelligentTiering,
+}
+
+// archiveState tells whether an object of S3 can be downloaded.
+type archiveState int
+
+const (
+	downloadable archiveState = iota
+	archived                  // its retrieval has not been requested
+	retrieving                // its retrieval is in progress
+)
+
+// archivedObject is an object S3 must retrieve before it is downloaded.
+type archivedObject struct {
+	key, storageClass string
+	tiered            bool // in an archive tier of INTELLIGENT_TIERING
+	state             archiveState
+}
+
+// headArchivedObject reads the archive state of s3Key, at versionID unless
+// it is empty, from its HeadObject, where a retrieved copy of an archived
+// object is downloadable.
+func headArchivedObject(ctx context.Context, s3Client *s3.Client, s3Bucket, s3Key, versionID string) (archivedObject, error) {
+	head, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:    aws.String(s3Bucket),
+		Key:       aws.String(s3Key),
+		VersionId: versionIDInput(versionID),
+	})
+	if err != nil {
+		return archivedObject{}, fmt.Errorf("failed to read metadata of %s: %w", s3Location(s3Bucket, s3Key, versionID), err)
+	}
+	object := archivedObject{key: s3Key, storageClass: string(head.StorageClass), tiered: head.ArchiveStatus != ""}
+	restore := aws.ToString(head.Restore)
+	switch {
+	case head.StorageClass != types.StorageClassGlacier && head.StorageClass != types.StorageClassDeepArchive && !object.tiered:
+		object.state = downloadable
+	case strings.Contains(restore, `ongoing-request="true"`):
+		object.state = retrieving
+	case strings.Contains(restore, `ongoing-request="false"`):
+		object.state = downloadable
+	default:
+		object.state = archived
+	}
+	if object.tiered {
+		object.storageClass += " " + string(head.ArchiveStatus)
+	}
+	return object, nil
+}
+
+// thawBackups makes the backups of sources that are archived in S3
+// downloadable as -glacier has it: it requests their retrieval and fails
+// with errRetrievalPending, requests it and waits until it completes, or
+// leaves the backups out, recording them as skipped. A split backup is
+// archived when one of its parts is. The storage class of each backup is
+// the one backups lists it with, and its version the one source reads. It
+// returns the targets left with backups to restore.
+func thawBackups(ctx context.Context, cfg *config.Config, source *backupSource, backups []listedBackup, targets []string, sources map[string][]restoreSource, summary *runSummary) ([]string, error) {
+	storageClasses := make(map[string]types.ObjectStorageClass)
+	for _, backup := range backups {
+		storageClasses[backup.key] = backup.storageClass
+	}
+
+	// Listing tells the storage class of backups but not of their parts,
+	// which are looked at whatever the class of their index
+	var objects []archivedObject
+	archivedBackups := make(map[string]string) // storage classes by backup key
+	for _, target := range targets {
+		for _, b := range sources[target] {
+			var keys []string
+			if slices.Contains(archiveStorageClasses, storageClasses[b.key]) {
+				keys = append(keys, b.key)
+			}
+			parts, _ := strconv.Atoi(b.metadata["parts"])
+			for n := 1; n <= parts; n++ {
+				keys = append(keys, partKey(b.key, n))
+			}
+			for _, key := range keys {
+				object, err := headArchivedObject(ctx, source.s3Client, cfg.S3.Bucket, key, source.versionOf(key))
+				if err != nil {
+					return nil, err
+				}
+				if object.state == downloadable {
+					continue
+				}
+				objects = append(objects, object)
+				if _, ok := archivedBackups[b.key]; !ok {
+					archivedBackups[b.key] = object.storageClass
+				}
+			}
+		}
+	}
+	if len(objects) == 0 {
+		return targets, nil
+	}
+
+	if cfg.Restore.Glacier == "skip" {
+		return slices.DeleteFunc(targets, func(target string) bool {
+			sources[target] = slices.DeleteFunc(sources[target], func(b restoreSource) bool {
+				storageClass, ok := archivedBackups[b.key]
+				if ok {
+					log.Printf("Skipping %s: it is archived in %s", b.key, storageClass)
+					summary.skip(target, "archived in "+storageClass)
+				}
+				return ok
+			})
+			return len(sources[target]) == 0
+		}), nil
+	}
+
+	// Objects in an archive tier of INTELLIGENT_TIERING are moved back to
+	// a frequent access tier for good, so their retrieval takes no days
+	for _, object := range objects {
+		if object.state != archived {
+			fmt.Printf("Retrieval of s3://%s/%s from %s is in progress\n", cfg.S3.Bucket, object.key, object.storageClass)
+			continue
+		}
+		request := &types.RestoreRequest{
+			GlacierJobParameters: &types.GlacierJobParameters{Tier: types.Tier(cfg.Restore.GlacierTier)},
+		}
+		if !object.tiered {
+			request.Days = aws.Int32(int32(cfg.Restore.GlacierDays))
+		}
+		_, err := source.s3Client.RestoreObject(ctx, &s3.RestoreObjectInput{
+			Bucket:         aws.String(cfg.S3.Bucket),
+			Key:            aws.String(object.key),
+			VersionId:      versionIDInput(source.versionOf(object.key)),
+			RestoreRequest: request,
+		})
+		var apiErr smithy.APIError
+		if err != nil && !(errors.As(err, &apiErr) && apiErr.ErrorCode() == "RestoreAlreadyInProgress") {
+			return nil, fmt.Errorf("failed to request the retrieval of s3://%s/%s from %s: %w", cfg.S3.Bucket, object.key, object.storageClass, err)
+		}
+		fmt.Printf("Requested the retrieval of s3://%s/%s from %s (%s tier)\n", cfg.S3.Bucket, object.key, object.storageClass, cfg.Restore.GlacierTier)
+	}
+	if cfg.Restore.Glacier == "initiate" {
+		return nil, fmt.Errorf("%w: %d objects of %d backups; retry the restore once S3 has retrieved them, or wait for them with -glacier wait", errRetrievalPending, len(objects), len(archivedBackups))
+	}
+
+	waitCtx := ctx
+	if timeout := cfg.Timeouts.Glacier; timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	started := time.Now()
+	for len(objects) > 0 {
+		fmt.Printf("Waiting for S3 to retrieve %d archived objects, checking every %s\n", len(objects), glacierPollInterval)
+		pause(waitCtx, glacierPollInterval)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if waitCtx.Err() != nil {
+			return nil, fmt.Errorf("%w: %d objects not retrieved within %s; retry the restore once they are", errRetrievalPending, len(objects), cfg.Timeouts.Glacier)
+		}
+		var left []archivedObject
+		for _, object := range objects {
+			checked, err := headArchivedObject(ctx, source.s3Client, cfg.S3.Bucket, object.key, source.versionOf(object.key))
+			if err != nil {
+				log.Printf("Warning: failed to check on the retrieval of s3://%s/%s: %v", cfg.S3.Bucket, object.key, err)
+				left = append(left, object)
+				continue
+			}
+			if checked.state != downloadable {
+				left = append(left, object)
+			}
+		}
+		objects = left
+	}
+	fmt.Printf("S3 retrieved the archived backups in %s\n", time.Since(started).Round(time.Second))
+	return targets, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"dbbackup/internal/config"
+	"dbbackup/internal/naming"
+	"dbbackup/internal/postgres"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// globalsPattern matches the base name of a cluster globals backup.
+var globalsPattern = regexp.MustCompile(`^globals_[0-9]{8}_[0-9]{6}(-[0-9a-f]{8})?\.sql(\.age|\.gpg|\.kms)?$`)
+
+// globalsKey returns the S3 key of the globals backup of the run runID. It
+// sits directly below the prefix whatever the key layout.
+func globalsKey(prefix, runID string) string {
+	return path.Join(prefix, "globals_"+runID+".sql")
+}
+
+// isGlobalsKey reports whether key is a cluster globals backup.
+func isGlobalsKey(key string) bool {
+	return globalsPattern.MatchString(path.Base(key))
+}
+
+// globalsTaken returns when the run that took the globals backup at key
+// started, as its name records.
+func globalsTaken(key string) time.Time {
+	stamp := strings.TrimPrefix(path.Base(key), "globals_")
+	taken, _ := time.Parse(naming.TimestampLayout, stamp[:min(len(stamp), len(naming.TimestampLayout))])
+	return taken
+}
+
+// backupGlobals dumps the cluster's roles and tablespaces with pg_dumpall and
+// uploads them next to the database backups of the run runID, encrypted like
+// the database backups since they hold the roles' password hashes.
+// provenance is the metadata recording where the backups come from.
+func backupGlobals(ctx context.Context, cfg *config.Config, s3Client *s3.Client, kmsClient *kms.Client, provenance map[string]string, runID string) (string, error) {
+	s3Key := globalsKey(cfg.S3.Prefix, runID) + encryptionSuffixes[cfg.Encryption.Scheme]
+	backupFilePath := workPath(cfg.WorkDir, runID, path.Base(s3Key))
+
+	// Encrypt the globals like the database backups
+	dataKey, encryptionMetadata, err := newEncryption(ctx, kmsClient, cfg.Encryption, kmsEncryptionContext("", s3Key))
+	if err != nil {
+		return "", err
+	}
+	file, err := createDigestFile(backupFilePath)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(backupFilePath)
+	defer file.Close()
+	w, err := encryptWriter(file, cfg.Encryption, dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	// Run the pg_dumpall command to backup roles and tablespaces
+	cmd, cleanup, err := postgres.Command(ctx, cfg.Postgres, cfg.Timeouts, "pg_dumpall", "-l", cfg.Postgres.Database, "--globals-only")
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	cmd.Stdout = w
+	fmt.Printf("Running %s\n", postgres.CommandLine(cmd, cfg.Postgres))
+	started := time.Now()
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to backup globals: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("failed to encrypt globals: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+
+	// Upload the globals to S3
+	metadata := map[string]string{
+		"format":   "plain",
+		"content":  "globals",
+		"sha256":   file.Sum(),
+		"started":  started.UTC().Format(time.RFC3339),
+		"finished": time.Now().UTC().Format(time.RFC3339),
+	}
+	maps.Copy(metadata, provenance)
+	maps.Copy(metadata, encryptionMetadata)
+	fmt.Printf("SHA-256 of %s: %s\n", path.Base(s3Key), file.Sum())
+	if _, err := uploadToS3(ctx, s3Client, backupFilePath, cfg.S3, s3Key, metadata, objectTags(cfg, "", cfg.Retention.Days), newProgressReporter(cfg, log.New(os.Stdout, "", 0), "")); err != nil {
+		return "", err
+	}
+	return s3Key, nil
+}
+
+// globalsErrors counts the errors psql reports while applying a globals
+// backup by kind: roles and tablespaces that already exist are expected
+// when restoring into a live cluster, while permission errors mean that the
+// server, often a managed one, forbids role statements.
+type globalsErrors struct {
+	exists, denied, other int
+}
+
+func (g *globalsErrors) classify(line string) {
+	switch {
+	case strings.Contains(line, "already exists"):
+		g.exists++
+	case strings.Contains(line, "permission denied"), strings.Contains(line, "must be superuser"), strings.Contains(line, "must have"):
+		g.denied++
+	default:
+		g.other++
+	}
+}
+
+func (g globalsErrors) String() string {
+	return fmt.Sprintf("%d already existed, %d not permitted, %d other", g.exists, g.denied, g.other)
+}
+
+// latestGlobals returns the key of the latest globals backup of source
+// that eligible accepts, "" when there is none.
+func latestGlobals(ctx context.Context, source *backupSource, eligible func(key string) bool) (string, error) {
+	keys, err := source.globalsKeys(ctx)
+	if err != nil {
+		return "", err
+	}
+	keys = slices.DeleteFunc(keys, func(key string) bool { return !isGlobalsKey(key) || !eligible(key) })
+	if len(keys) == 0 {
+		return "", nil
+	}
+	// The run timestamp in the name sorts chronologically
+	return slices.Max(keys), nil
+}
+
+// restoreGlobals applies the latest globals backup of source that eligible
+// accepts with psql, fetching it as a work file of the run runID. It
+// returns the key of the backup applied, "" when there is none, and the
+// errors psql carried on past.
+func restoreGlobals(ctx context.Context, cfg *config.Config, source *backupSource, kmsClient *kms.Client, runID string, eligible func(key string) bool) (string, globalsErrors, error) {
+	var errs globalsErrors
+	s3Key, err := latestGlobals(ctx, source, eligible)
+	if err != nil || s3Key == "" {
+		return "", errs, err
+	}
+
+	// Download the globals backup from S3
+	backupFilePath := workPath(cfg.WorkDir, runID, path.Base(s3Key))
+	if err := source.fetch(ctx, s3Key, backupFilePath, nil); err != nil {
+		return "", errs, err
+	}
+	defer os.Remove(backupFilePath)
+
+	// Decrypt the globals so psql can read them
+	if scheme, plainPath := encryptionForKey(backupFilePath); scheme != "none" {
+		var dataKey []byte
+		if scheme == "kms" {
+			metadata, err := source.metadata(ctx, s3Key)
+			if err != nil {
+				return "", errs, err
+			}
+			if dataKey, err = decryptDataKey(ctx, kmsClient, metadata, cfg.Encryption.KMSKeyID, kmsEncryptionContext("", s3Key)); err != nil {
+				return "", errs, err
+			}
+		}
+		if err := decryptFile(backupFilePath, plainPath, scheme, cfg.Encryption.IdentityFiles, dataKey); err != nil {
+			return "", errs, err
+		}
+		defer os.Remove(plainPath)
+		backupFilePath = plainPath
+	}
+
+	// Roles that already exist make their CREATE ROLE fail; psql carries on
+	// so that the remaining roles and grants are still applied
+	cmd, cleanup, err := postgres.Command(ctx, cfg.Postgres, cfg.Timeouts, "psql", "-X", "-d", cfg.Postgres.Database, "-f", backupFilePath)
+	if err != nil {
+		return "", errs, err
+	}
+	defer cleanup()
+	stderr := &errorLines{w: os.Stderr, onError: errs.classify}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return "", errs, stderr.wrap(fmt.Errorf("failed to restore globals: %w", err))
+	}
+
+	fmt.Printf("Globals restored from %s\n", source.location(s3Key))
+	if stderr.count > 0 {
+		log.Printf("Warning: psql carried on past %d errors applying the globals: %s", stderr.count, errs)
+	}
+	return s3Key, errs, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"dbbackup/internal/config"
+	"dbbackup/internal/postgres"
+)
+
+// pickBackups lists backups, numbered and grouped by database with the
+// latest first, and asks on in which to restore, at most one per database.
+// Restoring over a target database the server already has must then be
+// confirmed by typing its name. Nothing is picked when the answer is
+// empty.
+func pickBackups(ctx context.Context, cfg *config.Config, in io.Reader, out io.Writer, backups []listedBackup, renames map[string]string) ([]listedBackup, error) {
+	slices.SortStableFunc(backups, func(a, b listedBackup) int {
+		return cmp.Or(strings.Compare(a.database, b.database), b.taken.Compare(a.taken))
+	})
+	target := func(b listedBackup) string { return cmp.Or(renames[b.database], b.database) }
+	var targets []string
+	for _, b := range backups {
+		if !slices.Contains(targets, target(b)) {
+			targets = append(targets, target(b))
+		}
+	}
+	existing, err := existingDatabases(ctx, cfg, targets)
+	if err != nil {
+		return nil, err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for i, b := range backups {
+		if i == 0 || b.database != backups[i-1].database {
+			state := "new"
+			if existing[target(b)] {
+				state = "exists, will be overwritten"
+			}
+			fmt.Fprintf(w, "Database %s, restored into %s (%s):\n", b.database, target(b), state)
+		}
+		fmt.Fprintf(w, "  %d)\t%s\t%s\t%s\n", i+1, b.taken.Local().Format(time.DateTime), formatSize(b.size), b.key)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	// Ask until the answer names existing backups of distinct databases
+	lines := bufio.NewScanner(in)
+	var picked []listedBackup
+	for picked == nil {
+		fmt.Fprint(out, "Backups to restore, by number, separated by spaces or commas (empty to cancel): ")
+		if !lines.Scan() {
+			return nil, cmp.Or(lines.Err(), errors.New("no backups picked"))
+		}
+		answer := strings.FieldsFunc(lines.Text(), func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+		if len(answer) == 0 {
+			return nil, errors.New("no backups picked")
+		}
+		picked = []listedBackup{}
+		for _, field := range answer {
+			n, err := strconv.Atoi(field)
+			if err != nil || n < 1 || n > len(backups) {
+				fmt.Fprintf(out, "%q is not the number of a backup listed above\n", field)
+				picked = nil
+				break
+			}
+			b := backups[n-1]
+			if slices.ContainsFunc(picked, func(p listedBackup) bool { return p.database == b.database }) {
+				fmt.Fprintf(out, "Pick a single backup of database %s\n", b.database)
+				picked = nil
+				break
+			}
+			picked = append(picked, b)
+		}
+	}
+
+	// Nothing is overwritten without its name being typed
+	for _, b := range picked {
+		if !existing[target(b)] {
+			continue
+		}
+		fmt.Fprintf(out, "Database %s exists and will be overwritten by %s; type its name to confirm: ", target(b), b.key)
+		if !lines.Scan() || strings.TrimSpace(lines.Text()) != target(b) {
+			return nil, fmt.Errorf("restore cancelled: overwriting database %s was not confirmed", target(b))
+		}
+	}
+	return picked, nil
+}
+
+// existingDatabases reports which of names the server has.
+func existingDatabases(ctx context.Context, cfg *config.Config, names []string) (map[string]bool, error) {
+	db, err := postgres.Open(cfg.Postgres, cfg.Timeouts, cfg.Postgres.Database)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	existing := make(map[string]bool, len(names))
+	for _, name := range names {
+		var exists bool
+		if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)", name).Scan(&exists); err != nil {
+			return nil, fmt.Errorf("failed to look up database %s: %w", name, err)
+		}
+		existing[name] = exists
+	}
+	return existing, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// KMS-encrypted backups are sealed with a data key of their own, generated
+// by KMS and stored wrapped in the object's metadata. The data is split into
+// chunks sealed with AES-256-GCM so that it can be encrypted and decrypted as
+// a stream. Each chunk's nonce holds its index and, in the last byte, whether
+// it is the final chunk, so that reordered or truncated backups fail to
+// decrypt.
+
+// kmsChunkSize is the plaintext size of each sealed chunk.
+const kmsChunkSize = 64 << 10
+
+// kmsEncryptionContext returns the encryption context that binds a data key
+// to the backup of dbName, empty for the globals, stored as s3Key. It leaves
+// out the prefix so that backups still decrypt after being copied elsewhere.
+func kmsEncryptionContext(dbName, s3Key string) map[string]string {
+	encryptionContext := map[string]string{"pgbackup:file": path.Base(s3Key)}
+	if dbName != "" {
+		encryptionContext["pgbackup:database"] = dbName
+	}
+	return encryptionContext
+}
+
+// generateDataKey returns a new data key under the KMS key keyID, along with
+// the object metadata that records it in wrapped form.
+func generateDataKey(ctx context.Context, kmsClient *kms.Client, keyID string, encryptionContext map[string]string) ([]byte, map[string]string, error) {
+	output, err := kmsClient.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:             aws.String(keyID),
+		KeySpec:           types.DataKeySpecAes256,
+		EncryptionContext: encryptionContext,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate data key with KMS key %s: %w", keyID, err)
+	}
+	metadata := map[string]string{
+		"key-id":          aws.ToString(output.KeyId),
+		"kms-wrapped-key": base64.StdEncoding.EncodeToString(output.CiphertextBlob),
+	}
+	return output.Plaintext, metadata, nil
+}
+
+// resolveKMSKey returns the ARN of the KMS key keyID, which may be a key ID,
+// ARN or alias, as recorded in the metadata of the backups under it.
+func resolveKMSKey(ctx context.Context, kmsClient *kms.Client, keyID string) (string, error) {
+	output, err := kmsClient.DescribeKey(ctx, &kms.DescribeKeyInput{KeyId: aws.String(keyID)})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe KMS key %s: %w", keyID, err)
+	}
+	return aws.ToString(output.KeyMetadata.Arn), nil
+}
+
+// decryptDataKey unwraps the data key recorded in metadata. KMS checks that
+// it was generated with encryptionContext and, when keyID is set, under that
+// key.
+func decryptDataKey(ctx context.Context, kmsClient *kms.Client, metadata map[string]string, keyID string, encryptionContext map[string]string) ([]byte, error) {
+	wrapped, err := base64.StdEncoding.DecodeString(metadata["kms-wrapped-key"])
+	if err != nil || len(wrapped) == 0 {
+		return nil, errors.New("backup metadata holds no valid wrapped data key")
+	}
+	input := &kms.DecryptInput{
+		CiphertextBlob:    wrapped,
+		EncryptionContext: encryptionContext,
+	}
+	if keyID != "" {
+		input.KeyId = aws.String(keyID)
+	}
+	output, err := kmsClient.Decrypt(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+	if recorded := metadata["key-id"]; recorded != "" && recorded != aws.ToString(output.KeyId) {
+		return nil, fmt.Errorf("data key was decrypted with KMS key %s, but the backup records %s", aws.ToString(output.KeyId), recorded)
+	}
+	return output.Plaintext, nil
+}
+
+func newGCM(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of the chunk with the given index.
+func chunkNonce(aead cipher.AEAD, index uint64, final bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], index)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// gcmWriter seals the data written to it chunk by chunk into w.
+type gcmWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	index uint64
+}
+
+func newGCMWriter(w io.Writer, dataKey []byte) (io.WriteCloser, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmWriter{w: w, aead: aead, buf: make([]byte, 0, kmsChunkSize)}, nil
+}
+
+func (g *gcmWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data shows it is not the last
+		if len(g.buf) == kmsChunkSize {
+			if err := g.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(g.buf[len(g.buf):kmsChunkSize], p)
+		g.buf = g.buf[:len(g.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the final chunk. It does not close w.
+func (g *gcmWriter) Close() error {
+	return g.seal(true)
+}
+
+func (g *gcmWriter) seal(final bool) error {
+	sealed := g.aead.Seal(nil, chunkNonce(g.aead, g.index, final), g.buf, nil)
+	g.index++
+	g.buf = g.buf[:0]
+	_, err := g.w.Write(sealed)
+	return err
+}
+
+// gcmReader opens the chunks sealed by a gcmWriter.
+type gcmReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	buf   []byte
+	plain []byte
+	index uint64
+	done  bool
+}
+
+func newGCMReader(r io.Reader, dataKey []byte) (io.Reader, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmReader{r: bufio.NewReader(r), aead: aead, buf: make([]byte, kmsChunkSize+aead.Overhead())}, nil
+}
+
+func (g *gcmReader) Read(p []byte) (int, error) {
+	for len(g.plain) == 0 {
+		if g.done {
+			return 0, io.EOF
+		}
+		if err := g.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, g.plain)
+	g.plain = g.plain[n:]
+	return n, nil
+}
+
+func (g *gcmReader) open() error {
+	n, err := io.ReadFull(g.r, g.buf)
+	final := false
+	switch {
+	case err == io.EOF:
+		return errors.New("encrypted backup is truncated")
+	case err == io.ErrUnexpectedEOF:
+		final = true
+	case err != nil:
+		return err
+	default:
+		_, err := g.r.Peek(1)
+		final = err == io.EOF
+	}
+
+	plain, err := g.aead.Open(g.buf[:0], chunkNonce(g.aead, g.index, final), g.buf[:n], nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt chunk %d: %w", g.index, err)
+	}
+	g.index++
+	g.plain = plain
+	g.done = final
+	return nil
+}
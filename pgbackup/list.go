@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"dbbackup/internal/config"
+	"dbbackup/internal/naming"
+	"dbbackup/internal/storage"
+)
+
+func runList(ctx context.Context, args []string) error {
+	var database, key string
+	var versions bool
+	cfg, err := loadConfig("list", "Lists the backup objects under an S3 prefix (the whole bucket when no prefix is set).", args, config.Defaults(),
+		func(fs *flag.FlagSet, c *config.Config) {
+			fs.StringVar(&database, "database", "", "only list the backups of this database")
+			fs.StringVar(&key, "key", "", "only list the object stored as this key")
+			fs.BoolVar(&versions, "versions", false, "list every version of the objects of a versioned bucket, and the delete markers of those deleted, newest first, with the IDs restore -version-id takes")
+		})
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := naming.Parse(cfg.Dump.FilenameTemplate)
+	if err != nil {
+		return err
+	}
+	layout, err := naming.ParseLayout(cfg.S3.KeyLayout)
+	if err != nil {
+		return err
+	}
+
+	// A database's backups live in their own subtree when the key layout
+	// groups them; otherwise the names below the prefix are matched
+	prefix := cfg.S3.Prefix
+	if key != "" {
+		prefix = key
+	} else if database != "" {
+		if dbPrefix, ok := layout.DatabasePrefix(cfg.S3.Prefix, hostLabel(cfg.Postgres), database); ok {
+			prefix = dbPrefix
+		}
+	}
+
+	s3Client, err := storage.NewClient(ctx, cfg.S3, cfg.AWS)
+	if err != nil {
+		return err
+	}
+
+	listed := func(s3Key string) bool {
+		if key != "" && s3Key != key {
+			return false
+		}
+		if database != "" {
+			if fields, ok := matchBackupKey(tmpl, s3Key); !ok || fields.Database != database {
+				return false
+			}
+		}
+		return true
+	}
+	if versions {
+		return listVersions(ctx, s3Client, cfg.S3.Bucket, prefix, listed)
+	}
+
+	objects, err := listS3Objects(ctx, s3Client, cfg.S3.Bucket, prefix)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tSIZE\tLAST MODIFIED")
+	for _, object := range objects {
+		if !listed(*object.Key) {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", *object.Key, *object.Size, object.LastModified.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// objectVersion is a version of an object, or a delete marker, as listed
+// by list -versions.
+type objectVersion struct {
+	key, versionID, size string
+	lastModified         time.Time
+	state                string
+}
+
+// listVersions prints the versions and delete markers of the objects below
+// prefix that listed keeps, by key and newest first. A delete marker has no
+// size and cannot be restored; it hides the versions below it, which can.
+func listVersions(ctx context.Context, s3Client *s3.Client, s3Bucket, prefix string, listed func(string) bool) error {
+	versions, deleteMarkers, err := listS3ObjectVersions(ctx, s3Client, s3Bucket, prefix)
+	if err != nil {
+		return err
+	}
+	var rows []objectVersion
+	for _, version := range versions {
+		state := "noncurrent"
+		if aws.ToBool(version.IsLatest) {
+			state = "latest"
+		}
+		rows = append(rows, objectVersion{aws.ToString(version.Key), aws.ToString(version.VersionId), strconv.FormatInt(aws.ToInt64(version.Size), 10), aws.ToTime(version.LastModified), state})
+	}
+	for _, marker := range deleteMarkers {
+		state := "delete marker"
+		if aws.ToBool(marker.IsLatest) {
+			state += ", latest"
+		}
+		rows = append(rows, objectVersion{aws.ToString(marker.Key), aws.ToString(marker.VersionId), "-", aws.ToTime(marker.LastModified), state})
+	}
+	slices.SortFunc(rows, func(a, b objectVersion) int {
+		if c := strings.Compare(a.key, b.key); c != 0 {
+			return c
+		}
+		return b.lastModified.Compare(a.lastModified)
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tVERSION ID\tSIZE\tLAST MODIFIED\tSTATE")
+	for _, row := range rows {
+		if !listed(row.key) {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", row.key, row.versionID, row.size, row.lastModified.Format(time.RFC3339), row.state)
+	}
+	return w.Flush()
+}
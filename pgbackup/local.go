@@ -0,0 +1,145 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"dbbackup/internal/config"
+)
+
+// localCopyPath returns the path of the local copy of the backup of dbName
+// at s3Key, in the directory of the database below dir.
+func localCopyPath(dir, dbName, s3Key string) string {
+	name := url.PathEscape(dbName)
+	if strings.Trim(name, ".") == "" {
+		name = strings.ReplaceAll(name, ".", "%2E")
+	}
+	return filepath.Join(dir, name, path.Base(s3Key))
+}
+
+// keepLocalCopy moves the uploaded backup file of dbName into the local
+// copies, then removes the oldest copies of dbName beyond local.Count.
+func keepLocalCopy(dbLog *databaseLog, local config.Local, dbName, backupFilePath, s3Key string) error {
+	dst := localCopyPath(local.Dir, dbName, s3Key)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		return fmt.Errorf("failed to create local copy directory: %w", err)
+	}
+	if err := moveFile(backupFilePath, dst); err != nil {
+		return fmt.Errorf("failed to keep local copy: %w", err)
+	}
+	dbLog.out.Printf("Kept local copy %s\n", dst)
+
+	// Keep the newest copies, dumps keeping the time they were written
+	entries, err := os.ReadDir(filepath.Dir(dst))
+	if err != nil {
+		return fmt.Errorf("failed to prune local copies: %w", err)
+	}
+	type localCopy struct {
+		path string
+		info fs.FileInfo
+	}
+	var copies []localCopy
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		copies = append(copies, localCopy{filepath.Join(filepath.Dir(dst), entry.Name()), info})
+	}
+	slices.SortFunc(copies, func(a, b localCopy) int {
+		return cmp.Or(b.info.ModTime().Compare(a.info.ModTime()), strings.Compare(b.path, a.path))
+	})
+	for _, old := range copies[min(local.Count, len(copies)):] {
+		if old.path == dst {
+			continue
+		}
+		if err := os.Remove(old.path); err != nil {
+			dbLog.err.Printf("Warning: failed to remove local copy %s: %v", old.path, err)
+			continue
+		}
+		dbLog.out.Printf("Removed local copy %s (keeping %d)\n", old.path, local.Count)
+	}
+	return nil
+}
+
+// restoreLocalCopy links the local copy of the backup b, if there is one
+// whose SHA-256 matches the backup's, to dst, reporting whether it did.
+// A missing, damaged or unreadable copy leaves the backup to be downloaded.
+func restoreLocalCopy(dir string, b restoreSource, dst string) bool {
+	if dir == "" || b.metadata["sha256"] == "" {
+		return false
+	}
+	local := localCopyPath(dir, b.database, b.key)
+	sum, err := fileSHA256(local)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	if err != nil {
+		log.Printf("Warning: failed to read local copy %s, downloading the backup instead: %v", local, err)
+		return false
+	}
+	if sum != b.metadata["sha256"] {
+		log.Printf("Warning: local copy %s has SHA-256 %s, not %s, downloading the backup instead", local, sum, b.metadata["sha256"])
+		return false
+	}
+	if err := linkOrCopy(local, dst); err != nil {
+		log.Printf("Warning: failed to use local copy %s, downloading the backup instead: %v", local, err)
+		return false
+	}
+	fmt.Printf("Restoring %s from local copy %s, SHA-256 verified\n", b.key, local)
+	return true
+}
+
+// moveFile moves src to dst, copying it when they are on different file
+// systems.
+func moveFile(src, dst string) error {
+	if os.Rename(src, dst) == nil {
+		return nil
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// linkOrCopy makes dst a hard link to src, or a copy of it when they are on
+// different file systems, so that removing dst leaves src alone.
+func linkOrCopy(src, dst string) error {
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+	return copyFile(src, dst)
+}
+
+// copyFile copies src to a new file dst, removing dst when the copy fails.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+// Command pgbackup backs up PostgreSQL databases to S3 and restores them.
+//
+// Usage:
+//
+//	pgbackup <command> [flags]
+//
+// Run "pgbackup <command> -h" for the flags of each command.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"syscall"
+
+	"dbbackup/internal/config"
+)
+
+// command is a pgbackup subcommand.
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, args []string) error
+}
+
+var commands = []command{
+	{"backup", "back up every database to S3", runBackup},
+	{"restore", "restore the databases backed up under an S3 prefix", runRestore},
+	{"dump", "dump a single database to stdout, without S3", runDump},
+	{"list", "list the backups stored in S3", runList},
+	{"prune", "delete backups older than the retention period", runPrune},
+	{"rekey", "re-encrypt backups with the current encryption key", runRekey},
+}
+
+// version is the release of pgbackup, set at build time with
+// -ldflags "-X main.version=v1.2.3".
+var version string
+
+// toolVersion returns the release of pgbackup, falling back to the module
+// version or VCS revision recorded in the binary.
+func toolVersion() string {
+	if version != "" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" && info.Main.Version == "(devel)" {
+			return setting.Value[:min(len(setting.Value), 12)]
+		}
+	}
+	return info.Main.Version
+}
+
+// usageError reports invalid flags or configuration.
+type usageError struct {
+	err error
+}
+
+func (e *usageError) Error() string { return e.err.Error() }
+func (e *usageError) Unwrap() error { return e.err }
+
+// errRunAborted reports that a run stopped at the first failed database,
+// as -on-error abort has it.
+var errRunAborted = errors.New("run aborted")
+
+// registerOnErrorFlag binds -on-error, shared by the commands that work
+// through several databases.
+func registerOnErrorFlag(fs *flag.FlagSet, c *config.Config) {
+	fs.StringVar(&c.OnError, "on-error", c.OnError, "what to do when a database fails: continue with the others, or abort the run at once; either way the run exits non-zero ($BACKUP_ON_ERROR)")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+
+	name := os.Args[1]
+	if name == "help" || name == "-h" || name == "-help" || name == "--help" {
+		usage(os.Stdout)
+		return
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+
+		// Interrupting pgbackup cancels the running command, which stops the
+		// client programs it started in their own process groups
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := cmd.run(ctx, os.Args[2:])
+		stop()
+		var uerr *usageError
+		switch {
+		case err == nil:
+		case errors.Is(err, flag.ErrHelp):
+		case errors.As(err, &uerr):
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		case errors.Is(err, errRunTimeout):
+			log.Printf("Error: %v", err)
+			os.Exit(3)
+		case errors.Is(err, errRetrievalPending):
+			log.Printf("Error: %v", err)
+			os.Exit(4)
+		default:
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "Error: unknown command %q\n\n", name)
+	usage(os.Stderr)
+	os.Exit(2)
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: pgbackup <command> [flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-8s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nRun \"pgbackup <command> -h\" for the flags of a command.\n")
+}
+
+// loadConfig parses the flags of the subcommand name on top of the shared
+// configuration. register, if non-nil, binds the subcommand's own flags.
+func loadConfig(name, description string, args []string, defaults config.Config, register func(*flag.FlagSet, *config.Config)) (*config.Config, error) {
+	fs := flag.NewFlagSet("pgbackup "+name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: pgbackup %s [flags]\n\n%s\n\nFlags:\n", name, description)
+		fs.PrintDefaults()
+	}
+
+	cfg, err := config.Load(fs, args, defaults, register)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &usageError{err}
+	}
+
+	if cfg.Verbose {
+		cfg.Print(os.Stderr)
+	}
+	return cfg, nil
+}
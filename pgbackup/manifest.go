@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"dbbackup/internal/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// manifestDir is the directory below the S3 prefix that holds the manifest
+// of every backup run.
+const manifestDir = "manifests"
+
+// manifest describes a backup run. It is uploaded next to the backups so that
+// an operator can tell what each backup contains before restoring it.
+type manifest struct {
+	RunID    string          `json:"run_id"`
+	Started  time.Time       `json:"started"`
+	Finished time.Time       `json:"finished"`
+	Host     string          `json:"host"`
+	Globals  string          `json:"globals,omitempty"`
+	Backups  []manifestEntry `json:"backups"`
+}
+
+// manifestEntry describes a single uploaded backup.
+type manifestEntry struct {
+	Database    string `json:"database"`
+	Key         string `json:"key"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	Format      string `json:"format"`
+	Content     string `json:"content"`
+	Compression string `json:"compression"`
+	Encryption  string `json:"encryption"`
+	Blobs       bool   `json:"blobs"`
+
+	// Partial is set when table or schema filters left part of the
+	// database out of the dump; Tables lists those filters.
+	Partial bool                `json:"partial"`
+	Tables  config.TableFilters `json:"tables"`
+
+	// Deduplicated is set when the dump was identical to the backup at Key,
+	// taken by an earlier run, and was not uploaded again.
+	Deduplicated bool `json:"deduplicated,omitempty"`
+
+	// Parts is the number of part objects the backup was split into; Key
+	// then holds the index of the parts.
+	Parts int `json:"parts,omitempty"`
+}
+
+// manifestKey returns the S3 key of the manifest of the run runID.
+func manifestKey(prefix, runID string) string {
+	return path.Join(prefix, manifestDir, runID+".json")
+}
+
+// isManifestKey reports whether key is a run manifest rather than a backup.
+func isManifestKey(key string) bool {
+	return path.Base(path.Dir(key)) == manifestDir && strings.HasSuffix(key, ".json")
+}
+
+// uploadManifest writes m, tagged with tags, to the bucket below the prefix
+// of s3Cfg.
+func uploadManifest(ctx context.Context, s3Client *s3.Client, s3Cfg config.S3, tags map[string]string, m *manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	s3Key := manifestKey(s3Cfg.Prefix, m.RunID)
+	if err := putS3Object(ctx, s3Client, s3Cfg, s3Key, data, "application/json", tags); err != nil {
+		return err
+	}
+
+	fmt.Printf("Manifest uploaded to s3://%s/%s\n", s3Cfg.Bucket, s3Key)
+	return nil
+}
+
+// findRunManifest returns the manifest of the run below the prefix whose ID
+// starts with runID, failing unless exactly one run does.
+func findRunManifest(ctx context.Context, s3Client *s3.Client, s3Cfg config.S3, runID string) (*manifest, error) {
+	keys, err := listS3BackupFiles(ctx, s3Client, s3Cfg.Bucket, path.Join(s3Cfg.Prefix, manifestDir, runID))
+	if err != nil {
+		return nil, err
+	}
+	keys = slices.DeleteFunc(keys, func(key string) bool { return !isManifestKey(key) })
+	switch len(keys) {
+	case 0:
+		return nil, fmt.Errorf("no manifest of a run %s below s3://%s/%s", runID, s3Cfg.Bucket, s3Cfg.Prefix)
+	case 1:
+	default:
+		ids := make([]string, len(keys))
+		for i, key := range keys {
+			ids[i] = strings.TrimSuffix(path.Base(key), ".json")
+		}
+		return nil, fmt.Errorf("run ID %s matches %d runs: %s", runID, len(keys), strings.Join(ids, ", "))
+	}
+
+	output, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s3Cfg.Bucket),
+		Key:    aws.String(keys[0]),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download manifest s3://%s/%s: %w", s3Cfg.Bucket, keys[0], err)
+	}
+	defer output.Body.Close()
+	var m manifest
+	if err := json.NewDecoder(output.Body).Decode(&m); err != nil {
+		return nil, fmt.Errorf("failed to read manifest s3://%s/%s: %w", s3Cfg.Bucket, keys[0], err)
+	}
+	return &m, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// databaseLog writes the output of a single database's backup. When several
+// databases are backed up at once every line is prefixed with the database
+// name so that their output can be told apart.
+type databaseLog struct {
+	out    *log.Logger // progress, on stdout
+	err    *log.Logger // failures, on stderr like the standard logger
+	stderr *lineWriter // the client programs' own messages
+}
+
+func newDatabaseLog(dbName string, prefixed bool) *databaseLog {
+	prefix := ""
+	if prefixed {
+		prefix = "[" + dbName + "] "
+	}
+	return &databaseLog{
+		out:    log.New(os.Stdout, prefix, log.Lmsgprefix),
+		err:    log.New(os.Stderr, prefix, log.LstdFlags|log.Lmsgprefix),
+		stderr: &lineWriter{w: os.Stderr, prefix: prefix},
+	}
+}
+
+// lineWriter passes each complete line written to it on to w with a prefix,
+// in a single write so that concurrent writers do not interleave mid-line.
+type lineWriter struct {
+	w       io.Writer
+	prefix  string
+	partial []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.partial = append(l.partial, p...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := append([]byte(l.prefix), l.partial[:i+1]...)
+		l.partial = l.partial[i+1:]
+		if _, err := l.w.Write(line); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+// Flush writes out a final line that lacks its newline.
+func (l *lineWriter) Flush() error {
+	if len(l.partial) == 0 {
+		return nil
+	}
+	_, err := l.Write([]byte("\n"))
+	return err
+}
+
+// errorLines passes a client program's messages on to w, counting the
+// errors among them and keeping the first, which a failed run is reported
+// with.
+type errorLines struct {
+	w       io.Writer
+	partial []byte
+	first   string
+	count   int
+
+	// onError, when set, is called with each error line.
+	onError func(line string)
+}
+
+func (e *errorLines) Write(p []byte) (int, error) {
+	e.partial = append(e.partial, p...)
+	for {
+		i := bytes.IndexByte(e.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(e.partial[:i])
+		e.partial = e.partial[i+1:]
+		// psql reports the server's errors as ERROR:, pg_restore its own as
+		// error:
+		if strings.Contains(line, "ERROR:") || strings.Contains(line, "error:") {
+			e.count++
+			if e.first == "" {
+				e.first = strings.TrimSpace(line)
+			}
+			if e.onError != nil {
+				e.onError(line)
+			}
+		}
+	}
+	return e.w.Write(p)
+}
+
+// wrap adds the first error reported to err.
+func (e *errorLines) wrap(err error) error {
+	if e.first == "" {
+		return err
+	}
+	return fmt.Errorf("%w: %s", err, e.first)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/lib/pq"
+
+	"dbbackup/internal/config"
+	"dbbackup/internal/postgres"
+)
+
+// logToStderr points os.Stdout at stderr for the commands that stream a
+// dump through their standard input or output, so that everything they
+// log, progress included, goes to stderr and the stream stays clean. It
+// returns the original stdout.
+func logToStderr() *os.File {
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	return stdout
+}
+
+func runDump(ctx context.Context, args []string) error {
+	stream := logToStderr()
+	defaults := config.Defaults()
+	defaults.Dump.Output = "-"
+
+	var dbName string
+	cfg, err := loadConfig("dump", "Dumps a single database to stdout, or to a file, without S3 or the work directory.", args, defaults,
+		func(fs *flag.FlagSet, c *config.Config) {
+			fs.StringVar(&dbName, "database", "", "the database to dump (required)")
+			fs.StringVar(&c.Dump.Output, "output", c.Dump.Output, `where to write the dump: "-" for stdout, or a file`)
+			fs.StringVar(&c.Dump.Format, "format", c.Dump.Format, "pg_dump output format: custom, tar or plain; directory dumps cannot be streamed")
+			fs.BoolVar(&c.Dump.SchemaOnly, "schema-only", c.Dump.SchemaOnly, "dump only the object definitions, without data")
+			fs.BoolVar(&c.Dump.DataOnly, "data-only", c.Dump.DataOnly, "dump only the data, without the object definitions")
+			config.StringsVar(fs, &c.Dump.Tables.IncludeSchemas, "include-schema", "only dump schemas matching this pg_dump pattern (repeatable)")
+			config.StringsVar(fs, &c.Dump.Tables.ExcludeSchemas, "exclude-schema", "do not dump schemas matching this pg_dump pattern (repeatable)")
+			config.StringsVar(fs, &c.Dump.Tables.IncludeTables, "include-table", "only dump tables matching this pg_dump pattern (repeatable)")
+			config.StringsVar(fs, &c.Dump.Tables.ExcludeTables, "exclude-table", "do not dump tables matching this pg_dump pattern (repeatable)")
+			config.StringsVar(fs, &c.Dump.Tables.ExcludeTableData, "exclude-table-data", "dump the definition but not the rows of tables matching this pg_dump pattern (repeatable)")
+			config.StringsVar(fs, &c.Dump.ExtraArgs, "pg-dump-arg", "extra argument passed verbatim to pg_dump, e.g. --no-comments (repeatable)")
+		})
+	if err != nil {
+		return err
+	}
+	if dbName == "" {
+		return &usageError{errors.New("-database is required")}
+	}
+	if cfg.Dump.Output == "" {
+		return &usageError{errors.New(`-output must be "-" for stdout or a file`)}
+	}
+	settings, _ := cfg.ForDatabase(dbName)
+	if settings.Format == "directory" {
+		return &usageError{fmt.Errorf("database %s is dumped in directory format, which cannot be streamed; pass -format custom, tar or plain", dbName)}
+	}
+	return dumpDatabase(ctx, cfg, dbName, settings, stream)
+}
+
+// dumpDatabase dumps dbName as configured in settings to cfg.Dump.Output,
+// stdout being stream. The dump is pg_dump's own output, neither
+// compressed nor encrypted, so that pg_restore and psql read it as it is.
+func dumpDatabase(ctx context.Context, cfg *config.Config, dbName string, settings config.Database, stream io.Writer) error {
+	dbLog := newDatabaseLog(dbName, false)
+	out, name := stream, "stdout"
+	var file *os.File
+	if cfg.Dump.Output != "-" {
+		var err error
+		file, err = os.Create(cfg.Dump.Output)
+		if err != nil {
+			return fmt.Errorf("failed to create dump file: %w", err)
+		}
+		defer file.Close()
+		out, name = file, cfg.Dump.Output
+	}
+
+	check := newDumpCheck(settings.Format)
+	check.w = out
+	err := runPgDump(ctx, cfg, dbLog, append(pgDumpArgs(cfg, settings, nil), dbName), check)
+	if err == nil {
+		err = check.verify(settings.MinSize)
+	}
+	if err == nil && file != nil {
+		err = file.Close()
+	}
+	if err != nil {
+		if file != nil {
+			os.Remove(file.Name())
+		}
+		return fmt.Errorf("database %s: %w", dbName, err)
+	}
+	dbLog.out.Printf("Dumped database %s to %s (%s, SHA-256 %s)\n", dbName, name, formatSize(check.size), check.Sum())
+	return nil
+}
+
+// restoreStream restores the dump read from in into the single database
+// -database names, creating it when the server lacks it unless
+// -create-missing=false is given. pg_restore reads custom and tar-format
+// archives from the pipe in a single pass, so nothing that needs the
+// archive's table of contents beforehand, such as selecting tables,
+// remapping tablespaces or parallel workers, is available; plain scripts
+// are applied with psql.
+func restoreStream(ctx context.Context, cfg *config.Config, in io.Reader) error {
+	names, ok := cfg.Restore.RequestedNames()
+	if !ok || len(names) != 1 {
+		return &usageError{errors.New("-input - restores a single database, which -database must name")}
+	}
+	target := names[0]
+	switch {
+	case len(cfg.Restore.Tables) > 0 || len(cfg.Restore.Schemas) > 0:
+		return &usageError{errors.New("-input - cannot restore selected tables or schemas, which needs the archive's table of contents first")}
+	case cfg.Restore.CreateMissingRoles:
+		return &usageError{errors.New("-input - cannot be combined with -create-missing-roles, which reads the backup before restoring it")}
+	case cfg.Restore.CreateExtensions:
+		return &usageError{errors.New("-input - cannot be combined with -create-extensions, which reads the backup before restoring it")}
+	case cfg.Restore.Jobs > 1:
+		return &usageError{errors.New("-input - restores with a single pg_restore worker; leave -restore-jobs unset")}
+	}
+	dbLog := newDatabaseLog(target, false)
+
+	// The format is told by the first bytes of the stream, which are kept
+	// for the restore
+	br := bufio.NewReaderSize(in, dumpHeadSize)
+	head, err := br.Peek(dumpHeadSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to read the dump from stdin: %w", err)
+	}
+	tarHeader := dumpHeaders["tar"]
+	var format string
+	switch {
+	case len(head) == 0:
+		return errors.New("no dump on stdin")
+	case bytes.HasPrefix(head, []byte(dumpHeaders["custom"].magic)):
+		format = "custom"
+	case len(head) >= tarHeader.offset+len(tarHeader.magic) && string(head[tarHeader.offset:tarHeader.offset+len(tarHeader.magic)]) == tarHeader.magic:
+		format = "tar"
+	case isScript(head):
+		format = "plain"
+	default:
+		return errors.New("the dump on stdin is neither a custom or tar-format pg_dump archive nor an SQL script")
+	}
+	tablespaces, _ := config.ParseTablespaceRemaps(cfg.Restore.RemapTablespaces) // checked when the config was loaded
+	if format != "plain" && len(tablespaces) > 0 {
+		return errors.New("tablespaces of archives are remapped through their script, which cannot be read from stdin; restore a file instead")
+	}
+	if format == "plain" && cfg.Restore.DataOnly {
+		return errors.New("a plain dump cannot be restored data-only")
+	}
+	dbLog.out.Printf("Restoring database %s on %s from a %s-format dump on stdin\n", target, describeServer(cfg.Postgres), format)
+
+	if cfg.Restore.Role != "" {
+		if err := checkRestoreRole(ctx, cfg, cfg.Restore.Role, cfg.Restore.CreateRole); err != nil {
+			return err
+		}
+	}
+	if err := checkTablespaces(ctx, cfg); err != nil {
+		return err
+	}
+	if cfg.Restore.DropExisting {
+		if _, err := dropDatabase(ctx, cfg, dbLog, target); err != nil {
+			return fmt.Errorf("failed to drop database %s: %w", target, err)
+		}
+	}
+	if cfg.Restore.CreateMissing == nil || *cfg.Restore.CreateMissing || cfg.Restore.DropExisting {
+		if _, err := createMissingDatabase(ctx, cfg, dbLog, target); err != nil {
+			return fmt.Errorf("failed to create database %s: %w", target, err)
+		}
+	}
+
+	noOwner := cfg.Restore.SkipsOwners()
+	var name string
+	var args []string
+	filter := scriptFilter{}
+	if format == "plain" {
+		name = "psql"
+		args = []string{"-X", "-v", onErrorStop(cfg), "-d", target}
+		if cfg.Restore.SingleTransaction {
+			args = append(args, "-1")
+		}
+		if cfg.Restore.Role != "" {
+			args = append(args, "-c", "SET ROLE "+pq.QuoteIdentifier(cfg.Restore.Role))
+		}
+		args = append(args, "-f", "-")
+		filter = scriptFilter{noOwner: noOwner, noACL: cfg.Restore.NoACL, noTablespaces: cfg.Restore.NoTablespaces, tablespaces: tablespaces}
+	} else {
+		name = "pg_restore"
+		args = []string{"-d", target}
+		switch {
+		case cfg.Restore.DataOnly:
+			args = append(args, "--data-only")
+		case !cfg.Restore.DropExisting:
+			args = append(args, "-c", "--if-exists")
+		}
+		if cfg.Restore.SingleTransaction {
+			args = append(args, "--single-transaction")
+		}
+		if noOwner {
+			args = append(args, "--no-owner")
+		}
+		if cfg.Restore.NoACL {
+			args = append(args, "--no-acl")
+		}
+		if cfg.Restore.Role != "" {
+			args = append(args, "--role", cfg.Restore.Role)
+		}
+		if cfg.Restore.NoTablespaces {
+			args = append(args, "--no-tablespaces")
+		}
+		if cfg.Restore.DisableTriggers && cfg.Restore.DataOnly {
+			args = append(args, "--disable-triggers")
+		}
+	}
+
+	cmd, cleanup, err := postgres.Command(ctx, cfg.Postgres, cfg.Timeouts, name, args...)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	stderr := &errorLines{w: dbLog.stderr}
+	cmd.Stderr = stderr
+	defer dbLog.stderr.Flush()
+	var removed, rewritten int
+	if filter.active() {
+		// psql has no options to leave statements out, so the script is
+		// rewritten on its way in
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("failed to restore database %s: %w", target, err)
+		}
+		var copyErr error
+		removed, rewritten, copyErr = filter.copy(stdin, br)
+		stdin.Close()
+		if err := cmd.Wait(); err != nil {
+			return stderr.wrap(fmt.Errorf("failed to restore database %s: %w", target, err))
+		}
+		if copyErr != nil {
+			return fmt.Errorf("failed to restore database %s: %w", target, copyErr)
+		}
+		dbLog.out.Printf("Left %d ownership, privilege and tablespace statements out of the dump and moved %d to other tablespaces\n", removed, rewritten)
+	} else {
+		cmd.Stdin = br
+		if err := cmd.Run(); err != nil {
+			return stderr.wrap(fmt.Errorf("failed to restore database %s: %w", target, err))
+		}
+	}
+	if format == "plain" {
+		reportIgnoredErrors(dbLog, stderr, target)
+	}
+	dbLog.out.Printf("Database %s restored successfully from stdin\n", target)
+	var errs []error
+	if settings, _ := cfg.ForDatabase(target); len(settings.Validations) > 0 {
+		results := validateDatabase(ctx, cfg, dbLog, target, settings.Validations)
+		if cfg.Restore.ValidationFailure == "error" {
+			errs = validationErrors(results)
+		}
+	}
+	if cfg.Restore.PostAnalyze != "off" {
+		if err := analyzeDatabase(ctx, cfg, dbLog, target); err != nil {
+			dbLog.err.Printf("Warning: %v", err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"dbbackup/internal/postgres"
+)
+
+// printRestorePlan lists what a restore would do without touching the
+// server: the globals backup it would apply, then the backups it would
+// restore into each target database. With showTOC each backup is fetched
+// and the table of contents pg_restore -l prints for it follows. It
+// returns an error when the plan is incomplete, unplanned naming the
+// databases expected without a backup to restore, or a table of contents
+// could not be listed.
+func printRestorePlan(ctx context.Context, r *restoreRun, targets []string, sources map[string][]restoreSource, globalsKey string, unplanned []string, showTOC bool) error {
+	cfg := r.cfg
+	fmt.Println("Restore plan (dry run):")
+	fmt.Printf("  target server: %s\n", describeServer(cfg.Postgres))
+	switch {
+	case !cfg.Restore.Globals:
+		fmt.Println("  globals: skipped")
+	case globalsKey == "":
+		fmt.Println("  globals: none found")
+	default:
+		fmt.Printf("  globals: %s\n", r.source.location(globalsKey))
+	}
+
+	var errs []error
+	for _, target := range targets {
+		for _, b := range sources[target] {
+			from := ""
+			if b.database != b.target {
+				from = " from database " + b.database
+			}
+			format := "format unknown until fetched"
+			if b.format != "" {
+				format = b.format + " format"
+			}
+			fmt.Printf("  database %s%s: %s (%s, taken %s, %s)\n", target, from, r.source.location(b.key),
+				formatSize(b.size), b.taken.Local().Format(time.DateTime), format)
+			if showTOC {
+				if err := r.printTOC(ctx, b); err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to list the contents of %s: %v\n", b.key, err)
+					errs = append(errs, fmt.Errorf("database %s: %w", target, err))
+				}
+			}
+		}
+	}
+	if len(unplanned) > 0 {
+		fmt.Printf("  no backup: %s\n", strings.Join(unplanned, ", "))
+		errs = append(errs, fmt.Errorf("restore plan is incomplete: no backup to restore for database %s", strings.Join(unplanned, ", ")))
+	}
+	return errors.Join(errs...)
+}
+
+// printTOC fetches the backup b and prints the table of contents of its
+// archive, as pg_restore -l lists it.
+func (r *restoreRun) printTOC(ctx context.Context, b restoreSource) error {
+	dbLog := newDatabaseLog(b.target, false)
+	backupFilePath, err := r.fetchBackup(ctx, dbLog, b)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(backupFilePath)
+	if b.format == "" {
+		b.format = detectFormat(backupFilePath)
+	}
+
+	var args []string
+	switch b.format {
+	case "plain":
+		fmt.Printf("    %s is a plain SQL script, which has no table of contents\n", b.key)
+		return nil
+	case "directory":
+		dumpDir, err := unpackDirectory(r.cfg.WorkDir, backupFilePath)
+		if err != nil {
+			return fmt.Errorf("failed to unpack backup file %s: %w", b.key, err)
+		}
+		defer os.RemoveAll(dumpDir)
+		backupFilePath = dumpDir
+		args = []string{"-F", "d"}
+	case "custom", "tar":
+	default:
+		return fmt.Errorf("%s is neither a pg_dump archive nor an SQL script", b.key)
+	}
+
+	cmd, cleanup, err := postgres.Command(ctx, r.cfg.Postgres, r.cfg.Timeouts, "pg_restore", append(append([]string{"-l"}, args...), backupFilePath)...)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	cmd.Stdout = os.Stdout
+	stderr := &errorLines{w: os.Stderr}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return stderr.wrap(fmt.Errorf("failed to list the contents of %s: %w", b.key, err))
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+
+	"dbbackup/internal/config"
+)
+
+// prefetcher downloads the backups of a restore run ahead of their
+// restores, in the order they are restored, so that the server is not left
+// idle while S3 transfers run. The downloads held in the work directory,
+// from the start of each until its backup is restored, stay within budget
+// bytes of S3 objects, unless a single backup is larger on its own.
+type prefetcher struct {
+	run    *restoreRun
+	budget int64 // 0 for no limit
+	order  []restoreSource
+	items  map[string]*prefetched
+
+	// mu guards the fields below and the state of the items
+	mu      sync.Mutex
+	cond    *sync.Cond
+	held    int64 // bytes of the downloads started and not released
+	stopped bool
+}
+
+// prefetched is the download of a single backup.
+type prefetched struct {
+	ready    chan struct{} // closed once the download is over or passed over
+	path     string
+	err      error
+	started  bool // whether its bytes count towards held
+	released bool
+}
+
+func newPrefetcher(run *restoreRun, budget int64, order []restoreSource) *prefetcher {
+	p := &prefetcher{run: run, budget: budget, order: order, items: make(map[string]*prefetched, len(order))}
+	p.cond = sync.NewCond(&p.mu)
+	for _, b := range order {
+		p.items[b.key] = &prefetched{ready: make(chan struct{})}
+	}
+	return p
+}
+
+// start downloads the backups in order, n at a time, waiting for restores
+// to free their share of the budget.
+func (p *prefetcher) start(ctx context.Context, n int) {
+	slots := make(chan struct{}, n)
+	go func() {
+		for _, b := range p.order {
+			item := p.items[b.key]
+			slots <- struct{}{}
+			p.mu.Lock()
+			for !p.stopped && !item.released && p.held > 0 && p.budget > 0 && p.held+b.size > p.budget {
+				p.cond.Wait()
+			}
+			if p.stopped || item.released {
+				p.mu.Unlock()
+				<-slots
+				close(item.ready)
+				continue
+			}
+			item.started = true
+			p.held += b.size
+			p.mu.Unlock()
+
+			go func() {
+				defer func() { <-slots }()
+				dbLog := newDatabaseLog(b.target, true)
+				item.path, item.err = p.run.downloadBackup(ctx, dbLog, b)
+				close(item.ready)
+			}()
+		}
+	}()
+}
+
+// take waits for the download of b and hands it over to its restore.
+func (p *prefetcher) take(b restoreSource) (string, error) {
+	item := p.items[b.key]
+	<-item.ready
+	if item.path == "" && item.err == nil {
+		return "", errors.New("download given up as the restore stopped")
+	}
+	return item.path, item.err
+}
+
+// release frees the share of the budget the download of b holds once its
+// restore is over, removing the download unless the restore already has.
+// A backup released before its download started is not downloaded.
+func (p *prefetcher) release(b restoreSource) {
+	item := p.items[b.key]
+	p.mu.Lock()
+	if item.released {
+		p.mu.Unlock()
+		return
+	}
+	item.released = true
+	started := item.started
+	p.mu.Unlock()
+
+	if started {
+		<-item.ready
+		if item.path != "" {
+			os.Remove(item.path)
+		}
+	}
+	p.mu.Lock()
+	if started {
+		p.held -= b.size
+	}
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
+
+// stop gives up the downloads not yet started and removes those no restore
+// took, once they are over.
+func (p *prefetcher) stop() {
+	p.mu.Lock()
+	p.stopped = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+	for _, b := range p.order {
+		p.release(b)
+	}
+}
+
+// prefetchBudget describes the disk budget of the downloads held at once.
+func prefetchBudget(budget config.ByteSize) string {
+	if budget == 0 {
+		return "unlimited"
+	}
+	return budget.String()
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dbbackup/internal/config"
+)
+
+// progressReporter reports how far long transfers have got, every interval,
+// as text lines or as JSON events depending on the log format.
+type progressReporter struct {
+	out      *log.Logger // text reports, prefixed like the rest of the database's output
+	json     bool
+	interval time.Duration // 0 turns the reports off
+	database string        // the database transferred, empty for the globals
+}
+
+// newProgressReporter returns the reporter of the transfers of dbName,
+// writing text reports to out.
+func newProgressReporter(cfg *config.Config, out *log.Logger, dbName string) progressReporter {
+	return progressReporter{
+		out:      out,
+		json:     cfg.LogFormat == "json",
+		interval: cfg.ProgressInterval,
+		database: dbName,
+	}
+}
+
+// progressEvent is the JSON form of a progress report.
+type progressEvent struct {
+	Time           time.Time `json:"time"`
+	Event          string    `json:"event"`
+	Database       string    `json:"database,omitempty"`
+	Object         string    `json:"object"`
+	Bytes          int64     `json:"bytes"`
+	TotalBytes     int64     `json:"total_bytes"`
+	Percent        float64   `json:"percent"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	BytesPerSecond float64   `json:"bytes_per_second"`
+}
+
+// track reports the upload of size bytes to object, of which done counts
+// the bytes sent so far, until the returned function is called.
+func (p progressReporter) track(object string, size int64, done *atomic.Int64) (stop func()) {
+	if p.interval <= 0 || size <= 0 {
+		return func() {}
+	}
+	start := time.Now()
+	ticker := time.NewTicker(p.interval)
+	stopped := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-stopped:
+				return
+			case now := <-ticker.C:
+				// Parts retried by the SDK are read again, so the count
+				// may overshoot
+				p.report(object, min(done.Load(), size), size, now.Sub(start))
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(stopped)
+		<-finished
+	}
+}
+
+// report writes a single progress report.
+func (p progressReporter) report(object string, sent, size int64, elapsed time.Duration) {
+	rate := float64(sent) / elapsed.Seconds()
+	percent := float64(sent) * 100 / float64(size)
+	if p.json {
+		data, err := json.Marshal(progressEvent{
+			Time:           time.Now().UTC(),
+			Event:          "upload_progress",
+			Database:       p.database,
+			Object:         object,
+			Bytes:          sent,
+			TotalBytes:     size,
+			Percent:        percent,
+			ElapsedSeconds: elapsed.Seconds(),
+			BytesPerSecond: rate,
+		})
+		if err != nil {
+			return
+		}
+		// A single write keeps events of concurrent uploads on lines of
+		// their own
+		os.Stdout.Write(append(data, '\n'))
+		return
+	}
+	remaining := "unknown time"
+	if rate > 0 {
+		remaining = time.Duration(float64(size-sent) / rate * float64(time.Second)).Round(time.Second).String()
+	}
+	p.out.Printf("Uploading %s: %s of %s (%.0f%%) in %s, %s, %s left\n", object, formatSize(sent), formatSize(size),
+		percent, elapsed.Round(time.Second), formatThroughput(sent, elapsed), remaining)
+}
+
+// countingReader counts the bytes read from an upload body.
+type countingReader struct {
+	r    uploadReader
+	read *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingReader) Seek(offset int64, whence int) (int64, error) {
+	return c.r.Seek(offset, whence)
+}
+
+// restoreProgressEvent is the JSON form of a progress report of a restore.
+type restoreProgressEvent struct {
+	Time           time.Time `json:"time"`
+	Event          string    `json:"event"`
+	Database       string    `json:"database,omitempty"`
+	Object         string    `json:"object"`
+	Items          int       `json:"items"`
+	TotalItems     int       `json:"total_items"`
+	Percent        float64   `json:"percent"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+}
+
+// restoreItems counts the entries of a table of contents that pg_restore
+// --verbose reports as it restores them, with --data-only and --no-acl as
+// set. The count is approximate, as a few entries only set up the session.
+func restoreItems(entries []tocEntry, dataOnly, noACL bool) int {
+	n := 0
+	for _, entry := range entries {
+		switch {
+		case dataOnly && !slices.Contains(tocDataDescs, entry.desc):
+		case noACL && (entry.desc == "ACL" || entry.desc == "DEFAULT ACL"):
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+// tocDataDescs are the kinds of TOC entries that --data-only restores.
+var tocDataDescs = []string{"TABLE DATA", "SEQUENCE SET", "BLOBS", "BLOB DATA", "LARGE OBJECTS"}
+
+// restoreItemLine matches the lines pg_restore --verbose starts restoring
+// an entry with, capturing the entry.
+var restoreItemLine = regexp.MustCompile(`^(?:creating|processing data for table|executing) (.+)$`)
+
+// restoreChatter are the starts of the other lines of pg_restore --verbose,
+// which are left out of the output while its progress is reported.
+var restoreChatter = []string{
+	"connecting to ", "dropping ", "disabling triggers ", "enabling triggers ", "implied data-only restore",
+	"entering ", "finished main parallel loop", "processing item ", "processing missed item ", "launching item ",
+	"finished item ", "skipping item ", "transferring dependency ", "reducing dependencies ",
+	"restoring large object", "restored ", "setting owner and privileges ", "skipping tar member ",
+}
+
+// restoreProgress follows pg_restore --verbose on its way to w, counting
+// the entries restored and passing on the lines that are not about them,
+// such as warnings and errors. A line it does not recognise, as a later
+// pg_restore may print, turns the counting off and passes everything on
+// from then on.
+type restoreProgress struct {
+	w       io.Writer
+	partial []byte
+
+	// mu guards the fields below, which the reports read
+	mu          sync.Mutex
+	done        int
+	current     string
+	passThrough bool
+}
+
+func (r *restoreProgress) Write(p []byte) (int, error) {
+	r.partial = append(r.partial, p...)
+	for {
+		i := bytes.IndexByte(r.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := r.partial[:i+1]
+		r.partial = r.partial[i+1:]
+		if r.follow(string(bytes.TrimRight(line, "\r\n"))) {
+			continue
+		}
+		if _, err := r.w.Write(line); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+// Flush passes on a final line that lacks its newline.
+func (r *restoreProgress) Flush() error {
+	if len(r.partial) == 0 {
+		return nil
+	}
+	_, err := r.Write([]byte("\n"))
+	return err
+}
+
+// follow counts line if it starts an entry and reports whether it is left
+// out of the output.
+func (r *restoreProgress) follow(line string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.passThrough {
+		return false
+	}
+	message, ok := strings.CutPrefix(line, "pg_restore: ")
+	if !ok {
+		return false // the statements quoted after an error
+	}
+	if m := restoreItemLine.FindStringSubmatch(message); m != nil {
+		r.done++
+		r.current = m[1]
+		return true
+	}
+	for _, chatter := range restoreChatter {
+		if strings.HasPrefix(message, chatter) {
+			return true
+		}
+	}
+	for _, prefix := range []string{"error:", "warning:", "detail:", "hint:", "while PROCESSING TOC", "from TOC entry"} {
+		if strings.HasPrefix(message, prefix) {
+			return false
+		}
+	}
+	r.passThrough = true
+	return false
+}
+
+// trackRestore reports how many of the total entries of the archive object
+// restore has restored, until the returned function is called. It stops
+// reporting once restore can no longer make sense of pg_restore's output.
+func (p progressReporter) trackRestore(object string, total int, restore *restoreProgress) (stop func()) {
+	if p.interval <= 0 || total <= 0 {
+		return func() {}
+	}
+	start := time.Now()
+	ticker := time.NewTicker(p.interval)
+	stopped := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-stopped:
+				return
+			case now := <-ticker.C:
+				restore.mu.Lock()
+				done, current, passThrough := restore.done, restore.current, restore.passThrough
+				restore.mu.Unlock()
+				if passThrough {
+					p.out.Printf("Cannot follow pg_restore's progress on %s any longer; passing its output on\n", object)
+					return
+				}
+				// A few entries are restored without a line of their own,
+				// so the count may fall short of the total
+				p.reportRestore(object, min(done, total), total, current, now.Sub(start))
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(stopped)
+		<-finished
+	}
+}
+
+// reportRestore writes a single progress report of a restore.
+func (p progressReporter) reportRestore(object string, done, total int, current string, elapsed time.Duration) {
+	percent := float64(done) * 100 / float64(total)
+	if p.json {
+		data, err := json.Marshal(restoreProgressEvent{
+			Time:           time.Now().UTC(),
+			Event:          "restore_progress",
+			Database:       p.database,
+			Object:         current,
+			Items:          done,
+			TotalItems:     total,
+			Percent:        percent,
+			ElapsedSeconds: elapsed.Seconds(),
+		})
+		if err != nil {
+			return
+		}
+		os.Stdout.Write(append(data, '\n'))
+		return
+	}
+	p.out.Printf("Restoring %s: %d of %d entries (%.0f%%) in %s, at %s\n", object, done, total, percent, elapsed.Round(time.Second), current)
+}
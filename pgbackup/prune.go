@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"dbbackup/internal/config"
+	"dbbackup/internal/naming"
+	"dbbackup/internal/storage"
+)
+
+func runPrune(ctx context.Context, args []string) error {
+	var dryRun bool
+	cfg, err := loadConfig("prune", "Deletes backup objects under an S3 prefix that are older than the retention period.", args, config.Defaults(),
+		func(fs *flag.FlagSet, c *config.Config) {
+			fs.IntVar(&c.Retention.Days, "retention-days", c.Retention.Days, "delete backups older than this many days")
+			fs.BoolVar(&dryRun, "dry-run", false, "only print the objects that would be deleted")
+		})
+	if err != nil {
+		return err
+	}
+	if !hasRetention(cfg) {
+		return &usageError{errors.New("retention period is required (-retention-days, retention.days or databases.<name>.retention_days)")}
+	}
+
+	s3Client, err := storage.NewClient(ctx, cfg.S3, cfg.AWS)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := naming.Parse(cfg.Dump.FilenameTemplate)
+	if err != nil {
+		return err
+	}
+
+	objects, err := listS3Objects(ctx, s3Client, cfg.S3.Bucket, cfg.S3.Prefix)
+	if err != nil {
+		return err
+	}
+
+	// The parts of a split backup expire with their index, uploaded last
+	modified := make(map[string]time.Time, len(objects))
+	for _, object := range objects {
+		modified[*object.Key] = *object.LastModified
+	}
+
+	// Delete every backup last modified before its database's cutoff
+	now := time.Now()
+	var failed int
+	for _, object := range objects {
+		backupKey, lastModified := *object.Key, *object.LastModified
+		if isPartKey(backupKey) {
+			backupKey = partIndexKey(backupKey)
+			if indexModified, ok := modified[backupKey]; ok {
+				lastModified = indexModified
+			}
+		}
+		retentionDays := cfg.Retention.Days
+		if fields, ok := matchBackupKey(tmpl, backupKey); ok {
+			settings, _ := cfg.ForDatabase(fields.Database)
+			retentionDays = settings.RetentionDays
+		}
+		if retentionDays == 0 || !lastModified.Before(now.AddDate(0, 0, -retentionDays)) {
+			continue
+		}
+
+		if dryRun {
+			fmt.Printf("Would delete s3://%s/%s (retention %d days)\n", cfg.S3.Bucket, *object.Key, retentionDays)
+			continue
+		}
+		if err := deleteFromS3(ctx, s3Client, cfg.S3.Bucket, *object.Key); err != nil {
+			log.Printf("Failed to prune backup: %v", err)
+			failed++
+			continue
+		}
+		fmt.Printf("Deleted s3://%s/%s (retention %d days)\n", cfg.S3.Bucket, *object.Key, retentionDays)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to delete %d backup objects", failed)
+	}
+	return nil
+}
+
+// hasRetention reports whether a retention period is configured globally or for any database.
+func hasRetention(cfg *config.Config) bool {
+	if cfg.Retention.Days != 0 {
+		return true
+	}
+	for _, db := range cfg.Databases {
+		if db.RetentionDays != 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"text/tabwriter"
+
+	"dbbackup/internal/config"
+)
+
+// reconcileDatabases prints, under title, the databases with a backup below
+// the prefix next to those the target server has, with what the run does
+// with each. backedUp maps the names the backups are restored as to the
+// databases they were taken of, and status describes the restore of each.
+// It returns the databases of the target that have no backup, leaving out
+// those the filters, or -database, do not select and the system databases
+// of managed services.
+func reconcileDatabases(ctx context.Context, cfg *config.Config, title string, backedUp map[string]string, status func(database, target string) string) ([]string, error) {
+	databases, err := getDatabaseList(ctx, cfg.Postgres, cfg.Timeouts, config.Backup{DefaultExcludes: cfg.Backup.DefaultExcludes})
+	if err != nil {
+		return nil, err
+	}
+	selected := func(name string) bool {
+		if len(cfg.Restore.Databases) > 0 {
+			return len(cfg.Restore.Requested(name)) > 0
+		}
+		return cfg.Filters.Selected(name)
+	}
+
+	// A database renamed on restore still has a backup under its own name
+	renamed := make(map[string]bool)
+	for target, database := range backedUp {
+		renamed[database] = database != target
+	}
+	onTarget := make(map[string]bool)
+	var noBackup []string
+	for _, database := range databases {
+		onTarget[database.name] = true
+		if _, ok := backedUp[database.name]; ok || renamed[database.name] || database.managed || !selected(database.name) {
+			continue
+		}
+		noBackup = append(noBackup, database.name)
+	}
+
+	fmt.Println(title)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  DATABASE\tBACKUP\tON TARGET\tSTATUS")
+	yesNo := map[bool]string{true: "yes", false: "no"}
+	for _, name := range slices.Sorted(slices.Values(append(slices.Collect(maps.Keys(backedUp)), noBackup...))) {
+		database, ok := backedUp[name]
+		state := "no backup"
+		if ok {
+			state = status(database, name)
+			if database != name {
+				state += " (backup of " + database + ")"
+			}
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", name, yesNo[ok], yesNo[onTarget[name]], state)
+	}
+	return noBackup, w.Flush()
+}
+
+// restoreStatus describes what the run did with the backups of database,
+// restored as target, as summary records it so far; pending marks a target
+// the run has yet to restore.
+func restoreStatus(summary *runSummary, database, target string, pending bool) string {
+	switch {
+	case slices.Contains(summary.failed, target) || slices.Contains(summary.createFailed, target):
+		return "failed"
+	case slices.Contains(summary.succeeded, target):
+		return "restored"
+	case slices.Contains(summary.notAttempted, target):
+		return "not attempted"
+	case pending:
+		return "to restore"
+	}
+	for _, skipped := range summary.skipped {
+		if skipped.name == target || skipped.name == database {
+			return "skipped: " + skipped.reason
+		}
+	}
+	return "not restored"
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+
+	"dbbackup/internal/config"
+	"dbbackup/internal/naming"
+	"dbbackup/internal/storage"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func runRekey(ctx context.Context, args []string) error {
+	var dryRun bool
+	cfg, err := loadConfig("rekey", "Re-encrypts the encrypted backups under an S3 prefix with the current key, leaving the dumps inside unchanged.", args, config.Defaults(),
+		func(fs *flag.FlagSet, c *config.Config) {
+			registerEncryptionFlags(fs, c)
+			registerUploadFlags(fs, c)
+			registerDownloadFlags(fs, c)
+			config.StringsVar(fs, &c.Encryption.IdentityFiles, "identity", "age identity file or GPG private key file to decrypt the backups with (repeatable)")
+			fs.BoolVar(&dryRun, "dry-run", false, "only print the backups that would be re-encrypted")
+		})
+	if err != nil {
+		return err
+	}
+	if cfg.Encryption.Scheme == "none" {
+		return &usageError{errors.New("the current encryption is required (-encrypt)")}
+	}
+	if err := checkEncryption(cfg.Encryption); err != nil {
+		return &usageError{err}
+	}
+	if cfg.Encryption.Scheme != "kms" && len(cfg.Encryption.IdentityFiles) == 0 {
+		return &usageError{fmt.Errorf("-identity is required to decrypt backups encrypted with %s", cfg.Encryption.Scheme)}
+	}
+
+	// Rekey the selected backups
+	return rekeyBackups(ctx, cfg, dryRun)
+}
+
+func rekeyBackups(ctx context.Context, cfg *config.Config, dryRun bool) error {
+	runID := newRunID(time.Now())
+	fmt.Printf("Rekey run %s\n", runID)
+	if err := prepareWorkDir(cfg); err != nil {
+		return err
+	}
+
+	s3Client, err := storage.NewClient(ctx, cfg.S3, cfg.AWS)
+	if err != nil {
+		return err
+	}
+	kmsClient, err := storage.NewKMSClient(ctx, cfg.S3.Region, cfg.AWS)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := naming.Parse(cfg.Dump.FilenameTemplate)
+	if err != nil {
+		return err
+	}
+
+	// Identify the current key the way the backups record it
+	var currentKeyID string
+	if cfg.Encryption.Scheme == "kms" {
+		currentKeyID, err = resolveKMSKey(ctx, kmsClient, cfg.Encryption.KMSKeyID)
+	} else {
+		currentKeyID, err = encryptionKeyID(cfg.Encryption)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Select the backups encrypted with the current scheme; the scheme is
+	// part of their names, which rekeying keeps
+	objects, err := listS3Objects(ctx, s3Client, cfg.S3.Bucket, cfg.S3.Prefix)
+	if err != nil {
+		return err
+	}
+	type backup struct{ s3Key, dbName, storageClass string }
+	var selected []backup
+	for _, object := range objects {
+		s3Key, storageClass := aws.ToString(object.Key), string(object.StorageClass)
+		if isManifestKey(s3Key) {
+			continue
+		}
+		if scheme, _ := encryptionForKey(s3Key); scheme != cfg.Encryption.Scheme {
+			continue
+		}
+		if isGlobalsKey(s3Key) {
+			if len(cfg.Filters.Include) == 0 {
+				selected = append(selected, backup{s3Key: s3Key, storageClass: storageClass})
+			}
+			continue
+		}
+		fields, ok := matchBackupKey(tmpl, s3Key)
+		if !ok || !cfg.Filters.Selected(fields.Database) {
+			continue
+		}
+		selected = append(selected, backup{s3Key, fields.Database, storageClass})
+	}
+
+	// Rekey each backup, reporting its progress
+	var rekeyed, current, failed int
+	for i, b := range selected {
+		progress := fmt.Sprintf("[%d/%d] s3://%s/%s", i+1, len(selected), cfg.S3.Bucket, b.s3Key)
+		metadata, err := headS3Object(ctx, s3Client, cfg.S3.Bucket, b.s3Key, "")
+		if err != nil {
+			log.Printf("%s: %v", progress, err)
+			failed++
+			continue
+		}
+		if metadata["parts"] != "" {
+			log.Printf("%s: split into %s parts, which rekey cannot re-encrypt", progress, metadata["parts"])
+			failed++
+			continue
+		}
+		if metadata["key-id"] == currentKeyID {
+			fmt.Printf("%s: already encrypted with the current key\n", progress)
+			current++
+			continue
+		}
+		if dryRun {
+			fmt.Printf("%s: would re-encrypt (key %s)\n", progress, keyIDOrUnknown(metadata["key-id"]))
+			continue
+		}
+		if err := rekeyBackup(ctx, cfg, s3Client, kmsClient, runID, b.dbName, b.s3Key, b.storageClass, metadata); err != nil {
+			log.Printf("%s: failed to re-encrypt: %v", progress, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: re-encrypted (key %s replaced by %s)\n", progress, keyIDOrUnknown(metadata["key-id"]), currentKeyID)
+		rekeyed++
+	}
+
+	fmt.Printf("Rekey complete: %d re-encrypted, %d already current, %d failed, of %d backups\n", rekeyed, current, failed, len(selected))
+	if failed > 0 {
+		return fmt.Errorf("failed to re-encrypt %d backups", failed)
+	}
+	return nil
+}
+
+// rekeyBackup downloads the backup of dbName, empty for the globals, stored
+// as s3Key in storageClass as a work file of the run runID and replaces it
+// with a copy encrypted under the current key. The plaintext is streamed
+// between the two encryptions and never stored.
+func rekeyBackup(ctx context.Context, cfg *config.Config, s3Client *s3.Client, kmsClient *kms.Client, runID, dbName, s3Key, storageClass string, metadata map[string]string) error {
+	encryptionContext := kmsEncryptionContext(dbName, s3Key)
+
+	// Download the backup from S3
+	rekeyedPath := workPath(cfg.WorkDir, runID, filepath.Base(s3Key))
+	backupFilePath := rekeyedPath + ".old"
+	if err := downloadFromS3(ctx, s3Client, cfg.S3, s3Key, "", backupFilePath); err != nil {
+		return err
+	}
+	defer os.Remove(backupFilePath)
+
+	// Unwrap the old data key of a KMS-encrypted backup, under whichever
+	// key it was generated with
+	var oldDataKey []byte
+	if cfg.Encryption.Scheme == "kms" {
+		var err error
+		if oldDataKey, err = decryptDataKey(ctx, kmsClient, metadata, "", encryptionContext); err != nil {
+			return err
+		}
+	}
+
+	// Re-encrypt the backup under the current key
+	dataKey, encryptionMetadata, err := newEncryption(ctx, kmsClient, cfg.Encryption, encryptionContext)
+	if err != nil {
+		return err
+	}
+	digest, err := reencryptFile(backupFilePath, rekeyedPath, cfg.Encryption, cfg.Encryption.IdentityFiles, oldDataKey, dataKey)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(rekeyedPath)
+
+	// Replace the backup, keeping its tags, storage class and the rest of
+	// its metadata
+	tags, err := getS3ObjectTags(ctx, s3Client, cfg.S3.Bucket, s3Key)
+	if err != nil {
+		return err
+	}
+	metadata = maps.Clone(metadata)
+	delete(metadata, "kms-wrapped-key")
+	maps.Copy(metadata, encryptionMetadata)
+	metadata["sha256"] = digest
+	s3Cfg := cfg.S3
+	s3Cfg.StorageClass = storageClass
+	_, err = uploadToS3(ctx, s3Client, rekeyedPath, s3Cfg, s3Key, metadata, tags, newProgressReporter(cfg, log.New(os.Stdout, "", 0), dbName))
+	return err
+}
+
+// keyIDOrUnknown returns keyID, or a placeholder for backups uploaded before
+// key identifiers were recorded.
+func keyIDOrUnknown(keyID string) string {
+	if keyID == "" {
+		return "unknown"
+	}
+	return keyID
+}
@@ -0,0 +1,1493 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dbbackup/internal/config"
+	"dbbackup/internal/naming"
+	"dbbackup/internal/postgres"
+	"dbbackup/internal/storage"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/lib/pq"
+)
+
+func runRestore(ctx context.Context, args []string) error {
+	// S3_DIR is still honoured as the lowest-precedence source of the prefix
+	defaults := config.Defaults()
+	defaults.S3.Prefix = os.Getenv("S3_DIR")
+
+	var confirmDrop bool
+	var opts restoreOptions
+	cfg, err := loadConfig("restore", "Restores every database backup found under an S3 prefix.", args, defaults,
+		func(fs *flag.FlagSet, c *config.Config) {
+			fs.IntVar(&c.Dump.Jobs, "jobs", c.Dump.Jobs, "parallel pg_restore workers for directory-format backups")
+			config.StringsVar(fs, &c.Restore.Tables, "restore-table", "restore only this table, as schema.table or table, with its data and the sequences it owns (repeatable)")
+			config.StringsVar(fs, &c.Restore.Schemas, "restore-schema", "restore only the objects of this schema (repeatable)")
+			fs.BoolVar(&c.Restore.DataOnly, "data-only", c.Restore.DataOnly, "restore only the data, into tables that already exist")
+			fs.BoolVar(&c.Restore.SingleTransaction, "single-transaction", c.Restore.SingleTransaction, "restore each backup in a single transaction, so that a failed restore leaves nothing behind; cannot be combined with -restore-jobs above 1")
+			fs.BoolVar(&c.Restore.ContinueOnError, "continue-on-error", c.Restore.ContinueOnError, "let psql carry on past errors in plain backups, for scripts known to contain ignorable ones, instead of stopping at the first")
+			fs.IntVar(&c.Restore.Concurrency, "concurrency", c.Restore.Concurrency, "number of databases to restore at once")
+			fs.IntVar(&c.Restore.Prefetch, "prefetch", c.Restore.Prefetch, "download this many upcoming backups at once while earlier ones are restored; 0 downloads each as its restore starts")
+			fs.Var(&c.Restore.PrefetchDisk, "prefetch-disk", "most bytes of prefetched backups held in the work directory at once, e.g. 20GiB; 0 sets no limit")
+			fs.StringVar(&c.Restore.Source, "source", c.Restore.Source, "where to restore from: s3 for the bucket and prefix, or dir:PATH for the backup files in a local directory, which needs no AWS configuration")
+			fs.StringVar(&c.Restore.Target.Host, "target-host", c.Restore.Target.Host, "restore into the server on this host, or Unix socket directory, instead of -db-host, e.g. backups of production into a staging server")
+			fs.IntVar(&c.Restore.Target.Port, "target-port", c.Restore.Target.Port, "restore into the server on this port instead of -db-port")
+			fs.StringVar(&c.Restore.Target.User, "target-user", c.Restore.Target.User, "connect to the restore target as this user instead of -db-user")
+			fs.StringVar(&c.Restore.Input, "input", c.Restore.Input, `"-" to restore the custom, tar or plain dump piped to stdin into the single database -database names, without S3; everything is logged to stderr`)
+			registerDownloadFlags(fs, c)
+			registerOnErrorFlag(fs, c)
+			fs.StringVar(&c.Restore.CacheDir, "cache-dir", c.Restore.CacheDir, "keep downloaded backups in this directory and reuse them while their S3 ETag is unchanged")
+			fs.Var(&c.Restore.CacheSize, "cache-size", "most bytes kept in -cache-dir, evicting the least recently used downloads first, e.g. 200GiB; 0 sets no limit")
+			fs.BoolVar(&c.Restore.NoCache, "no-cache", c.Restore.NoCache, "download every backup afresh, bypassing -cache-dir")
+			fs.BoolVar(&c.Restore.Resume, "resume", c.Restore.Resume, "skip the backups the latest unfinished restore of the prefix already restored")
+			fs.BoolFunc("no-resume", "start afresh, discarding the progress of unfinished restores of the prefix; the same as -resume=false", func(value string) error {
+				noResume, err := strconv.ParseBool(value)
+				c.Restore.Resume = !noResume
+				return err
+			})
+			fs.StringVar(&c.Restore.ValidationFailure, "validation-failure", c.Restore.ValidationFailure, "what a failed validation check of a restored database does: warn, or error to also fail the run")
+			config.OptionalVar(fs, &c.Restore.PostAnalyze, "post-analyze", "analyze", "off", "gather planner statistics of each restored database with ANALYZE, or with vacuumdb --analyze-in-stages as -post-analyze=stages; a failure is reported without failing the restore")
+			fs.DurationVar(&c.Timeouts.Analyze, "analyze-timeout", c.Timeouts.Analyze, "bound the statistics gathering of -post-analyze for each database, e.g. 30m; 0 waits indefinitely")
+			fs.StringVar(&c.Restore.Glacier, "glacier", c.Restore.Glacier, "what to do with backups archived in Glacier or Deep Archive: initiate their retrieval and exit with status 4, wait for it, or skip them")
+			fs.StringVar(&c.Restore.GlacierTier, "glacier-tier", c.Restore.GlacierTier, "retrieval tier of archived backups: Standard, Bulk or Expedited")
+			fs.IntVar(&c.Restore.GlacierDays, "glacier-days", c.Restore.GlacierDays, "days S3 keeps the retrieved copies of archived backups")
+			fs.DurationVar(&c.Timeouts.Glacier, "glacier-timeout", c.Timeouts.Glacier, "bound the wait of -glacier wait for archived backups to be retrieved, e.g. 12h; 0 waits indefinitely")
+			fs.BoolVar(&c.Restore.RequireChecksum, "require-checksum", c.Restore.RequireChecksum, "fail the restore of a backup whose object records no SHA-256, instead of restoring it unchecked")
+			fs.IntVar(&c.Restore.Jobs, "restore-jobs", c.Restore.Jobs, "parallel pg_restore workers for custom and directory-format backups; 0 uses -jobs for directory-format backups")
+			fs.BoolVar(&c.Restore.Globals, "globals", c.Restore.Globals, "apply the latest roles and tablespaces backup with psql before restoring the databases")
+			fs.BoolFunc("skip-globals", "do not apply the globals backup, for managed servers that forbid role statements; the same as -globals=false", func(value string) error {
+				skip, err := strconv.ParseBool(value)
+				c.Restore.Globals = !skip
+				return err
+			})
+			fs.BoolVar(&c.Restore.DisableTriggers, "disable-triggers", c.Restore.DisableTriggers, "disable triggers while loading data-only backups so foreign keys do not get in the way")
+			fs.StringVar(&c.Encryption.KMSKeyID, "kms-key-id", c.Encryption.KMSKeyID, "only decrypt KMS-encrypted backups whose data keys belong to this KMS key")
+			config.StringsVar(fs, &c.Encryption.IdentityFiles, "identity", "age identity file or GPG private key file to decrypt encrypted backups with (repeatable)")
+			fs.StringVar(&c.Local.Dir, "keep-local", c.Local.Dir, "restore from the copies backup -keep-local kept in this directory when their SHA-256 matches, instead of downloading")
+			config.StringsVar(fs, &c.Restore.Databases, "database", "restore only this database, glob or re: regular expression, in place of the filters; each must have a backup below the prefix (repeatable)")
+			config.StringsVar(fs, &c.Restore.Renames, "rename", "restore the backups of database old into database new, given as old=new (repeatable)")
+			fs.BoolFunc("create-missing", "create target databases the server does not have before restoring them; on by default when no databases are selected", func(value string) error {
+				createMissing, err := strconv.ParseBool(value)
+				c.Restore.CreateMissing = &createMissing
+				return err
+			})
+			fs.StringVar(&c.Restore.Create.Owner, "create-owner", c.Restore.Create.Owner, "owner of the databases -create-missing creates, instead of the connecting role")
+			fs.StringVar(&c.Restore.Create.Template, "create-template", c.Restore.Create.Template, "template of the databases -create-missing creates, e.g. template0 to change the encoding or locale")
+			fs.StringVar(&c.Restore.Create.Encoding, "create-encoding", c.Restore.Create.Encoding, "encoding of the databases -create-missing creates, e.g. UTF8")
+			fs.StringVar(&c.Restore.Create.Locale, "create-locale", c.Restore.Create.Locale, "collation and character classification locale of the databases -create-missing creates")
+			fs.StringVar(&c.Restore.Create.LocaleProvider, "create-locale-provider", c.Restore.Create.LocaleProvider, "locale provider of the databases -create-missing creates: libc or icu")
+			fs.StringVar(&c.Restore.Create.ICULocale, "create-icu-locale", c.Restore.Create.ICULocale, "ICU locale of the databases -create-missing creates, with -create-locale-provider icu")
+			fs.BoolVar(&c.Restore.DropExisting, "drop-existing", c.Restore.DropExisting, "terminate the sessions of each target database, drop it and recreate it before restoring, instead of cleaning it; requires -confirm-drop")
+			fs.BoolVar(&confirmDrop, "confirm-drop", false, "confirm that -drop-existing may drop the target databases")
+			fs.StringVar(&c.Restore.AsOf, "as-of", c.Restore.AsOf, "restore the latest backup of each database taken at or before this time, in RFC 3339 or as a date")
+			fs.StringVar(&c.Restore.RunID, "run-id", c.Restore.RunID, "restore the backups of the run whose ID starts with this, as listed in its manifest")
+			fs.BoolVar(&c.Restore.AllVersions, "all-versions", c.Restore.AllVersions, "restore every backup of each database below the prefix, oldest first, instead of only the latest")
+			fs.BoolVar(&c.Restore.NoOwner, "no-owner", c.Restore.NoOwner, "do not restore the owners of objects, leaving them owned by the restoring role")
+			fs.StringVar(&c.Restore.Role, "restore-role", c.Restore.Role, "create the restored objects as this role, which then owns them, in place of their original owners; implies -no-owner")
+			fs.BoolVar(&c.Restore.CreateRole, "create-role", c.Restore.CreateRole, "create the -restore-role role, and grant it to the connecting role, when the server lacks it")
+			fs.BoolVar(&c.Restore.CreateMissingRoles, "create-missing-roles", c.Restore.CreateMissingRoles, "create, without login, the roles a backup makes owners or grants privileges to that the server lacks, before restoring it")
+			fs.BoolVar(&c.Restore.CreateExtensions, "create-extensions", c.Restore.CreateExtensions, "create the extensions a backup needs that the target database lacks before restoring it; the server must provide them")
+			fs.BoolVar(&c.Restore.StrictCompat, "strict-compat", c.Restore.StrictCompat, "refuse to restore backups of a newer server than the target, of a newer pg_dump than the local pg_restore, or of another collation than they are restored with, instead of warning")
+			fs.BoolVar(&c.Restore.Strict, "strict", c.Restore.Strict, "fail the run, before restoring anything, when a database of the target has no backup below the prefix")
+			fs.BoolVar(&c.Restore.NoTablespaces, "no-tablespaces", c.Restore.NoTablespaces, "create every object in the target database's default tablespace")
+			config.StringsVar(fs, &c.Restore.RemapTablespaces, "remap-tablespace", "create the objects of tablespace old in tablespace new, given as old=new, restoring archives through psql (repeatable)")
+			fs.BoolVar(&c.Restore.NoACL, "no-acl", c.Restore.NoACL, "do not restore the privileges granted on objects")
+			fs.BoolVar(&c.Restore.AllowSchemaOnly, "allow-schema-only", c.Restore.AllowSchemaOnly, "restore schema-only backups, which create empty tables")
+			fs.BoolVar(&opts.dryRun, "dry-run", false, "only print the backups that would be restored into each database, failing when a database has none")
+			fs.BoolVar(&opts.interactive, "interactive", false, "list the backups below the prefix and ask which to restore, confirming each database overwritten by name")
+			fs.BoolVar(&opts.showTOC, "show-toc", false, "with -dry-run, fetch each backup and print the table of contents pg_restore -l lists for it")
+			fs.StringVar(&opts.key, "key", "", "restore only the backup stored as this S3 key, without listing the prefix")
+			fs.StringVar(&opts.versionID, "version-id", "", "with -key, restore this version of the object, as list -versions shows it, from a versioned bucket instead of the latest")
+		})
+	if err != nil {
+		return err
+	}
+
+	// The backups are found by the server they were taken from, which the
+	// connection settings name, and restored into the target
+	source := cfg.Postgres
+	cfg.Postgres = cfg.RestoreServer()
+	if cfg.Restore.Input != "" {
+		if opts != (restoreOptions{}) {
+			return &usageError{errors.New("-input - restores the dump on stdin and cannot be combined with -dry-run, -show-toc, -interactive, -key or -version-id")}
+		}
+		if cfg.Restore.DropExisting && !confirmDrop {
+			return &usageError{errors.New("-drop-existing drops the target database before restoring it; pass -confirm-drop to go ahead")}
+		}
+		logToStderr()
+		return restoreStream(ctx, cfg, os.Stdin)
+	}
+	dir, _ := config.ParseRestoreSource(cfg.Restore.Source) // checked when the config was loaded
+	if cfg.S3.Prefix == "" && dir == "" && opts.key == "" {
+		return &usageError{errors.New("S3 prefix is required (-s3-prefix, BACKUP_S3_PREFIX or S3_DIR)")}
+	}
+	if cfg.Restore.DropExisting && !confirmDrop {
+		return &usageError{errors.New("-drop-existing drops every target database before restoring it; pass -confirm-drop to go ahead")}
+	}
+	if opts.showTOC && !opts.dryRun {
+		return &usageError{errors.New("-show-toc only applies to -dry-run")}
+	}
+	if opts.interactive && cfg.Restore.AllVersions {
+		return &usageError{errors.New("-interactive picks a single backup of each database and cannot be combined with -all-versions")}
+	}
+	switch {
+	case opts.versionID != "" && opts.key == "":
+		return &usageError{errors.New("-version-id picks a version of the object -key names, which is required with it")}
+	case opts.key == "":
+	case dir != "":
+		return &usageError{errors.New("-key names an S3 object and cannot be combined with -source dir:")}
+	case cfg.Restore.RunID != "" || cfg.Restore.AsOf != "" || cfg.Restore.AllVersions || opts.interactive:
+		return &usageError{errors.New("-key restores a single backup and cannot be combined with -run-id, -as-of, -all-versions or -interactive")}
+	}
+
+	// Restore all databases from S3 backups
+	return restoreAllDatabasesFromS3(ctx, cfg, source, opts)
+}
+
+// restoreDatabase restores the archive at backupFilePath into dbName with
+// pg_restore, reporting its progress through the total entries it
+// restores when that is known.
+func restoreDatabase(ctx context.Context, cfg *config.Config, dbLog *databaseLog, dbName, backupFilePath string, restoreArgs []string, total int) error {
+	// Run the pg_restore command to restore the database; pg_restore detects
+	// whether the archive is in custom or tar format. Its progress is
+	// followed through the entries --verbose reports
+	progress := newProgressReporter(cfg, dbLog.out, dbName)
+	args := append([]string{"-d", dbName}, restoreArgs...)
+	if total > 0 && progress.interval > 0 {
+		args = append(args, "--verbose")
+	}
+	cmd, cleanup, err := postgres.Command(ctx, cfg.Postgres, cfg.Timeouts, "pg_restore", append(args, backupFilePath)...)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	stderr := &errorLines{w: dbLog.stderr}
+	cmd.Stderr = stderr
+	defer dbLog.stderr.Flush()
+	if slices.Contains(args, "--verbose") {
+		restore := &restoreProgress{w: stderr}
+		cmd.Stderr = restore
+		defer restore.Flush()
+		stop := progress.trackRestore(filepath.Base(backupFilePath), total, restore)
+		defer stop()
+	}
+	if err := cmd.Run(); err != nil {
+		return stderr.wrap(fmt.Errorf("failed to restore database %s: %w", dbName, err))
+	}
+
+	dbLog.out.Printf("Database %s restored successfully from %s\n", dbName, backupFilePath)
+	return nil
+}
+
+// restoreArchiveScript restores the archive at backupFilePath into dbName
+// by piping the script pg_restore writes for it through filter into psql,
+// for the changes pg_restore cannot make itself.
+func restoreArchiveScript(ctx context.Context, cfg *config.Config, dbLog *databaseLog, dbName, backupFilePath string, restoreArgs []string, filter scriptFilter) error {
+	args := append([]string{"-f", "-"}, restoreArgs...)
+	dump, cleanupDump, err := postgres.Command(ctx, cfg.Postgres, cfg.Timeouts, "pg_restore", append(args, backupFilePath)...)
+	if err != nil {
+		return err
+	}
+	defer cleanupDump()
+	script, err := dump.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	psql, cleanupPsql, err := postgres.Command(ctx, cfg.Postgres, cfg.Timeouts, "psql", "-X", "-v", onErrorStop(cfg), "-d", dbName)
+	if err != nil {
+		return err
+	}
+	defer cleanupPsql()
+	stderr := &errorLines{w: dbLog.stderr}
+	psql.Stderr = stderr
+	defer dbLog.stderr.Flush()
+	stdin, err := psql.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := dump.Start(); err != nil {
+		return fmt.Errorf("failed to restore database %s: %w", dbName, err)
+	}
+	if err := psql.Start(); err != nil {
+		dump.Process.Kill()
+		dump.Wait()
+		return fmt.Errorf("failed to restore database %s: %w", dbName, err)
+	}
+	_, rewritten, copyErr := filter.copy(stdin, script)
+	stdin.Close()
+	io.Copy(io.Discard, script) // let pg_restore finish when psql stopped early
+	dumpErr := dump.Wait()
+	if err := psql.Wait(); err != nil {
+		return stderr.wrap(fmt.Errorf("failed to restore database %s: %w", dbName, err))
+	}
+	if dumpErr != nil {
+		return fmt.Errorf("failed to restore database %s: pg_restore: %w", dbName, dumpErr)
+	}
+	if copyErr != nil {
+		return fmt.Errorf("failed to restore database %s: %w", dbName, copyErr)
+	}
+	reportIgnoredErrors(dbLog, stderr, dbName)
+
+	dbLog.out.Printf("Database %s restored successfully from %s, moving %d groups of objects to other tablespaces\n", dbName, backupFilePath, rewritten)
+	return nil
+}
+
+// restorePlainDatabase applies a plain SQL backup to dbName with psql,
+// stopping at the first error unless -continue-on-error is given.
+func restorePlainDatabase(ctx context.Context, cfg *config.Config, dbLog *databaseLog, dbName, backupFilePath string, restoreArgs []string) error {
+	args := append([]string{"-X", "-v", onErrorStop(cfg), "-d", dbName}, restoreArgs...)
+	cmd, cleanup, err := postgres.Command(ctx, cfg.Postgres, cfg.Timeouts, "psql", append(args, "-f", backupFilePath)...)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	stderr := &errorLines{w: dbLog.stderr}
+	cmd.Stderr = stderr
+	defer dbLog.stderr.Flush()
+	if err := cmd.Run(); err != nil {
+		return stderr.wrap(fmt.Errorf("failed to restore database %s: %w", dbName, err))
+	}
+	reportIgnoredErrors(dbLog, stderr, dbName)
+
+	dbLog.out.Printf("Database %s restored successfully from %s\n", dbName, backupFilePath)
+	return nil
+}
+
+// onErrorStop returns the psql variable setting that makes scripts stop at
+// their first error, or carry on past errors with -continue-on-error.
+func onErrorStop(cfg *config.Config) string {
+	if cfg.Restore.ContinueOnError {
+		return "ON_ERROR_STOP=0"
+	}
+	return "ON_ERROR_STOP=1"
+}
+
+// reportIgnoredErrors warns of the errors psql carried on past while
+// restoring dbName.
+func reportIgnoredErrors(dbLog *databaseLog, stderr *errorLines, dbName string) {
+	if stderr.count > 0 {
+		dbLog.err.Printf("Warning: psql carried on past %d errors restoring database %s, the first: %s", stderr.count, dbName, stderr.first)
+	}
+}
+
+// isBackupKey reports whether key is named like a backup, ending in the
+// extension of a dump format once any compression and encryption suffixes
+// are removed, or named as backups were before the filename template.
+func isBackupKey(key string) bool {
+	_, plainKey := encryptionForKey(key)
+	_, plainKey = compressionForKey(plainKey)
+	for _, format := range dumpFormats {
+		if strings.HasSuffix(plainKey, format.ext) {
+			return true
+		}
+	}
+	return legacyBackupName.MatchString(path.Base(plainKey))
+}
+
+// contentForKey returns what a backup uploaded without content metadata
+// holds, judging by the marker ahead of its extension.
+func contentForKey(key string) string {
+	for content, marker := range contentMarkers {
+		if marker == "" {
+			continue
+		}
+		for _, format := range dumpFormats {
+			if strings.HasSuffix(key, marker+format.ext) {
+				return content
+			}
+		}
+	}
+	return "full"
+}
+
+// restorePrefixes returns the key prefixes to list for a restore of the
+// backups taken from host. With -database or an include filter naming
+// databases and a layout that places each database in its own subtree,
+// only those subtrees are listed; otherwise the whole run prefix is.
+func restorePrefixes(cfg *config.Config, layout naming.Layout, host string) []string {
+	names, ok := cfg.Filters.IncludedNames()
+	if len(cfg.Restore.Databases) > 0 {
+		names, ok = cfg.Restore.RequestedNames()
+	}
+	if !ok {
+		return []string{cfg.S3.Prefix}
+	}
+	var prefixes []string
+	for _, dbName := range names {
+		prefix, ok := layout.DatabasePrefix(cfg.S3.Prefix, host, dbName)
+		if !ok {
+			return []string{cfg.S3.Prefix}
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+// restoreOptions are the ways of running a restore given on its command
+// line only.
+type restoreOptions struct {
+	dryRun      bool // only print the plan
+	showTOC     bool // print the tables of contents of the backups in the plan
+	interactive bool // ask which backups to restore
+
+	// key is restored alone, at versionID unless it is empty
+	key, versionID string
+}
+
+// restoreAllDatabasesFromS3 restores the backups below the prefix that the
+// server sourceServer names took into the server of cfg, as opts has it.
+func restoreAllDatabasesFromS3(ctx context.Context, cfg *config.Config, sourceServer config.Postgres, opts restoreOptions) error {
+	runID := newRunID(time.Now())
+	fmt.Printf("Restore run %s\n", runID)
+	summary := &runSummary{title: "Restore"}
+	summary.setting("run", runID)
+	if err := prepareWorkDir(cfg); err != nil {
+		return err
+	}
+
+	// The target must be reachable before anything is downloaded; a dry
+	// run leaves it alone
+	target := describeServer(cfg.Postgres)
+	summary.setting("target server", target)
+	var release string
+	if !opts.dryRun {
+		var err error
+		release, err = postgres.ServerRelease(ctx, cfg.Postgres, cfg.Timeouts)
+		if err != nil {
+			return fmt.Errorf("failed to connect to the restore target %s: %w", target, err)
+		}
+		fmt.Printf("Restoring into PostgreSQL %s at %s\n", release, target)
+	}
+
+	source, err := newBackupSource(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	summary.setting("source", source.String())
+	kmsClient, err := storage.NewKMSClient(ctx, cfg.S3.Region, cfg.AWS)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := naming.Parse(cfg.Dump.FilenameTemplate)
+	if err != nil {
+		return err
+	}
+	layout, err := naming.ParseLayout(cfg.S3.KeyLayout)
+	if err != nil {
+		return err
+	}
+
+	// List all backup files in the S3 bucket, only walking the subtrees of
+	// the included databases when the key layout groups them, or in the
+	// directory restored from. A backup asked for by key is looked up alone,
+	// at the version asked for
+	var objects []types.Object
+	if opts.key != "" {
+		source.versionKey, source.versionID = opts.key, opts.versionID
+		object, err := source.object(ctx, opts.key)
+		if err != nil {
+			return err
+		}
+		objects = []types.Object{object}
+		summary.setting("key", opts.key)
+		if opts.versionID != "" {
+			summary.setting("version", opts.versionID)
+		}
+	} else if objects, err = source.list(ctx, restorePrefixes(cfg, layout, hostLabel(sourceServer))); err != nil {
+		return err
+	}
+
+	// Consider the newest objects first, in an order that does not depend
+	// on how S3 lists them, once each however many prefixes listed them
+	slices.SortFunc(objects, func(a, b types.Object) int {
+		if c := aws.ToTime(b.LastModified).Compare(aws.ToTime(a.LastModified)); c != 0 {
+			return c
+		}
+		return strings.Compare(aws.ToString(a.Key), aws.ToString(b.Key))
+	})
+	objects = slices.CompactFunc(objects, func(a, b types.Object) bool { return aws.ToString(a.Key) == aws.ToString(b.Key) })
+
+	// Find the database of every backup file, and which of the requested
+	// databases have backups
+	var backups []listedBackup
+	found := make(map[string]bool)
+	ignore := func(s3Key, reason string) {
+		if cfg.Verbose || opts.key != "" {
+			log.Printf("Ignoring %s: %s", source.location(s3Key), reason)
+		}
+	}
+	excluded := make(map[string]bool)
+	var listed []string // every database with a backup, selected or not
+	for _, object := range objects {
+		s3Key := aws.ToString(object.Key)
+		if isManifestKey(s3Key) || isGlobalsKey(s3Key) || isPartKey(s3Key) {
+			continue
+		}
+		if strings.HasSuffix(s3Key, "/") || aws.ToInt64(object.Size) == 0 {
+			ignore(s3Key, "empty object or directory placeholder")
+			continue
+		}
+		metadata, err := source.metadata(ctx, s3Key)
+		if err != nil {
+			log.Printf("Failed to read backup file %s: %v", s3Key, err)
+			continue
+		}
+		if metadata["database"] == "" && !isBackupKey(s3Key) {
+			ignore(s3Key, "neither recorded as a backup nor named like one")
+			continue
+		}
+		if metadata["parts"] != "" && source.versionOf(s3Key) != "" {
+			return fmt.Errorf("backup %s is split into parts, which are read at their latest versions whatever version of it -version-id picks", s3Key)
+		}
+
+		// The database name recorded at upload wins over the one in the
+		// name, which older backups are parsed for with the template they
+		// were named with. A backup whose database cannot be told is not
+		// restored into a guessed one
+		dbName := metadata["database"]
+		if dbName == "" {
+			var ok bool
+			if dbName, ok = databaseForKey(tmpl, s3Key); !ok {
+				log.Printf("Error: cannot tell the database of %s: it has no database metadata and its name matches neither filename template %s nor database_backup_YYYYMMDD_HHMMSS", s3Key, tmpl)
+				summary.skip(s3Key, "database unknown")
+				continue
+			}
+		}
+		if !slices.Contains(listed, dbName) {
+			listed = append(listed, dbName)
+		}
+		if len(cfg.Restore.Databases) > 0 {
+			requested := cfg.Restore.Requested(dbName)
+			if len(requested) == 0 {
+				continue
+			}
+			for _, pattern := range requested {
+				found[pattern] = true
+			}
+		} else if !cfg.Filters.Selected(dbName) {
+			if !excluded[dbName] {
+				summary.skip(dbName, "excluded by filters")
+				excluded[dbName] = true
+			}
+			continue
+		}
+		backups = append(backups, listedBackup{s3Key, dbName, metadata, backupTaken(metadata, object), aws.ToInt64(object.Size), object.StorageClass})
+	}
+	var missing []string
+	for _, pattern := range cfg.Restore.Databases {
+		if !found[pattern] {
+			missing = append(missing, pattern)
+		}
+	}
+	if len(missing) > 0 && !opts.dryRun {
+		return fmt.Errorf("no backup below %s for requested database %s", source, strings.Join(missing, ", "))
+	}
+	var databases []string
+	for _, backup := range backups {
+		if !slices.Contains(databases, backup.database) {
+			databases = append(databases, backup.database)
+		}
+	}
+	if len(cfg.Restore.Databases) > 0 {
+		summary.setting("requested", strings.Join(cfg.Restore.Databases, ", "))
+	}
+	summary.setting("found", strings.Join(databases, ", "))
+
+	// Backups are found and downloaded by the name they were taken with,
+	// and restored under the new one
+	renames, _ := config.ParseRenames(cfg.Restore.Renames) // checked when the config was loaded
+	var applied []string
+	for _, from := range slices.Sorted(maps.Keys(renames)) {
+		if !slices.Contains(databases, from) {
+			log.Printf("Warning: -rename %s=%s matches no database found below the prefix", from, renames[from])
+			continue
+		}
+		applied = append(applied, from+" -> "+renames[from])
+	}
+	if len(applied) > 0 {
+		summary.setting("renamed", strings.Join(applied, ", "))
+	}
+	createMissing := cfg.Restore.CreatesMissing(cfg.Filters)
+	summary.setting("create missing", strconv.FormatBool(createMissing))
+	summary.setting("drop existing", strconv.FormatBool(cfg.Restore.DropExisting))
+	summary.setting("transactional", strconv.FormatBool(cfg.Restore.SingleTransaction))
+	summary.setting("no owner", strconv.FormatBool(cfg.Restore.SkipsOwners()))
+	switch {
+	case cfg.Restore.Role != "":
+		summary.setting("objects owned by", cfg.Restore.Role)
+	case cfg.Restore.NoOwner:
+		summary.setting("objects owned by", cfg.Postgres.User)
+	default:
+		summary.setting("objects owned by", "original owners")
+	}
+	summary.setting("no acl", strconv.FormatBool(cfg.Restore.NoACL))
+	summary.setting("post analyze", cfg.Restore.PostAnalyze)
+	summary.setting("validation failure", cfg.Restore.ValidationFailure)
+
+	// Keep the backups of the run asked for, or those taken by the cutoff,
+	// and the globals that go with them
+	globalsEligible := func(string) bool { return true }
+	switch {
+	case cfg.Restore.RunID != "":
+		runManifest, err := findRunManifest(ctx, source.s3Client, cfg.S3, cfg.Restore.RunID)
+		if err != nil {
+			return err
+		}
+		summary.setting("backup run", runManifest.RunID)
+		backups = backupsOfRun(backups, runManifest, summary)
+		globalsEligible = func(key string) bool { return key == runManifest.Globals }
+	case cfg.Restore.AsOf != "":
+		cutoff, _ := config.ParseAsOf(cfg.Restore.AsOf) // checked when the config was loaded
+		summary.setting("as of", cutoff.Format(time.RFC3339))
+		backups = backupsTakenBy(backups, cutoff, summary)
+		globalsEligible = func(key string) bool { return !globalsTaken(key).After(cutoff) }
+	}
+
+	// Restore the backups picked, or the latest backup of each database,
+	// unless every version is asked for; those are restored oldest first,
+	// so that each database ends up as its latest backup left it
+	switch {
+	case opts.interactive:
+		if backups, err = pickBackups(ctx, cfg, os.Stdin, os.Stdout, backups, renames); err != nil {
+			return err
+		}
+		summary.setting("picked", strconv.Itoa(len(backups)))
+	case !cfg.Restore.AllVersions:
+		backups = latestPerDatabase(backups)
+	default:
+		slices.SortStableFunc(backups, func(a, b listedBackup) int { return a.taken.Compare(b.taken) })
+	}
+
+	// Work out how to unwrap each backup before touching the server,
+	// grouping the backups by the database they are restored into so that
+	// a database's versions are restored one at a time, in listed order
+	var targets []string
+	sources := make(map[string][]restoreSource)
+	for _, backup := range backups {
+		s3Key, metadata := backup.key, backup.metadata
+
+		// The encryption and compression recorded at upload win over the
+		// name's suffixes. The format is taken from the metadata only, as
+		// names do not tell a packed directory dump from a tar-format one;
+		// backups without it are recognised once fetched
+		encryption, plainKey := encryptionForKey(s3Key)
+		compression, plainKey := compressionForKey(plainKey)
+		if recorded, ok := metadata["encryption"]; ok {
+			encryption = recorded
+		}
+		if recorded, ok := metadata["compression"]; ok {
+			compression = recorded
+		}
+		if (encryption == "age" || encryption == "gpg") && len(cfg.Encryption.IdentityFiles) == 0 {
+			return fmt.Errorf("backup %s is encrypted with %s to %s; pass -identity with a file holding its key to decrypt it", s3Key, encryption, keyIDOrUnknown(metadata["key-id"]))
+		}
+		format := metadata["format"]
+		content := metadata["content"]
+		if content == "" {
+			content = contentForKey(plainKey)
+		}
+
+		target := cmp.Or(renames[backup.database], backup.database)
+		if _, ok := sources[target]; !ok {
+			targets = append(targets, target)
+		}
+		sources[target] = append(sources[target], restoreSource{
+			key:         s3Key,
+			database:    backup.database,
+			target:      target,
+			clean:       !cfg.Restore.DropExisting,
+			encryption:  encryption,
+			compression: compression,
+			format:      format,
+			content:     content,
+			metadata:    metadata,
+			size:        backup.size,
+			taken:       backup.taken,
+		})
+	}
+
+	summary.setting("backed up from", backupServers(backups))
+
+	// A dry run stops at the plan, which is incomplete when a database
+	// requested or found below the prefix has no backup left to restore
+	if opts.dryRun {
+		// The databases left unpicked are not expected
+		unplanned := missing
+		for _, dbName := range databases {
+			if !opts.interactive && !slices.ContainsFunc(backups, func(b listedBackup) bool { return b.database == dbName }) {
+				unplanned = append(unplanned, dbName)
+			}
+		}
+		var globalsKey string
+		if cfg.Restore.Globals {
+			if globalsKey, err = latestGlobals(ctx, source, globalsEligible); err != nil {
+				return err
+			}
+		}
+		run := &restoreRun{cfg: cfg, runID: runID, source: source, kmsClient: kmsClient, summary: summary}
+		if !cfg.Restore.NoCache && source.dir == "" {
+			run.cache = newDownloadCache(cfg.Restore.CacheDir, cfg.Restore.CacheSize)
+		}
+		return printRestorePlan(ctx, run, targets, sources, globalsKey, unplanned, opts.showTOC)
+	}
+
+	// Pass over the backups an unfinished restore already restored when
+	// resuming it, and start afresh otherwise. A backup restored by key is
+	// resumed apart from the prefix, and from its other versions
+	statePrefix := source.prefix
+	if opts.key != "" {
+		statePrefix = opts.key + "?versionId=" + opts.versionID
+	}
+	state, err := openRestoreState(cfg.WorkDir, source.bucket, statePrefix, runID, cfg.Restore.Resume)
+	if err != nil {
+		return err
+	}
+	if state.runID != runID {
+		summary.setting("resumed run", state.runID)
+		targets = slices.DeleteFunc(targets, func(target string) bool {
+			sources[target] = slices.DeleteFunc(sources[target], func(b restoreSource) bool {
+				if !state.restored(b) {
+					return false
+				}
+				summary.skip(target, "restored by run "+state.runID)
+				return true
+			})
+			return len(sources[target]) == 0
+		})
+	}
+
+	// Backups archived in Glacier must be retrieved before they are
+	// downloaded, which takes hours
+	if source.dir == "" {
+		if targets, err = thawBackups(ctx, cfg, source, backups, targets, sources, summary); err != nil {
+			return err
+		}
+		summary.setting("glacier", cfg.Restore.Glacier)
+	}
+
+	// Backups of a newer server or pg_dump, or of another collation, may
+	// restore with subtle breakage; they are warned about before anything
+	// is restored, or not restored at all under -strict-compat
+	warnings, err := checkCompatibility(ctx, cfg, release, targets, sources)
+	if err != nil {
+		return fmt.Errorf("failed to check the compatibility of the backups with %s: %w", target, err)
+	}
+	for _, warning := range warnings {
+		log.Printf("Warning: %s", warning)
+	}
+	summary.setting("compatibility warnings", strconv.Itoa(len(warnings)))
+	if len(warnings) > 0 && cfg.Restore.StrictCompat {
+		return fmt.Errorf("refusing to restore under -strict-compat: %s", strings.Join(warnings, "; "))
+	}
+
+	// Compare the databases backed up with those of the target, where a
+	// database without a backup would be left as it is
+	backedUp := make(map[string]string)
+	for _, dbName := range listed {
+		backedUp[cmp.Or(renames[dbName], dbName)] = dbName
+	}
+	noBackup, err := reconcileDatabases(ctx, cfg, "Databases before the restore:", backedUp, func(database, target string) string {
+		return restoreStatus(summary, database, target, slices.Contains(targets, target))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list the databases of %s: %w", target, err)
+	}
+	if len(noBackup) > 0 {
+		summary.setting("no backup", strings.Join(noBackup, ", "))
+		if cfg.Restore.Strict {
+			return fmt.Errorf("refusing to restore under -strict: database %s of %s has no backup below %s", strings.Join(noBackup, ", "), target, source)
+		}
+		log.Printf("Warning: database %s of %s has no backup below %s", strings.Join(noBackup, ", "), target, source)
+	}
+
+	// Create the roles and tablespaces the databases refer to first. psql
+	// carries on past errors in the globals, which are counted apart from
+	// the databases' own
+	if cfg.Restore.Globals {
+		globalsKey, globalsErrs, err := restoreGlobals(ctx, cfg, source, kmsClient, runID, globalsEligible)
+		switch {
+		case err != nil:
+			log.Printf("Failed to restore globals: %v", err)
+			summary.setting("globals", "failed")
+		case globalsKey == "":
+			fmt.Println("No globals backup found; skipping roles and tablespaces")
+			summary.setting("globals", "none found")
+		default:
+			summary.setting("globals", source.location(globalsKey))
+		}
+		if globalsErrs != (globalsErrors{}) {
+			summary.setting("globals errors", globalsErrs.String())
+		}
+	} else {
+		summary.setting("globals", "skipped")
+	}
+
+	// The role objects are assigned to, and the tablespaces they are moved
+	// to, may come with the globals
+	if cfg.Restore.Role != "" {
+		if err := checkRestoreRole(ctx, cfg, cfg.Restore.Role, cfg.Restore.CreateRole); err != nil {
+			return err
+		}
+	}
+	if err := checkTablespaces(ctx, cfg); err != nil {
+		return err
+	}
+
+	// Restore the databases, cfg.Restore.Concurrency at a time
+	run := &restoreRun{
+		cfg:           cfg,
+		runID:         runID,
+		source:        source,
+		kmsClient:     kmsClient,
+		createMissing: createMissing,
+		state:         state,
+		summary:       summary,
+	}
+	if !cfg.Restore.NoCache && source.dir == "" {
+		run.cache = newDownloadCache(cfg.Restore.CacheDir, cfg.Restore.CacheSize)
+	}
+	summary.setting("concurrency", strconv.Itoa(cfg.Restore.Concurrency))
+	summary.setting("download cache", cacheDescription(cfg.Restore))
+
+	// With -on-error abort the first failure cancels the rest of the run,
+	// the restores in progress included
+	if cfg.OnError == "abort" {
+		var abort context.CancelCauseFunc
+		ctx, abort = context.WithCancelCause(ctx)
+		defer abort(nil)
+		run.abort = abort
+	}
+	summary.setting("on error", cfg.OnError)
+
+	// Download upcoming backups while earlier ones are restored
+	if cfg.Restore.Prefetch > 0 {
+		var queued []restoreSource
+		for _, target := range targets {
+			queued = append(queued, sources[target]...)
+		}
+		run.prefetch = newPrefetcher(run, int64(cfg.Restore.PrefetchDisk), queued)
+		run.prefetch.start(ctx, cfg.Restore.Prefetch)
+		defer run.prefetch.stop()
+		summary.setting("prefetch", fmt.Sprintf("%d at a time, disk budget %s", cfg.Restore.Prefetch, prefetchBudget(cfg.Restore.PrefetchDisk)))
+	}
+	queue := make(chan string, cfg.Restore.Concurrency)
+	var wg sync.WaitGroup
+	for range cfg.Restore.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range queue {
+				run.restoreTarget(ctx, target, sources[target])
+			}
+		}()
+	}
+queue:
+	for i, target := range targets {
+		select {
+		case queue <- target:
+		case <-ctx.Done():
+			for _, target := range targets[i:] {
+				run.abandon(target)
+			}
+			break queue
+		}
+	}
+	close(queue)
+	wg.Wait()
+	if _, err := reconcileDatabases(context.WithoutCancel(ctx), cfg, "Databases after the restore:", backedUp, func(database, target string) string {
+		return restoreStatus(summary, database, target, false)
+	}); err != nil {
+		log.Printf("Warning: failed to list the databases of %s after the restore: %v", target, err)
+	}
+
+	summary.setting("restored", strings.Join(summary.succeeded, ", "))
+	if cfg.Restore.DropExisting {
+		summary.setting("sessions terminated", strconv.Itoa(run.terminated))
+	}
+	if cfg.Restore.CreateMissingRoles {
+		summary.setting("roles created", strings.Join(run.createdRoles, ", "))
+		if len(run.failedRoles) > 0 {
+			summary.setting("roles not created", strings.Join(run.failedRoles, ", "))
+		}
+	}
+	if cfg.Restore.CreateExtensions {
+		summary.setting("extensions created", strings.Join(run.createdExtensions, ", "))
+	}
+	summary.print(os.Stdout)
+
+	// A restore with nothing left to do cannot be resumed
+	if len(run.errs) == 0 && len(summary.notAttempted) == 0 {
+		state.finish()
+	}
+	if cause := context.Cause(ctx); errors.Is(cause, errRunAborted) {
+		run.errs = append(run.errs, fmt.Errorf("%w, %d databases not attempted", cause, len(summary.notAttempted)))
+	}
+	return errors.Join(run.errs...)
+}
+
+// restoreRun holds the state shared by the workers of a restore run.
+type restoreRun struct {
+	cfg           *config.Config
+	runID         string
+	source        *backupSource
+	kmsClient     *kms.Client
+	createMissing bool
+	prefetch      *prefetcher    // nil when each backup is downloaded as its restore starts
+	cache         *downloadCache // nil without a download cache
+	state         *restoreState
+
+	// abort cancels the run at the first failure under -on-error abort,
+	// and is nil otherwise
+	abort context.CancelCauseFunc
+
+	// rolesMu keeps workers from creating the same role at once
+	rolesMu sync.Mutex
+
+	// mu guards the fields below
+	mu           sync.Mutex
+	summary      *runSummary
+	terminated   int      // sessions terminated to drop target databases
+	createdRoles []string // roles created for the backups to refer to
+	failedRoles  []string // roles that could not be created
+	errs         []error
+
+	createdExtensions []string // extensions created, as "NAME in DATABASE"
+}
+
+// createRoles creates the roles the backup b, unwrapped at path, refers to
+// that the server lacks.
+func (r *restoreRun) createRoles(ctx context.Context, dbLog *databaseLog, b restoreSource, path string, noOwner bool) error {
+	roles, err := referencedRoles(ctx, r.cfg, b.format, path, noOwner, r.cfg.Restore.NoACL)
+	if err != nil {
+		return fmt.Errorf("failed to find the roles backup file %s refers to: %w", b.key, err)
+	}
+	r.rolesMu.Lock()
+	created, failed, err := createMissingRoles(ctx, r.cfg, dbLog, roles)
+	r.rolesMu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.createdRoles = append(r.createdRoles, created...)
+	for _, role := range failed {
+		if !slices.Contains(r.failedRoles, role) {
+			r.failedRoles = append(r.failedRoles, role)
+		}
+	}
+	return err
+}
+
+// checkExtensions checks that the server provides the extensions the
+// backup b, unwrapped at path, creates, and under -create-extensions
+// creates those its target lacks.
+func (r *restoreRun) checkExtensions(ctx context.Context, dbLog *databaseLog, b restoreSource, path string) error {
+	listPath := workPath(r.cfg.WorkDir, r.runID, filepath.Base(b.key)+".extensions.list")
+	extensions, err := referencedExtensions(ctx, r.cfg, b.format, path, listPath)
+	if err != nil {
+		return fmt.Errorf("failed to find the extensions backup file %s needs: %w", b.key, err)
+	}
+	if len(extensions) == 0 {
+		return nil
+	}
+	created, err := checkExtensions(ctx, r.cfg, dbLog, b.target, extensions, r.cfg.Restore.CreateExtensions)
+	if err != nil {
+		return fmt.Errorf("cannot restore %s: %w", b.key, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range created {
+		r.createdExtensions = append(r.createdExtensions, name+" in "+b.target)
+	}
+	return nil
+}
+
+// restoreTarget restores the backups of a single target database in turn.
+func (r *restoreRun) restoreTarget(ctx context.Context, target string, sources []restoreSource) {
+	dbLog := newDatabaseLog(target, r.prefixed())
+	for _, b := range sources {
+		if ctx.Err() != nil {
+			r.abandon(target)
+			return
+		}
+		r.restore(ctx, dbLog, b)
+	}
+}
+
+// prefixed reports whether the output of each database is prefixed with
+// its name, as it is when several are restored or downloaded at once.
+func (r *restoreRun) prefixed() bool {
+	return r.cfg.Restore.Concurrency > 1 || r.prefetch != nil
+}
+
+// abandon records that target was not restored as the run was cut short.
+func (r *restoreRun) abandon(target string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.summary.abandon(target)
+}
+
+// restore restores a single backup into its target database, dropping or
+// creating the database first as configured, and records the outcome.
+func (r *restoreRun) restore(ctx context.Context, dbLog *databaseLog, b restoreSource) {
+	cfg, metadata := r.cfg, b.metadata
+	if r.prefetch != nil {
+		// Frees the download's share of the disk budget however the
+		// restore ends, including when it is skipped before the download
+		// is used
+		defer r.prefetch.release(b)
+	}
+	dbLog.out.Printf("Processing backup file: %s\n", b.key)
+	if b.target != b.database {
+		dbLog.out.Printf("Restoring database %s as %s\n", b.database, b.target)
+	}
+	if host := metadata["source-host"]; host != "" {
+		dbLog.out.Printf("Backup of database %s taken from %s:%s (PostgreSQL %s, pg_dump %s) at %s\n", b.database, host, metadata["source-port"], metadata["server-version"], metadata["pg-dump-version"], metadata["started"])
+	}
+	if b.content == "schema-only" && !cfg.Restore.AllowSchemaOnly {
+		dbLog.err.Printf("Refusing to restore database %s from schema-only backup %s; pass -allow-schema-only to restore it anyway", b.target, b.key)
+		r.mu.Lock()
+		r.summary.skipped = append(r.summary.skipped, skippedDatabase{b.target, "schema-only backup"})
+		r.mu.Unlock()
+		return
+	}
+	if metadata["partial"] == "true" {
+		dbLog.err.Printf("Warning: %s is a partial backup; see the run manifest for the tables it leaves out", b.key)
+	}
+	if b.content == "data-only" {
+		dbLog.err.Printf("Warning: %s is a data-only backup; it will not create tables in database %s", b.key, b.target)
+	}
+
+	// Fetch the backup before touching the target, so that a backup that
+	// cannot be read or restored leaves it as it is
+	backupFilePath, err := r.fetchBackup(ctx, dbLog, b)
+	if err != nil {
+		dbLog.err.Printf("Failed to restore database %s: %v", b.target, err)
+		r.fail(b.target, err, r.summary.fail)
+		return
+	}
+	defer os.Remove(backupFilePath)
+
+	// Backups uploaded without format metadata are recognised by their
+	// contents; anything else is left alone rather than fed to pg_restore
+	if b.format == "" {
+		b.format = detectFormat(backupFilePath)
+		if b.format != "" {
+			dbLog.out.Printf("Detected %s format of %s from its contents\n", b.format, b.key)
+		}
+	}
+	if _, ok := dumpFormats[b.format]; !ok {
+		dbLog.err.Printf("Skipping %s: it is neither a pg_dump archive nor an SQL script, so its format is unknown", b.key)
+		r.mu.Lock()
+		r.summary.skipped = append(r.summary.skipped, skippedDatabase{b.target, "unknown format of " + b.key})
+		r.mu.Unlock()
+		return
+	}
+
+	// A dropped target is recreated empty, so the restore need not clean it
+	if cfg.Restore.DropExisting {
+		terminated, err := dropDatabase(ctx, cfg, dbLog, b.target)
+		r.mu.Lock()
+		r.terminated += terminated
+		r.mu.Unlock()
+		if err != nil {
+			dbLog.err.Printf("Failed to drop database %s: %v", b.target, err)
+			r.fail(b.target, err, r.summary.fail)
+			return
+		}
+	}
+
+	// pg_restore -d and psql -d need the target to exist
+	if r.createMissing || cfg.Restore.DropExisting {
+		created, err := createMissingDatabase(ctx, cfg, dbLog, b.target)
+		if err != nil {
+			dbLog.err.Printf("Failed to create database %s: %v", b.target, err)
+			r.fail(b.target, err, r.summary.failCreate)
+			return
+		}
+		if created {
+			r.mu.Lock()
+			r.summary.create(b.target)
+			r.mu.Unlock()
+		}
+	}
+
+	if err := r.restoreBackup(ctx, dbLog, b, backupFilePath); err != nil {
+		dbLog.err.Printf("Failed to restore database %s: %v", b.target, err)
+		r.fail(b.target, err, r.summary.fail)
+		return
+	}
+	if err := r.state.mark(b); err != nil {
+		dbLog.err.Printf("Warning: failed to record the restore of %s for -resume: %v", b.key, err)
+	}
+	r.mu.Lock()
+	r.summary.succeed(b.target)
+	r.mu.Unlock()
+
+	// Checking the restored data is reported apart from the restore, and
+	// only fails the run under -validation-failure error
+	if settings, _ := cfg.ForDatabase(b.database); len(settings.Validations) > 0 {
+		results := validateDatabase(ctx, cfg, dbLog, b.target, settings.Validations)
+		r.mu.Lock()
+		r.summary.validations = append(r.summary.validations, results...)
+		if cfg.Restore.ValidationFailure == "error" {
+			r.errs = append(r.errs, validationErrors(results)...)
+		}
+		r.mu.Unlock()
+	}
+
+	// Statistics are a convenience: failing to gather them leaves the
+	// restore a success
+	if cfg.Restore.PostAnalyze != "off" {
+		err := analyzeDatabase(ctx, cfg, dbLog, b.target)
+		if err != nil {
+			dbLog.err.Printf("Warning: %v", err)
+		}
+		r.mu.Lock()
+		r.summary.analyzed(b.target, err)
+		r.mu.Unlock()
+	}
+}
+
+// describeServer names the server pg connects to, and as whom, for logs.
+func describeServer(pg config.Postgres) string {
+	return fmt.Sprintf("%s:%d as %s", pg.Host, pg.Port, pg.User)
+}
+
+// backupServers names the servers the backups were taken from, as their
+// metadata records them.
+func backupServers(backups []listedBackup) string {
+	var servers []string
+	for _, b := range backups {
+		host := b.metadata["source-host"]
+		if host == "" {
+			continue
+		}
+		if server := host + ":" + b.metadata["source-port"]; !slices.Contains(servers, server) {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		return "not recorded"
+	}
+	slices.Sort(servers)
+	return strings.Join(servers, ", ")
+}
+
+// fail records the failure of target with record and err for the exit
+// status, aborting the run under -on-error abort.
+func (r *restoreRun) fail(target string, err error, record func(string)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	record(target)
+	r.errs = append(r.errs, fmt.Errorf("database %s: %w", target, err))
+	if r.abort != nil {
+		r.abort(fmt.Errorf("%w after database %s failed", errRunAborted, target))
+	}
+}
+
+// listedBackup is a backup found below the prefix, with its metadata, the
+// database it holds, when it was taken and the size of its object.
+type listedBackup struct {
+	key, database string
+	metadata      map[string]string
+	taken         time.Time
+	size          int64
+	storageClass  types.ObjectStorageClass
+}
+
+// backupTaken returns when the backup stored as object was taken: the start
+// of its dump as recorded at upload, or, for older backups, when the object
+// was written. rekey rewrites objects, so their LastModified can be much
+// later than the dump.
+func backupTaken(metadata map[string]string, object types.Object) time.Time {
+	if started, err := time.Parse(time.RFC3339, metadata["started"]); err == nil {
+		return started
+	}
+	return aws.ToTime(object.LastModified)
+}
+
+// backupsTakenBy keeps the backups taken at or before cutoff, recording the
+// databases left with none as skipped.
+func backupsTakenBy(backups []listedBackup, cutoff time.Time, summary *runSummary) []listedBackup {
+	var kept []listedBackup
+	var late []string
+	for _, b := range backups {
+		if b.taken.After(cutoff) {
+			if !slices.Contains(late, b.database) {
+				late = append(late, b.database)
+			}
+			continue
+		}
+		kept = append(kept, b)
+	}
+	for _, dbName := range late {
+		if !slices.ContainsFunc(kept, func(b listedBackup) bool { return b.database == dbName }) {
+			summary.skip(dbName, "no backup taken by "+cutoff.Format(time.RFC3339))
+		}
+	}
+	return kept
+}
+
+// backupsOfRun keeps the backups m lists, which for a deduplicated backup
+// is one an earlier run took, recording the databases left with none as
+// skipped. Backups m lists of the databases found that are no longer below
+// the prefix are warned of.
+func backupsOfRun(backups []listedBackup, m *manifest, summary *runSummary) []listedBackup {
+	inRun := make(map[string]bool)
+	for _, entry := range m.Backups {
+		inRun[entry.Key] = true
+	}
+	var kept []listedBackup
+	var others []string
+	listed := make(map[string]bool)
+	for _, b := range backups {
+		listed[b.database] = true
+		if !inRun[b.key] {
+			if !slices.Contains(others, b.database) {
+				others = append(others, b.database)
+			}
+			continue
+		}
+		kept = append(kept, b)
+		delete(inRun, b.key)
+	}
+	for _, dbName := range others {
+		if !slices.ContainsFunc(kept, func(b listedBackup) bool { return b.database == dbName }) {
+			summary.skip(dbName, "not backed up by run "+m.RunID)
+		}
+	}
+	for _, entry := range m.Backups {
+		if inRun[entry.Key] && listed[entry.Database] {
+			log.Printf("Warning: backup %s of database %s, listed by run %s, is no longer below the prefix", entry.Key, entry.Database, m.RunID)
+		}
+	}
+	return kept
+}
+
+// latestPerDatabase keeps the latest of the backups of each database, in
+// the order they are listed, logging the versions it leaves out.
+func latestPerDatabase(backups []listedBackup) []listedBackup {
+	latest := make(map[string]listedBackup)
+	versions := make(map[string]int)
+	for _, b := range backups {
+		if current, ok := latest[b.database]; !ok || b.taken.After(current.taken) {
+			latest[b.database] = b
+		}
+		versions[b.database]++
+	}
+	return slices.DeleteFunc(backups, func(b listedBackup) bool {
+		if latest[b.database].key != b.key {
+			return true
+		}
+		if n := versions[b.database]; n > 1 {
+			fmt.Printf("Database %s has %d backups; restoring the latest, %s, taken %s (-all-versions restores them all)\n", b.database, n, b.key, b.taken.Format(time.RFC3339))
+		}
+		return false
+	})
+}
+
+// restoreSource is a backup to restore, with what its metadata and name
+// tell about it and the database it is restored into, and whether the
+// objects the backup holds are dropped from that database first.
+type restoreSource struct {
+	key, database, target, encryption, compression, format, content string
+	metadata                                                        map[string]string
+	clean                                                           bool
+	size                                                            int64 // of the object
+	taken                                                           time.Time
+}
+
+// downloadBackup gets the backup file of b into the work directory, from an
+// intact local copy or from S3, reassembling a split backup and checking the
+// download against the digest recorded at upload, and returns its path. The
+// file is removed if that fails.
+func (r *restoreRun) downloadBackup(ctx context.Context, dbLog *databaseLog, b restoreSource) (string, error) {
+	cfg, source := r.cfg, r.source
+	if source.dir != "" && b.metadata["parts"] != "" {
+		return "", fmt.Errorf("backup file %s is split into parts, which are only reassembled from S3", b.key)
+	}
+
+	// Download the backup file from S3, or copy it from the directory
+	// restored from, unless an intact local copy is at hand. The whole key
+	// names the file, as downloads of several backups of the same name may
+	// be held at once
+	backupFilePath := workPath(cfg.WorkDir, r.runID, b.key)
+	local := restoreLocalCopy(cfg.Local.Dir, b, backupFilePath)
+	if !local {
+		// A split backup's index is not worth caching, and its parts are
+		// reassembled over it
+		cache := r.cache
+		if b.metadata["parts"] != "" {
+			cache = nil
+		}
+		if err := source.fetch(ctx, b.key, backupFilePath, cache); err != nil {
+			os.Remove(backupFilePath)
+			return "", fmt.Errorf("failed to download backup file %s: %w", b.key, err)
+		}
+	}
+
+	// A split backup's key holds the index of its parts, which are
+	// reassembled in its place; a local copy is already whole
+	if !local && b.metadata["parts"] != "" {
+		if err := assembleParts(ctx, source.s3Client, cfg.S3, b.key, backupFilePath); err != nil {
+			os.Remove(backupFilePath)
+			return "", fmt.Errorf("failed to reassemble backup file %s: %w", b.key, err)
+		}
+	}
+
+	// Check the download against the digest recorded at upload before
+	// spending time decrypting it; a local copy was checked when it was
+	// chosen and a split backup's parts when they were reassembled
+	recorded := b.metadata["sha256"]
+	if !local && b.metadata["parts"] == "" && recorded == "" {
+		if cfg.Restore.RequireChecksum {
+			os.Remove(backupFilePath)
+			return "", fmt.Errorf("backup file %s records no SHA-256 to check the download against (-require-checksum)", b.key)
+		}
+		dbLog.err.Printf("Warning: backup file %s records no SHA-256, restoring it unchecked", b.key)
+	}
+	if !local && b.metadata["parts"] == "" && recorded != "" {
+		sum, err := fileSHA256(backupFilePath)
+		if err != nil {
+			os.Remove(backupFilePath)
+			return "", fmt.Errorf("failed to read backup file %s: %w", b.key, err)
+		}
+		if sum != recorded {
+			os.Remove(backupFilePath)
+			r.cache.forget(cfg.S3.Bucket, b.key)
+			return "", fmt.Errorf("downloaded backup file %s has SHA-256 %s, its metadata records %s", b.key, sum, recorded)
+		}
+		dbLog.out.Printf("Verified SHA-256 of %s: %s\n", b.key, sum)
+	}
+	return backupFilePath, nil
+}
+
+// fetchBackup downloads a single backup, or takes its prefetched download,
+// and unwraps it into the work directory, returning the path of the dump.
+// The caller removes it once the backup is restored or fails, before the
+// worker moves on to its next backup; the files left along the way are
+// removed here.
+func (r *restoreRun) fetchBackup(ctx context.Context, dbLog *databaseLog, b restoreSource) (string, error) {
+	cfg := r.cfg
+	var backupFilePath string
+	var err error
+	if r.prefetch != nil {
+		backupFilePath, err = r.prefetch.take(b)
+	} else {
+		backupFilePath, err = r.downloadBackup(ctx, dbLog, b)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Unwrap a KMS-encrypted backup's data key, which KMS only releases
+	// for the key and encryption context it was generated with
+	var dataKey []byte
+	if b.encryption == "kms" {
+		encryptionContext := kmsEncryptionContext(b.database, b.key)
+		dataKey, err = decryptDataKey(ctx, r.kmsClient, b.metadata, cfg.Encryption.KMSKeyID, encryptionContext)
+		if err != nil {
+			os.Remove(backupFilePath)
+			return "", fmt.Errorf("failed to decrypt backup file %s, which needs KMS key %s: %w", b.key, keyIDOrUnknown(b.metadata["key-id"]), err)
+		}
+		dbLog.out.Printf("Verified data key of %s: KMS key %s, encryption context %v\n", b.key, b.metadata["key-id"], encryptionContext)
+	}
+
+	// Decrypt and decompress the backup in one pass so pg_restore can read
+	// it, without writing out the decrypted but still compressed dump
+	if b.encryption != "none" || b.compression != "none" {
+		plainPath := strings.TrimSuffix(backupFilePath, encryptionSuffixes[b.encryption])
+		plainPath = strings.TrimSuffix(plainPath, compressionSuffixes[b.compression])
+		if plainPath == backupFilePath {
+			plainPath += ".unwrapped"
+		}
+		err := unwrapFile(backupFilePath, plainPath, b.encryption, b.compression, cfg.Encryption.IdentityFiles, dataKey, b.metadata["key-id"])
+		os.Remove(backupFilePath)
+		if err != nil {
+			os.Remove(plainPath)
+			return "", fmt.Errorf("failed to unwrap backup file %s: %w", b.key, err)
+		}
+		backupFilePath = plainPath
+	}
+	return backupFilePath, nil
+}
+
+// restoreBackup restores a single backup from the dump fetched to
+// backupFilePath, in the format b records.
+func (r *restoreRun) restoreBackup(ctx context.Context, dbLog *databaseLog, b restoreSource, backupFilePath string) error {
+	cfg := r.cfg
+
+	// Directory-format backups are unpacked and restored in parallel
+	var restoreArgs []string
+	if b.format == "directory" {
+		dumpDir, err := unpackDirectory(cfg.WorkDir, backupFilePath)
+		os.Remove(backupFilePath)
+		if err != nil {
+			return fmt.Errorf("failed to unpack backup file %s: %w", b.key, err)
+		}
+		defer os.RemoveAll(dumpDir)
+		backupFilePath = dumpDir
+
+		restoreArgs = []string{"-F", "d"}
+	}
+
+	// pg_restore cannot move objects to other tablespaces, so archives are
+	// then restored through their script, rewritten on the way to psql
+	noOwner := cfg.Restore.SkipsOwners()
+	tablespaces, _ := config.ParseTablespaceRemaps(cfg.Restore.RemapTablespaces) // checked when the config was loaded
+	filter := scriptFilter{noOwner: noOwner, noACL: cfg.Restore.NoACL, noTablespaces: cfg.Restore.NoTablespaces, tablespaces: tablespaces}
+	viaScript := b.format != "plain" && len(tablespaces) > 0
+
+	// pg_restore runs in parallel from custom and directory-format archives
+	// only, and outside of a single transaction; the database's own
+	// settings are those it was backed up with
+	settings, _ := cfg.ForDatabase(b.database)
+	jobs := settings.RestoreJobs
+	if jobs == 0 && b.format == "directory" && !cfg.Restore.SingleTransaction {
+		jobs = settings.Jobs
+	}
+	switch {
+	case jobs <= 1:
+	case viaScript:
+		dbLog.err.Printf("Warning: remapping tablespaces restores %s through psql, with a single worker instead of %d", b.key, jobs)
+	case b.format == "custom" || b.format == "directory":
+		restoreArgs = append(restoreArgs, "-j", strconv.Itoa(jobs))
+	default:
+		dbLog.err.Printf("Warning: %s is a %s-format backup, which pg_restore cannot restore in parallel; restoring it with a single worker instead of %d", b.key, b.format, jobs)
+	}
+
+	// Plain SQL scripts are applied with psql, archives with pg_restore.
+	// --if-exists keeps pg_restore's clean step from failing on objects,
+	// such as large objects, that the target database does not have yet.
+	var total int // the entries pg_restore is to restore, once known
+	restore := func(ctx context.Context, cfg *config.Config, dbLog *databaseLog, dbName, backupFilePath string, restoreArgs []string) error {
+		return restoreDatabase(ctx, cfg, dbLog, dbName, backupFilePath, restoreArgs, total)
+	}
+	switch {
+	case b.format == "plain":
+		restore = restorePlainDatabase
+	case viaScript:
+		restore = func(ctx context.Context, cfg *config.Config, dbLog *databaseLog, dbName, backupFilePath string, restoreArgs []string) error {
+			return restoreArchiveScript(ctx, cfg, dbLog, dbName, backupFilePath, restoreArgs, scriptFilter{tablespaces: tablespaces})
+		}
+	}
+	if b.format != "plain" && b.clean && !cfg.Restore.DataOnly {
+		restoreArgs = append(restoreArgs, "-c", "--if-exists")
+	}
+	if cfg.Restore.DataOnly {
+		if b.format == "plain" {
+			return fmt.Errorf("plain backup %s cannot be restored data-only", b.key)
+		}
+		restoreArgs = append(restoreArgs, "--data-only")
+	}
+
+	// Restore only the tables and schemas asked for, through a list of
+	// the archive's entries
+	if len(cfg.Restore.Tables) > 0 || len(cfg.Restore.Schemas) > 0 {
+		if b.format == "plain" {
+			return fmt.Errorf("plain backup %s cannot be restored table by table", b.key)
+		}
+		entries, err := readTOC(ctx, cfg, b.format, backupFilePath)
+		if err != nil {
+			return err
+		}
+		selected, err := selectTOC(entries, cfg.Restore.Tables, cfg.Restore.Schemas, cfg.Restore.DataOnly)
+		if err != nil {
+			return fmt.Errorf("cannot restore from %s: %w", b.key, err)
+		}
+		total = restoreItems(selected, cfg.Restore.DataOnly, cfg.Restore.NoACL)
+		listPath := workPath(cfg.WorkDir, r.runID, filepath.Base(b.key)+".list")
+		if err := writeTOCList(listPath, selected); err != nil {
+			return fmt.Errorf("failed to write the restore list of %s: %w", b.key, err)
+		}
+		defer os.Remove(listPath)
+		restoreArgs = append(restoreArgs, "-L", listPath)
+		dbLog.out.Printf("Restoring %d of the %d entries of %s\n", len(selected), len(entries), b.key)
+	} else if b.format != "plain" && !viaScript && cfg.ProgressInterval > 0 {
+		// The progress of the restore is reported against the archive's
+		// entries; without them it goes unreported
+		entries, err := readTOC(ctx, cfg, b.format, backupFilePath)
+		if err != nil {
+			dbLog.err.Printf("Warning: failed to count the entries of %s, so its restore will not report its progress: %v", b.key, err)
+		}
+		total = restoreItems(entries, cfg.Restore.DataOnly, cfg.Restore.NoACL)
+	}
+	if cfg.Restore.SingleTransaction {
+		if b.format == "plain" {
+			restoreArgs = append(restoreArgs, "-1")
+		} else {
+			restoreArgs = append(restoreArgs, "--single-transaction")
+		}
+	}
+	if b.format != "plain" {
+		if noOwner {
+			restoreArgs = append(restoreArgs, "--no-owner")
+		}
+		if cfg.Restore.NoACL {
+			restoreArgs = append(restoreArgs, "--no-acl")
+		}
+		if cfg.Restore.Role != "" {
+			restoreArgs = append(restoreArgs, "--role", cfg.Restore.Role)
+		}
+		if cfg.Restore.NoTablespaces {
+			restoreArgs = append(restoreArgs, "--no-tablespaces")
+		}
+	} else if filter.active() {
+		// psql has no such options, so the script is rewritten instead
+		filteredPath := backupFilePath + ".filtered"
+		removed, rewritten, err := filter.filterFile(backupFilePath, filteredPath)
+		os.Remove(backupFilePath)
+		if err != nil {
+			os.Remove(filteredPath)
+			return fmt.Errorf("failed to filter backup file %s: %w", b.key, err)
+		}
+		backupFilePath = filteredPath
+		defer os.Remove(backupFilePath)
+		dbLog.out.Printf("Left %d ownership, privilege and tablespace statements out of %s and moved %d to other tablespaces\n", removed, b.key, rewritten)
+	}
+	// Extensions the server cannot install fail the restore before it
+	// starts rather than statement by statement; data-only restores and
+	// those of selected tables or schemas create none
+	if !cfg.Restore.DataOnly && len(cfg.Restore.Tables) == 0 && len(cfg.Restore.Schemas) == 0 {
+		if err := r.checkExtensions(ctx, dbLog, b, backupFilePath); err != nil {
+			return err
+		}
+	}
+	if cfg.Restore.CreateMissingRoles {
+		if err := r.createRoles(ctx, dbLog, b, backupFilePath, noOwner); err != nil {
+			return err
+		}
+	}
+	if b.format == "plain" && cfg.Restore.Role != "" {
+		// psql runs -c and -f in order in a single session
+		restoreArgs = append(restoreArgs, "-c", "SET ROLE "+pq.QuoteIdentifier(cfg.Restore.Role))
+	}
+	if b.content == "data-only" && cfg.Restore.DisableTriggers {
+		if b.format == "plain" {
+			dbLog.err.Printf("Warning: -disable-triggers has no effect on plain backup %s", b.key)
+		} else {
+			restoreArgs = append(restoreArgs, "--disable-triggers")
+		}
+	}
+	return restore(ctx, cfg, dbLog, b.target, backupFilePath, restoreArgs)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// restoreStateDir is the directory of the work directory holding the
+// progress of unfinished restore runs. It lacks workFilePrefix so that
+// cleaning up orphans leaves it alone.
+const restoreStateDir = ".pgbackup-restore-state"
+
+// restoreState records the backups a restore run has restored, a marker
+// file each, so that a run cut short can be resumed where it stopped. The
+// markers are kept in a directory named after the run that started the
+// restore, which a resumed run goes on writing to, until a run finishes
+// without failures.
+type restoreState struct {
+	dir   string
+	runID string          // the run that started the restore
+	done  map[string]bool // the markers written before this run
+}
+
+// restoreStateRun identifies the backups a restore state belongs to.
+type restoreStateRun struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix"`
+}
+
+// restoreMarker records that the backup Key was restored into Target.
+type restoreMarker struct {
+	Target   string    `json:"target"`
+	Key      string    `json:"key"`
+	Restored time.Time `json:"restored"`
+}
+
+// openRestoreState returns the state of the latest unfinished restore of
+// the backups below s3Prefix when resume is set and there is one, and
+// otherwise discards the states of earlier restores of them and starts
+// afresh for the run runID.
+func openRestoreState(workDir, s3Bucket, s3Prefix, runID string, resume bool) (*restoreState, error) {
+	root := filepath.Join(workDir, restoreStateDir)
+	entries, err := os.ReadDir(root)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read restore state %s: %w", root, err)
+	}
+	// Run IDs sort chronologically, as do the entries
+	var unfinished []string
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(root, entry.Name(), "run.json"))
+		if err != nil {
+			continue
+		}
+		var run restoreStateRun
+		if json.Unmarshal(data, &run) == nil && run == (restoreStateRun{s3Bucket, s3Prefix}) {
+			unfinished = append(unfinished, entry.Name())
+		}
+	}
+
+	if resume && len(unfinished) > 0 {
+		state := &restoreState{dir: filepath.Join(root, unfinished[len(unfinished)-1]), done: make(map[string]bool)}
+		state.runID = filepath.Base(state.dir)
+		markers, err := os.ReadDir(state.dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read restore state %s: %w", state.dir, err)
+		}
+		for _, marker := range markers {
+			if name := marker.Name(); name != "run.json" && strings.HasSuffix(name, ".json") {
+				state.done[name] = true
+			}
+		}
+		fmt.Printf("Resuming restore run %s: %d backups already restored\n", state.runID, len(state.done))
+		return state, nil
+	}
+	if resume {
+		fmt.Println("No unfinished restore to resume; starting afresh")
+	}
+
+	for _, id := range unfinished {
+		if err := os.RemoveAll(filepath.Join(root, id)); err != nil {
+			log.Printf("Warning: failed to discard the state of unfinished restore run %s: %v", id, err)
+			continue
+		}
+		fmt.Printf("Discarded the state of unfinished restore run %s\n", id)
+	}
+	state := &restoreState{dir: filepath.Join(root, runID), runID: runID}
+	if err := os.MkdirAll(state.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create restore state %s: %w", state.dir, err)
+	}
+	data, err := json.Marshal(restoreStateRun{s3Bucket, s3Prefix})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(state.dir, "run.json"), data, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write restore state %s: %w", state.dir, err)
+	}
+	return state, nil
+}
+
+// restored reports whether b was restored into its target before this run.
+func (s *restoreState) restored(b restoreSource) bool {
+	return s.done[markerName(b)]
+}
+
+// mark records that b was restored into its target. It is only called once
+// the restore succeeded, and the marker appears whole or not at all.
+func (s *restoreState) mark(b restoreSource) error {
+	data, err := json.Marshal(restoreMarker{Target: b.target, Key: b.key, Restored: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, markerName(b))
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// finish discards the state of a restore that has nothing left to do.
+func (s *restoreState) finish() {
+	if err := os.RemoveAll(s.dir); err != nil {
+		log.Printf("Warning: failed to remove restore state %s: %v", s.dir, err)
+	}
+}
+
+// markerName returns the name of the marker of the restore of b into its
+// target.
+func markerName(b restoreSource) string {
+	sum := sha256.Sum256([]byte(b.target + "\x00" + b.key))
+	return hex.EncodeToString(sum[:]) + ".json"
+}
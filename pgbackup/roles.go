@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"dbbackup/internal/config"
+	"dbbackup/internal/postgres"
+
+	"github.com/lib/pq"
+)
+
+var (
+	// roleIdentifier matches a role name as pg_dump writes it: bare when it
+	// needs no quoting, in double quotes otherwise.
+	roleIdentifier = `("(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*)`
+
+	// ownerRole, grantRoles, revokeRoles and defaultPrivilegesRole find the
+	// roles the statements of a dump script refer to. Default privileges
+	// end in a GRANT or REVOKE of their own.
+	ownerRole             = regexp.MustCompile(`^ALTER [A-Z ]+ .* OWNER TO ` + roleIdentifier + `;$`)
+	grantRoles            = regexp.MustCompile(`^(ALTER DEFAULT PRIVILEGES .* )?GRANT .* TO (.+?)( WITH (GRANT|ADMIN) OPTION)?( GRANTED BY .*)?;$`)
+	revokeRoles           = regexp.MustCompile(`^(ALTER DEFAULT PRIVILEGES .* )?REVOKE .* FROM (.+?)( GRANTED BY .*)?;$`)
+	defaultPrivilegesRole = regexp.MustCompile(`^ALTER DEFAULT PRIVILEGES FOR ROLE ` + roleIdentifier + ` `)
+	roleList              = regexp.MustCompile(roleIdentifier + `(, |$)`)
+)
+
+// referencedRoles returns the roles the backup at path, in format, makes
+// owners of objects or grants privileges to, in the order they first
+// appear. Archives are read through the script pg_restore would run for
+// their schema, without connecting; the statements that noOwner and noACL
+// leave out are not read.
+func referencedRoles(ctx context.Context, cfg *config.Config, format, path string, noOwner, noACL bool) ([]string, error) {
+	if format == "plain" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return scanRoles(file)
+	}
+
+	args := []string{"--schema-only", "-f", "-"}
+	if format == "directory" {
+		args = append(args, "-F", "d")
+	}
+	if noOwner {
+		args = append(args, "--no-owner")
+	}
+	if noACL {
+		args = append(args, "--no-acl")
+	}
+	cmd, cleanup, err := postgres.Command(ctx, cfg.Postgres, cfg.Timeouts, "pg_restore", append(args, path)...)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to list the roles of %s: %w", path, err)
+	}
+	roles, scanErr := scanRoles(stdout)
+	io.Copy(io.Discard, stdout) // let pg_restore finish writing
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("failed to list the roles of %s: %w", path, err)
+	}
+	return roles, scanErr
+}
+
+// scanRoles returns the roles referred to by the ownership and privilege
+// statements of the SQL script r, skipping the rows of COPY blocks.
+func scanRoles(r io.Reader) ([]string, error) {
+	var roles []string
+	add := func(quoted string) {
+		role := quoted
+		if strings.HasPrefix(quoted, `"`) {
+			role = strings.ReplaceAll(quoted[1:len(quoted)-1], `""`, `"`)
+		}
+		if role != "PUBLIC" && !slices.Contains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	addList := func(list string) {
+		for _, match := range roleList.FindAllStringSubmatch(list, -1) {
+			add(match[1])
+		}
+	}
+
+	br := bufio.NewReader(r)
+	copying := false
+	for {
+		line, err := br.ReadBytes('\n')
+		if copying {
+			copying = !bytes.Equal(line, []byte("\\.\n"))
+		} else if bytes.HasPrefix(line, []byte("COPY ")) && bytes.HasSuffix(line, []byte("FROM stdin;\n")) {
+			copying = true
+		} else {
+			statement := strings.TrimSuffix(string(line), "\n")
+			if m := ownerRole.FindStringSubmatch(statement); m != nil {
+				add(m[1])
+			}
+			if m := defaultPrivilegesRole.FindStringSubmatch(statement); m != nil {
+				add(m[1])
+			}
+			if m := grantRoles.FindStringSubmatch(statement); m != nil {
+				addList(m[2])
+			} else if m := revokeRoles.FindStringSubmatch(statement); m != nil {
+				addList(m[2])
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return roles, nil
+		}
+		if err != nil {
+			return roles, err
+		}
+	}
+}
+
+// createMissingRoles creates, without login, the roles the server lacks,
+// returning those it created and those it failed to create.
+func createMissingRoles(ctx context.Context, cfg *config.Config, dbLog *databaseLog, roles []string) (created, failed []string, err error) {
+	db, err := postgres.Open(cfg.Postgres, cfg.Timeouts, cfg.Postgres.Database)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer db.Close()
+
+	for _, role := range roles {
+		var exists bool
+		if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)", role).Scan(&exists); err != nil {
+			return created, failed, fmt.Errorf("failed to look up role %s: %w", role, err)
+		}
+		if exists {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, "CREATE ROLE "+pq.QuoteIdentifier(role)+" NOLOGIN"); err != nil {
+			dbLog.err.Printf("Warning: failed to create role %s: %v", role, err)
+			failed = append(failed, role)
+			continue
+		}
+		dbLog.out.Printf("Created role %s, without login\n", role)
+		created = append(created, role)
+	}
+	return created, failed, nil
+}
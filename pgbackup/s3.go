@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"dbbackup/internal/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// maxUploadBackoff caps the wait between two attempts of an upload.
+const maxUploadBackoff = 5 * time.Minute
+
+// uploadToS3 uploads the backup file as s3Key, retrying failures that may
+// be transient up to s3Cfg.UploadAttempts times. It returns the number of
+// attempts made.
+func uploadToS3(ctx context.Context, s3Client *s3.Client, backupFilePath string, s3Cfg config.S3, s3Key string, metadata, tags map[string]string, progress progressReporter) (int, error) {
+	return uploadRangeToS3(ctx, s3Client, backupFilePath, 0, -1, s3Cfg, s3Key, metadata, tags, progress)
+}
+
+// uploadRangeToS3 uploads size bytes of the backup file from offset, or
+// the rest of the file when size is negative, as s3Key, retrying like
+// uploadToS3.
+func uploadRangeToS3(ctx context.Context, s3Client *s3.Client, backupFilePath string, offset, size int64, s3Cfg config.S3, s3Key string, metadata, tags map[string]string, progress progressReporter) (int, error) {
+	for attempt := 1; ; attempt++ {
+		err := uploadFileToS3(ctx, s3Client, backupFilePath, offset, size, s3Cfg, s3Key, metadata, tags, progress)
+		if err == nil || attempt >= s3Cfg.UploadAttempts || !isRetryable(err) {
+			return attempt, err
+		}
+		delay := uploadBackoff(s3Cfg.UploadBackoff, attempt)
+		log.Printf("Attempt %d of %d to upload s3://%s/%s failed, retrying in %s: %v", attempt, s3Cfg.UploadAttempts, s3Cfg.Bucket, s3Key, delay.Round(time.Millisecond), err)
+		pause(ctx, delay)
+		if ctx.Err() != nil {
+			return attempt, err
+		}
+	}
+}
+
+// uploadBackoff returns the wait after the failed attempt attempt: base
+// doubled for each earlier attempt, capped, of which a random half is
+// waited so that concurrent uploads do not retry in lockstep.
+func uploadBackoff(base time.Duration, attempt int) time.Duration {
+	d := min(base, maxUploadBackoff)
+	for range attempt - 1 {
+		d = min(2*d, maxUploadBackoff)
+	}
+	if d < 2 {
+		return d
+	}
+	return d/2 + rand.N(d/2)
+}
+
+// isRetryable reports whether the S3 error err may not recur, such as a
+// SlowDown response or a reset connection.
+func isRetryable(err error) bool {
+	return retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary
+}
+
+// uploadFileToS3 makes a single attempt to upload the range of the backup
+// file, reading it from the start and reporting its progress.
+func uploadFileToS3(ctx context.Context, s3Client *s3.Client, backupFilePath string, offset, size int64, s3Cfg config.S3, s3Key string, metadata, tags map[string]string, progress progressReporter) error {
+	// Open the backup file
+	file, err := os.Open(backupFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %w", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %w", err)
+	}
+	if size < 0 {
+		size = info.Size() - offset
+	}
+
+	// Upload the backup file to S3 in parts, or with a single PutObject
+	// when it is smaller than a part. Parts of a failed upload are aborted
+	// here rather than by the uploader, which would use ctx even when it was
+	// cancelled.
+	uploader := manager.NewUploader(s3Client, func(u *manager.Uploader) {
+		u.PartSize = int64(s3Cfg.UploadPartSize)
+		u.Concurrency = s3Cfg.UploadConcurrency
+		u.LeavePartsOnError = true
+	})
+	var sent atomic.Int64
+	section := io.NewSectionReader(file, offset, size)
+	body := &countingReader{uploadBody(ctx, section, sharedUploadLimiter(s3Cfg.UploadBandwidthLimit)), &sent}
+	stopProgress := progress.track(fmt.Sprintf("s3://%s/%s", s3Cfg.Bucket, s3Key), size, &sent)
+	start := time.Now()
+	_, err = uploader.Upload(ctx, withSSE(&s3.PutObjectInput{
+		Bucket:       aws.String(s3Cfg.Bucket),
+		Key:          aws.String(s3Key),
+		Body:         body,
+		ACL:          types.ObjectCannedACLPrivate,
+		Metadata:     metadata,
+		Tagging:      tagging(tags),
+		StorageClass: types.StorageClass(s3Cfg.StorageClass),
+	}, s3Cfg))
+	stopProgress()
+	if err != nil {
+		var multipart manager.MultiUploadFailure
+		if errors.As(err, &multipart) {
+			abortMultipartUpload(context.WithoutCancel(ctx), s3Client, s3Cfg.Bucket, s3Key, multipart.UploadID())
+		}
+		return fmt.Errorf("failed to upload to S3: %w", err)
+	}
+	elapsed := time.Since(start)
+
+	throughput := formatThroughput(size, elapsed)
+	if s3Cfg.UploadBandwidthLimit > 0 {
+		throughput += fmt.Sprintf(", limit %s shared by all uploads", s3Cfg.UploadBandwidthLimit)
+	}
+	fmt.Printf("Backup successful: %s uploaded to s3://%s/%s (%s in %s, %s)\n", filepath.Base(backupFilePath), s3Cfg.Bucket, s3Key,
+		formatSize(size), elapsed.Round(time.Millisecond), throughput)
+	return nil
+}
+
+// abortMultipartUpload discards the parts uploaded so far by the multipart
+// upload uploadID, so that they are not billed.
+func abortMultipartUpload(ctx context.Context, s3Client *s3.Client, s3Bucket, s3Key, uploadID string) {
+	_, err := s3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s3Bucket),
+		Key:      aws.String(s3Key),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		log.Printf("Warning: failed to abort multipart upload of s3://%s/%s, its parts remain until a lifecycle rule removes them: %v", s3Bucket, s3Key, err)
+	}
+}
+
+// formatThroughput renders size bytes transferred in elapsed as MB/s.
+func formatThroughput(size int64, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "- MB/s"
+	}
+	return fmt.Sprintf("%.1f MB/s", float64(size)/1e6/elapsed.Seconds())
+}
+
+// registerUploadFlags binds the flags tuning uploads, shared by the commands
+// that upload backups.
+func registerUploadFlags(fs *flag.FlagSet, c *config.Config) {
+	fs.Var(&c.S3.UploadPartSize, "upload-part-size", "size of the parts of multipart uploads, e.g. 64MiB; smaller files are uploaded in one request")
+	fs.IntVar(&c.S3.UploadConcurrency, "upload-concurrency", c.S3.UploadConcurrency, "number of parts of a file uploaded at once")
+	fs.IntVar(&c.S3.UploadAttempts, "upload-attempts", c.S3.UploadAttempts, "number of times an upload is tried before it fails")
+	fs.DurationVar(&c.S3.UploadBackoff, "upload-backoff", c.S3.UploadBackoff, "wait before the first retry of an upload, doubling with each further attempt")
+	fs.Var(&c.S3.UploadBandwidthLimit, "upload-bandwidth-limit", "maximum rate of all uploads together, e.g. 100MBps; 0 leaves them unlimited")
+}
+
+// registerDownloadFlags binds the flags tuning downloads, shared by the
+// commands that download backups.
+func registerDownloadFlags(fs *flag.FlagSet, c *config.Config) {
+	fs.IntVar(&c.S3.DownloadAttempts, "download-attempts", c.S3.DownloadAttempts, "number of times a download is tried before it fails")
+	fs.DurationVar(&c.S3.DownloadBackoff, "download-backoff", c.S3.DownloadBackoff, "wait before the first retry of a download, doubling with each further attempt")
+	fs.IntVar(&c.S3.DownloadParts, "download-parts", c.S3.DownloadParts, "number of parts of a split backup downloaded at once")
+}
+
+// objectTags returns the tags of an object holding a backup of dbName, empty
+// for objects of the whole run, kept for retentionDays: the configured tags
+// and the automatic ones.
+func objectTags(cfg *config.Config, dbName string, retentionDays int) map[string]string {
+	tags, _ := config.ParseTags(cfg.S3.Tags) // checked when the config was loaded
+	tags["host"] = tagValue(hostLabel(cfg.Postgres))
+	if dbName != "" {
+		tags["database"] = tagValue(dbName)
+	}
+	tags["retention-class"] = "indefinite"
+	if retentionDays > 0 {
+		tags["retention-class"] = strconv.Itoa(retentionDays) + "d"
+	}
+	return tags
+}
+
+// tagValue replaces the characters S3 does not allow in tag values, which
+// database names may contain, and truncates value to S3's limit.
+func tagValue(value string) string {
+	runes := []rune(value)
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsNumber(r) && !unicode.Is(unicode.Z, r) && !strings.ContainsRune("_.:/=+-@", r) {
+			runes[i] = '_'
+		}
+	}
+	return string(runes[:min(len(runes), 256)])
+}
+
+// tagging encodes tags for the Tagging header of PutObject, or returns nil
+// when there are none.
+func tagging(tags map[string]string) *string {
+	if len(tags) == 0 {
+		return nil
+	}
+	values := url.Values{}
+	for key, value := range tags {
+		values.Set(key, value)
+	}
+	return aws.String(values.Encode())
+}
+
+// versionIDInput returns the VersionId of a request for versionID, or nil
+// for the latest version when it is empty.
+func versionIDInput(versionID string) *string {
+	if versionID == "" {
+		return nil
+	}
+	return aws.String(versionID)
+}
+
+// s3Location names s3Key, and the version of it versionID is unless empty.
+func s3Location(s3Bucket, s3Key, versionID string) string {
+	if versionID == "" {
+		return fmt.Sprintf("s3://%s/%s", s3Bucket, s3Key)
+	}
+	return fmt.Sprintf("s3://%s/%s (version %s)", s3Bucket, s3Key, versionID)
+}
+
+// getS3ObjectTags returns the tags of an object.
+func getS3ObjectTags(ctx context.Context, s3Client *s3.Client, s3Bucket, s3Key string) (map[string]string, error) {
+	output, err := s3Client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(s3Key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tags of s3://%s/%s: %w", s3Bucket, s3Key, err)
+	}
+	tags := make(map[string]string, len(output.TagSet))
+	for _, tag := range output.TagSet {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return tags, nil
+}
+
+// withSSE sets the server-side encryption s3Cfg asks for on input.
+func withSSE(input *s3.PutObjectInput, s3Cfg config.S3) *s3.PutObjectInput {
+	if s3Cfg.SSE != "" {
+		input.ServerSideEncryption = types.ServerSideEncryption(s3Cfg.SSE)
+	}
+	if s3Cfg.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(s3Cfg.SSEKMSKeyID)
+	}
+	return input
+}
+
+// listS3Objects lists every object below s3KeyPrefix, following
+// ListObjectsV2's pages of up to 1000 objects to the end, and logs how many
+// there are.
+func listS3Objects(ctx context.Context, s3Client s3.ListObjectsV2APIClient, s3Bucket, s3KeyPrefix string) ([]types.Object, error) {
+	var objects []types.Object
+	pages := 0
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s3Bucket),
+		Prefix: aws.String(s3KeyPrefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects in S3 bucket: %w", err)
+		}
+		objects = append(objects, page.Contents...)
+		pages++
+	}
+
+	fmt.Printf("Listed %d objects in %d pages below s3://%s/%s\n", len(objects), pages, s3Bucket, s3KeyPrefix)
+	return objects, nil
+}
+
+func listS3BackupFiles(ctx context.Context, s3Client s3.ListObjectsV2APIClient, s3Bucket, s3KeyPrefix string) ([]string, error) {
+	objects, err := listS3Objects(ctx, s3Client, s3Bucket, s3KeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, object := range objects {
+		files = append(files, *object.Key)
+	}
+
+	return files, nil
+}
+
+// listS3ObjectVersions lists every version of the objects below
+// s3KeyPrefix, and the delete markers that hide the objects deleted from a
+// versioned bucket.
+func listS3ObjectVersions(ctx context.Context, s3Client s3.ListObjectVersionsAPIClient, s3Bucket, s3KeyPrefix string) ([]types.ObjectVersion, []types.DeleteMarkerEntry, error) {
+	var versions []types.ObjectVersion
+	var deleteMarkers []types.DeleteMarkerEntry
+	paginator := s3.NewListObjectVersionsPaginator(s3Client, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(s3Bucket),
+		Prefix: aws.String(s3KeyPrefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to list object versions in S3 bucket: %w", err)
+		}
+		versions = append(versions, page.Versions...)
+		deleteMarkers = append(deleteMarkers, page.DeleteMarkers...)
+	}
+	return versions, deleteMarkers, nil
+}
+
+// downloadFromS3 downloads s3Key, at versionID or at its latest version when
+// versionID is empty, to destinationPath, retrying errors that may be
+// transient, and downloads that came up short, up to s3Cfg.DownloadAttempts
+// times. Each attempt rewrites the file from the start.
+func downloadFromS3(ctx context.Context, s3Client *s3.Client, s3Cfg config.S3, s3Key, versionID, destinationPath string) error {
+	// Create a file to write to
+	file, err := os.Create(destinationPath)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %w", destinationPath, err)
+	}
+	defer file.Close()
+
+	// Download the file from S3
+	for attempt := 1; ; attempt++ {
+		err := downloadFileFromS3(ctx, s3Client, s3Cfg.Bucket, s3Key, versionID, file)
+		if err == nil {
+			break
+		}
+		if attempt >= s3Cfg.DownloadAttempts || !(isRetryable(err) || errors.Is(err, errShortDownload)) {
+			if attempt > 1 {
+				return fmt.Errorf("failed to download s3://%s/%s after %d attempts: %w", s3Cfg.Bucket, s3Key, attempt, err)
+			}
+			return err
+		}
+		delay := uploadBackoff(s3Cfg.DownloadBackoff, attempt)
+		log.Printf("Attempt %d of %d to download s3://%s/%s failed, retrying in %s: %v", attempt, s3Cfg.DownloadAttempts, s3Cfg.Bucket, s3Key, delay.Round(time.Millisecond), err)
+		pause(ctx, delay)
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Downloaded backup from %s to %s\n", s3Location(s3Cfg.Bucket, s3Key, versionID), destinationPath)
+	return nil
+}
+
+// errShortDownload reports a download that ended before the object did.
+var errShortDownload = errors.New("download ended early")
+
+// downloadFileFromS3 makes a single attempt to download s3Key at versionID
+// over the contents of file, checking that all of the object's
+// ContentLength arrived.
+func downloadFileFromS3(ctx context.Context, s3Client *s3.Client, s3Bucket, s3Key, versionID string, file *os.File) error {
+	if err := file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate file %s: %w", file.Name(), err)
+	}
+	head, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:    aws.String(s3Bucket),
+		Key:       aws.String(s3Key),
+		VersionId: versionIDInput(versionID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to download file from S3: %w", err)
+	}
+	if err := downloadS3Object(ctx, s3Client, s3Bucket, s3Key, versionID, file); err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to check file %s: %w", file.Name(), err)
+	}
+	if want := aws.ToInt64(head.ContentLength); info.Size() != want {
+		return fmt.Errorf("%w: got %d of %d bytes", errShortDownload, info.Size(), want)
+	}
+	return nil
+}
+
+// downloadS3Object downloads an object, at versionID unless it is empty,
+// into w, explaining the failures an archived object or a missing SSE-KMS
+// permission cause.
+func downloadS3Object(ctx context.Context, s3Client *s3.Client, s3Bucket, s3Key, versionID string, w io.WriterAt) error {
+	s3Downloader := manager.NewDownloader(s3Client)
+	_, err := s3Downloader.Download(ctx, w, &s3.GetObjectInput{
+		Bucket:    aws.String(s3Bucket),
+		Key:       aws.String(s3Key),
+		VersionId: versionIDInput(versionID),
+	})
+	if isArchived(err) {
+		return archivedObjectError(ctx, s3Client, s3Bucket, s3Key, versionID)
+	}
+	if isKMSAccessDenied(err) {
+		return fmt.Errorf("failed to download s3://%s/%s: the object is encrypted with SSE-KMS and the AWS identity is not allowed to use its key (kms:Decrypt): %w", s3Bucket, s3Key, err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download file from S3: %w", err)
+	}
+	return nil
+}
+
+// checkStorageClass reports a storage class the SDK does not know.
+func checkStorageClass(storageClass string) error {
+	classes := types.StorageClassStandard.Values()
+	if storageClass == "" || slices.Contains(classes, types.StorageClass(storageClass)) {
+		return nil
+	}
+	names := make([]string, len(classes))
+	for i, class := range classes {
+		names[i] = string(class)
+	}
+	return fmt.Errorf("storage class must be one of %s, got %q", strings.Join(names, ", "), storageClass)
+}
+
+// isArchived reports whether err is S3 refusing to read an object archived
+// in GLACIER or DEEP_ARCHIVE that has not been restored.
+func isArchived(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidObjectState"
+}
+
+// archivedObjectError explains how to get at an archived object.
+func archivedObjectError(ctx context.Context, s3Client *s3.Client, s3Bucket, s3Key, versionID string) error {
+	storageClass := "an archive storage class"
+	output, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:    aws.String(s3Bucket),
+		Key:       aws.String(s3Key),
+		VersionId: versionIDInput(versionID),
+	})
+	if err == nil {
+		storageClass = string(output.StorageClass)
+		if strings.Contains(aws.ToString(output.Restore), `ongoing-request="true"`) {
+			return fmt.Errorf("s3://%s/%s is being restored from %s; retry once the restore completes", s3Bucket, s3Key, storageClass)
+		}
+	}
+	return fmt.Errorf("s3://%s/%s is archived in %s and must be restored before it can be downloaded, with restore -glacier initiate or wait, or with aws s3api restore-object --bucket %s --key %s --restore-request Days=1; retry once the restore completes",
+		s3Bucket, s3Key, storageClass, s3Bucket, s3Key)
+}
+
+// isKMSAccessDenied reports whether err is S3 refusing an SSE-KMS object
+// because the caller may not decrypt with its KMS key.
+func isKMSAccessDenied(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "AccessDenied" && strings.Contains(apiErr.ErrorMessage(), "kms:")
+}
+
+// putS3Object uploads a small in-memory object such as a manifest.
+func putS3Object(ctx context.Context, s3Client *s3.Client, s3Cfg config.S3, s3Key string, body []byte, contentType string, tags map[string]string) error {
+	_, err := s3Client.PutObject(ctx, withSSE(&s3.PutObjectInput{
+		Bucket:      aws.String(s3Cfg.Bucket),
+		Key:         aws.String(s3Key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+		ACL:         types.ObjectCannedACLPrivate,
+		Metadata:    map[string]string{"sha256": sha256Hex(body)},
+		Tagging:     tagging(tags),
+	}, s3Cfg))
+	if err != nil {
+		return fmt.Errorf("failed to upload s3://%s/%s: %w", s3Cfg.Bucket, s3Key, err)
+	}
+	return nil
+}
+
+// headS3Object returns the user metadata of an object, at versionID unless
+// it is empty.
+func headS3Object(ctx context.Context, s3Client *s3.Client, s3Bucket, s3Key, versionID string) (map[string]string, error) {
+	output, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:    aws.String(s3Bucket),
+		Key:       aws.String(s3Key),
+		VersionId: versionIDInput(versionID),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata of %s: %w", s3Location(s3Bucket, s3Key, versionID), err)
+	}
+	return output.Metadata, nil
+}
+
+func deleteFromS3(ctx context.Context, s3Client *s3.Client, s3Bucket, s3Key string) error {
+	_, err := s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(s3Key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete s3://%s/%s: %w", s3Bucket, s3Key, err)
+	}
+	return nil
+}
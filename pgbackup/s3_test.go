@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// pagedClient serves pages of keys through ListObjectsV2, continuing each
+// page from the token of the one before, and fails with err when the
+// listing reaches the page at failAt.
+type pagedClient struct {
+	pages  [][]string
+	failAt int
+	err    error
+	calls  int
+}
+
+func (c *pagedClient) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	page := 0
+	if token := aws.ToString(params.ContinuationToken); token != "" {
+		var err error
+		if page, err = strconv.Atoi(token); err != nil || page >= len(c.pages) {
+			return nil, errors.New("unknown continuation token " + token)
+		}
+	}
+	c.calls++
+	if c.err != nil && page == c.failAt {
+		return nil, c.err
+	}
+	output := &s3.ListObjectsV2Output{}
+	for _, key := range c.pages[page] {
+		output.Contents = append(output.Contents, types.Object{Key: aws.String(key), Size: aws.Int64(1)})
+	}
+	if page+1 < len(c.pages) {
+		output.IsTruncated = aws.Bool(true)
+		output.NextContinuationToken = aws.String(strconv.Itoa(page + 1))
+	}
+	return output, nil
+}
+
+func TestListS3ObjectsPages(t *testing.T) {
+	client := &pagedClient{pages: [][]string{
+		{"backups/a.dump", "backups/b.dump"},
+		{"backups/c.dump"},
+		{"backups/d.dump", "backups/e.dump"},
+	}}
+	objects, err := listS3Objects(context.Background(), client, "bucket", "backups/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, aws.ToString(object.Key))
+	}
+	want := []string{"backups/a.dump", "backups/b.dump", "backups/c.dump", "backups/d.dump", "backups/e.dump"}
+	if !slices.Equal(keys, want) {
+		t.Errorf("listed %v, want %v", keys, want)
+	}
+	if client.calls != 3 {
+		t.Errorf("listed %d pages, want 3", client.calls)
+	}
+}
+
+func TestListS3ObjectsPageError(t *testing.T) {
+	pageErr := errors.New("throttled")
+	client := &pagedClient{pages: [][]string{{"backups/a.dump"}, {"backups/b.dump"}}, failAt: 1, err: pageErr}
+	objects, err := listS3Objects(context.Background(), client, "bucket", "backups/")
+	if !errors.Is(err, pageErr) {
+		t.Fatalf("got error %v, want %v", err, pageErr)
+	}
+	if objects != nil {
+		t.Errorf("got objects %v along with the error", objects)
+	}
+}
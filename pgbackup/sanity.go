@@ -0,0 +1,242 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"dbbackup/internal/config"
+)
+
+// dumpHeaders holds what the output of pg_dump starts with in each format,
+// at an offset: the archive formats carry a magic string and plain scripts
+// a fixed comment. Directory dumps are checked through their toc.dat, a
+// custom-format archive.
+var dumpHeaders = map[string]struct {
+	offset int
+	magic  string
+}{
+	"custom":    {0, "PGDMP"},
+	"directory": {0, "PGDMP"},
+	"tar":       {257, "ustar"},
+	"plain":     {0, "--\n-- PostgreSQL database dump"},
+}
+
+// scriptStarts are what the plain SQL scripts of pg_dump and other tools
+// start with, once leading blank space is skipped.
+var scriptStarts = []string{"--", "/*", "SET ", "SELECT ", "CREATE ", "BEGIN", `\connect`}
+
+// detectFormat returns the format of the dump at path, for backups uploaded
+// without format metadata, from what it starts with: the magic string of a
+// custom-format archive, a tar header, or SQL text. A tar file is a
+// tar-format dump when it holds restore.sql, which pg_dump -F t adds, and a
+// packed directory dump when it holds a toc.dat without it. It returns ""
+// when the dump is none of these.
+func detectFormat(dumpPath string) string {
+	file, err := os.Open(dumpPath)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	head := make([]byte, dumpHeadSize)
+	n, _ := io.ReadFull(file, head)
+	head = head[:n]
+
+	tarHeader := dumpHeaders["tar"]
+	switch {
+	case bytes.HasPrefix(head, []byte(dumpHeaders["custom"].magic)):
+		return "custom"
+	case len(head) >= tarHeader.offset+len(tarHeader.magic) && string(head[tarHeader.offset:tarHeader.offset+len(tarHeader.magic)]) == tarHeader.magic:
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return ""
+		}
+		toc := false
+		tr := tar.NewReader(file)
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				break
+			}
+			switch path.Clean(hdr.Name) {
+			case "restore.sql":
+				return "tar"
+			case "toc.dat":
+				toc = true
+			}
+		}
+		if toc {
+			return "directory"
+		}
+		return ""
+	}
+	if isScript(head) {
+		return "plain"
+	}
+	return ""
+}
+
+// isScript reports whether head, the first bytes of a dump, starts like
+// an SQL script, as text.
+func isScript(head []byte) bool {
+	if bytes.IndexByte(head, 0) >= 0 {
+		return false
+	}
+	text := string(bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")), " \t\r\n"))
+	for _, start := range scriptStarts {
+		if len(text) >= len(start) && strings.EqualFold(text[:len(start)], start) {
+			return true
+		}
+	}
+	return false
+}
+
+// dumpHeadSize is the number of leading bytes of a dump kept for the check.
+const dumpHeadSize = 512
+
+// dumpCheck passes pg_dump's output on to w, keeping its first bytes and
+// counting its size so that the output can be checked once pg_dump is done,
+// before it is compressed or encrypted. It also digests the output, leaving
+// out the creation time custom-format archives record, so that dumps of an
+// unchanged database digest alike.
+type dumpCheck struct {
+	w      io.Writer
+	format string
+	head   []byte
+	size   int64
+	hash   hash.Hash
+	hashed bool // whether head has been digested
+}
+
+func newDumpCheck(format string) *dumpCheck {
+	return &dumpCheck{format: format, hash: sha256.New()}
+}
+
+func (c *dumpCheck) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.size += int64(n)
+	rest := p[:n]
+	if len(c.head) < dumpHeadSize {
+		k := min(len(rest), dumpHeadSize-len(c.head))
+		c.head = append(c.head, rest[:k]...)
+		rest = rest[k:]
+		if len(c.head) == dumpHeadSize {
+			c.digestHead()
+		}
+	}
+	c.hash.Write(rest)
+	return n, err
+}
+
+// digestHead digests the head of the output with the creation time zeroed.
+func (c *dumpCheck) digestHead() {
+	head := slices.Clone(c.head)
+	if c.format == "custom" {
+		start, end := creationTime(head)
+		clear(head[start:end])
+	}
+	c.hash.Write(head)
+	c.hashed = true
+}
+
+// verify checks the output seen.
+func (c *dumpCheck) verify(minSize config.ByteSize) error {
+	return checkDump(c.format, c.head, c.size, minSize)
+}
+
+// Sum returns the hex-encoded digest of the output seen.
+func (c *dumpCheck) Sum() string {
+	if !c.hashed {
+		c.digestHead()
+	}
+	return hex.EncodeToString(c.hash.Sum(nil))
+}
+
+// creationTime returns the bounds of the creation time in the header of
+// the custom-format archive starting with head, or an empty range for
+// archives too old to record it. The header holds the magic string, the
+// archive version, the sizes of integers and offsets, the format, the
+// compression (a byte from version 1.15, an integer before), then the
+// creation time as seven integers, each a sign byte and intSize bytes.
+func creationTime(head []byte) (start, end int) {
+	if len(head) < 11 {
+		return 0, 0
+	}
+	major, minor, intSize := head[5], head[6], int(head[8])
+	atLeast := func(wantMajor, wantMinor byte) bool {
+		return major > wantMajor || major == wantMajor && minor >= wantMinor
+	}
+	if !atLeast(1, 4) {
+		return 0, 0
+	}
+	start = 12
+	if !atLeast(1, 15) {
+		start = 11 + 1 + intSize
+	}
+	end = start + 7*(1+intSize)
+	return min(start, len(head)), min(end, len(head))
+}
+
+// checkDump reports pg_dump output of size bytes starting with head that
+// cannot be a complete dump in format: empty output, output that does not
+// start like a dump, or output smaller than minSize. pg_dump crashing, or
+// a wrapper exiting successfully without running it, leaves such output.
+func checkDump(format string, head []byte, size int64, minSize config.ByteSize) error {
+	if size == 0 {
+		return errors.New("suspect dump: pg_dump wrote nothing")
+	}
+	header := dumpHeaders[format]
+	if end := header.offset + len(header.magic); len(head) < end || !bytes.Equal(head[header.offset:end], []byte(header.magic)) {
+		return fmt.Errorf("suspect dump: pg_dump's output does not start like a %s-format dump", format)
+	}
+	if size < int64(minSize) {
+		return fmt.Errorf("suspect dump: pg_dump wrote %s, less than the minimum of %s", formatSize(size), formatSize(int64(minSize)))
+	}
+	return nil
+}
+
+// checkDumpDirectory checks the directory-format dump in dir like
+// checkDump, through its table of contents and the total size of its
+// files.
+func checkDumpDirectory(dir string, minSize config.ByteSize) error {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check dump directory: %w", err)
+	}
+
+	toc, err := os.Open(filepath.Join(dir, "toc.dat"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return errors.New("suspect dump: pg_dump wrote no toc.dat")
+		}
+		return fmt.Errorf("failed to check dump directory: %w", err)
+	}
+	defer toc.Close()
+	head := make([]byte, dumpHeadSize)
+	n, err := io.ReadFull(toc, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to check dump directory: %w", err)
+	}
+	return checkDump("directory", head[:n], size, minSize)
+}
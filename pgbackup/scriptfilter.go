@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+var (
+	// ownerStatement matches the statements of a plain dump that set an
+	// object's owner, which pg_dump writes on a line of their own.
+	ownerStatement = regexp.MustCompile(`^ALTER [A-Z ]+ .* OWNER TO .*;\n$`)
+
+	// aclStatement matches the statements of a plain dump that grant or
+	// revoke privileges.
+	aclStatement = regexp.MustCompile(`^(GRANT|REVOKE|ALTER DEFAULT PRIVILEGES) .*;\n$`)
+
+	// tablespaceStatement matches the statements of a plain dump that pick
+	// the tablespace of the objects created after them, capturing its
+	// name, which is '' for the database's default.
+	tablespaceStatement = regexp.MustCompile(`^SET default_tablespace = (''|"(?:[^"]|"")+"|[^;]+);\n$`)
+)
+
+// scriptFilter rewrites SQL scripts for the pg_restore options psql lacks,
+// for plain backups and for archives restored through their script.
+type scriptFilter struct {
+	noOwner, noACL bool
+	noTablespaces  bool
+	tablespaces    map[string]string // old tablespace names to new ones
+}
+
+// active reports whether the filter changes anything.
+func (f scriptFilter) active() bool {
+	return f.noOwner || f.noACL || f.noTablespaces || len(f.tablespaces) > 0
+}
+
+// copy copies the script r to w, leaving out the statements that set
+// owners with noOwner, those that set privileges with noACL and those that
+// pick tablespaces with noTablespaces, and moving objects to the new
+// tablespaces. The rows of COPY blocks are copied as they are. It returns
+// the number of statements left out and rewritten.
+func (f scriptFilter) copy(w io.Writer, r io.Reader) (removed, rewritten int, err error) {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	copying := false
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			switch {
+			case copying:
+				copying = !bytes.Equal(line, []byte("\\.\n"))
+			case bytes.HasPrefix(line, []byte("COPY ")) && bytes.HasSuffix(line, []byte("FROM stdin;\n")):
+				copying = true
+			case f.noOwner && ownerStatement.Match(line), f.noACL && aclStatement.Match(line):
+				removed++
+				continue
+			case f.noTablespaces || len(f.tablespaces) > 0:
+				m := tablespaceStatement.FindSubmatch(line)
+				if m == nil {
+					break
+				}
+				if f.noTablespaces {
+					removed++
+					continue
+				}
+				name := string(m[1])
+				if strings.HasPrefix(name, `"`) {
+					name = strings.ReplaceAll(name[1:len(name)-1], `""`, `"`)
+				}
+				if to, ok := f.tablespaces[name]; ok {
+					line = []byte("SET default_tablespace = " + pq.QuoteIdentifier(to) + ";\n")
+					rewritten++
+				}
+			}
+			if _, err := bw.Write(line); err != nil {
+				return removed, rewritten, err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return removed, rewritten, err
+		}
+	}
+	return removed, rewritten, bw.Flush()
+}
+
+// filterFile copies the script src to dst through the filter.
+func (f scriptFilter) filterFile(src, dst string) (removed, rewritten int, err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create file %s: %w", dst, err)
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	return f.copy(out, in)
+}
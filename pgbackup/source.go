@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"dbbackup/internal/config"
+	"dbbackup/internal/storage"
+)
+
+// backupSource is where a restore finds its backups: the bucket and prefix
+// of the configuration, or a local directory of backup files. The files of
+// a directory are keyed by their slash-separated paths below it, and their
+// metadata is read from a sidecar NAME.json holding the object metadata, or
+// from the NAME.upload.json a failed upload was kept with.
+type backupSource struct {
+	dir      string     // the directory of a dir: source, empty for S3
+	s3Client *s3.Client // nil for a directory
+	s3Cfg    config.S3
+
+	// bucket and prefix tell the restores of the same backups apart: the
+	// S3 ones, or none and the directory
+	bucket, prefix string
+
+	// versionKey is restored at versionID, an earlier version of it in a
+	// versioned bucket, instead of at its latest version
+	versionKey, versionID string
+}
+
+// newBackupSource returns the source the restore configured in cfg reads
+// from, connecting to S3 only when the backups are there.
+func newBackupSource(ctx context.Context, cfg *config.Config) (*backupSource, error) {
+	dir, _ := config.ParseRestoreSource(cfg.Restore.Source) // checked when the config was loaded
+	if dir != "" {
+		return &backupSource{dir: dir, prefix: dir}, nil
+	}
+	s3Client, err := storage.NewClient(ctx, cfg.S3, cfg.AWS)
+	if err != nil {
+		return nil, err
+	}
+	return &backupSource{s3Client: s3Client, s3Cfg: cfg.S3, bucket: cfg.S3.Bucket, prefix: cfg.S3.Prefix}, nil
+}
+
+// String names the place the backups are found in.
+func (s *backupSource) String() string {
+	if s.dir != "" {
+		return s.dir
+	}
+	return fmt.Sprintf("s3://%s/%s", s.s3Cfg.Bucket, s.s3Cfg.Prefix)
+}
+
+// location names the backup stored as key.
+func (s *backupSource) location(key string) string {
+	if s.dir != "" {
+		return filepath.Join(s.dir, filepath.FromSlash(key))
+	}
+	return fmt.Sprintf("s3://%s/%s", s.s3Cfg.Bucket, key)
+}
+
+// versionOf returns the version key is read at, empty for the latest.
+func (s *backupSource) versionOf(key string) string {
+	if key == s.versionKey {
+		return s.versionID
+	}
+	return ""
+}
+
+// object returns the S3 object stored as key, at the version versionOf
+// tells, for restoring it without listing the prefix.
+func (s *backupSource) object(ctx context.Context, key string) (types.Object, error) {
+	versionID := s.versionOf(key)
+	head, err := s.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:    aws.String(s.s3Cfg.Bucket),
+		Key:       aws.String(key),
+		VersionId: versionIDInput(versionID),
+	})
+	if err != nil {
+		return types.Object{}, fmt.Errorf("failed to read %s, which list -versions -key %s tells the versions and delete markers of: %w", s3Location(s.s3Cfg.Bucket, key, versionID), key, err)
+	}
+	return types.Object{
+		Key:          aws.String(key),
+		Size:         head.ContentLength,
+		LastModified: head.LastModified,
+		StorageClass: types.ObjectStorageClass(head.StorageClass),
+	}, nil
+}
+
+// list lists the objects below the S3 prefixes, or every file of the
+// directory but the sidecars, as objects keyed by their paths.
+func (s *backupSource) list(ctx context.Context, prefixes []string) ([]types.Object, error) {
+	var objects []types.Object
+	if s.dir == "" {
+		for _, prefix := range prefixes {
+			listed, err := listS3Objects(ctx, s.s3Client, s.s3Cfg.Bucket, prefix)
+			if err != nil {
+				return nil, err
+			}
+			objects = append(objects, listed...)
+		}
+		return objects, nil
+	}
+
+	err := filepath.WalkDir(s.dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(name, ".json") {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, name)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, types.Object{
+			Key:          aws.String(filepath.ToSlash(rel)),
+			Size:         aws.Int64(info.Size()),
+			LastModified: aws.Time(info.ModTime()),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backup files in %s: %w", s.dir, err)
+	}
+	fmt.Printf("Found %d files in %s\n", len(objects), s.dir)
+	return objects, nil
+}
+
+// globalsKeys returns the keys of the files directly below the prefix, or
+// in the directory, whose names start with "globals_".
+func (s *backupSource) globalsKeys(ctx context.Context) ([]string, error) {
+	if s.dir == "" {
+		return listS3BackupFiles(ctx, s.s3Client, s.s3Cfg.Bucket, path.Join(s.s3Cfg.Prefix, "globals_"))
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backup files in %s: %w", s.dir, err)
+	}
+	var keys []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), "globals_") && !strings.HasSuffix(entry.Name(), ".json") {
+			keys = append(keys, entry.Name())
+		}
+	}
+	return keys, nil
+}
+
+// metadata returns the metadata of the backup stored as key, empty for a
+// file without a sidecar.
+func (s *backupSource) metadata(ctx context.Context, key string) (map[string]string, error) {
+	if s.dir == "" {
+		return headS3Object(ctx, s.s3Client, s.s3Cfg.Bucket, key, s.versionOf(key))
+	}
+	file := s.location(key)
+	metadata := make(map[string]string)
+	data, err := os.ReadFile(file + ".json")
+	if err == nil {
+		if err := json.Unmarshal(data, &metadata); err != nil {
+			return nil, fmt.Errorf("failed to read metadata of %s from %s.json: %w", file, file, err)
+		}
+		return metadata, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read metadata of %s: %w", file, err)
+	}
+	data, err = os.ReadFile(file + ".upload.json")
+	if errors.Is(err, fs.ErrNotExist) {
+		return metadata, nil
+	}
+	var upload failedUpload
+	if err == nil {
+		err = json.Unmarshal(data, &upload)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata of %s from %s.upload.json: %w", file, file, err)
+	}
+	if upload.Metadata != nil {
+		metadata = upload.Metadata
+	}
+	return metadata, nil
+}
+
+// fetch places the backup stored as key at dst, downloading it through
+// cache from S3, or linking or copying the file of the directory. An
+// earlier version is downloaded past the cache, which keeps the latest.
+func (s *backupSource) fetch(ctx context.Context, key, dst string, cache *downloadCache) error {
+	if versionID := s.versionOf(key); s.dir == "" && versionID != "" {
+		return downloadFromS3(ctx, s.s3Client, s.s3Cfg, key, versionID, dst)
+	}
+	if s.dir == "" {
+		return cache.download(ctx, s.s3Client, s.s3Cfg, key, dst)
+	}
+	if err := linkOrCopy(s.location(key), dst); err != nil {
+		return fmt.Errorf("failed to copy backup file %s: %w", s.location(key), err)
+	}
+	fmt.Printf("Copied backup from %s to %s\n", s.location(key), dst)
+	return nil
+}
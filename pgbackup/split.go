@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dbbackup/internal/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// partPattern matches the suffix of the part objects of a split backup.
+var partPattern = regexp.MustCompile(`\.part[0-9]{4,}$`)
+
+// partKey returns the key of part n, from 1, of the backup at s3Key.
+func partKey(s3Key string, n int) string {
+	return fmt.Sprintf("%s.part%04d", s3Key, n)
+}
+
+// isPartKey reports whether key is a part of a split backup rather than a
+// backup.
+func isPartKey(key string) bool {
+	return partPattern.MatchString(key)
+}
+
+// partIndexKey returns the key of the backup the part at key belongs to,
+// which holds the index of its parts.
+func partIndexKey(key string) string {
+	return partPattern.ReplaceAllString(key, "")
+}
+
+// partIndex describes a backup split into parts. It is stored at the
+// backup's key, with the backup's metadata, so that listing, pruning,
+// deduplication and the manifest see split backups like any other.
+type partIndex struct {
+	Size   int64        `json:"size"`
+	SHA256 string       `json:"sha256"`
+	Parts  []backupPart `json:"parts"`
+}
+
+// backupPart is one part object of a split backup.
+type backupPart struct {
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// uploadSplit uploads the backup file of size bytes as s3Key split into
+// parts of s3Cfg.MaxObjectSize bytes, whose digests are partSums, then
+// their index as s3Key itself with metadata. The parts are tagged like the
+// backup so that lifecycle rules expire them together. It returns the most
+// attempts the upload of a part took.
+func uploadSplit(ctx context.Context, s3Client *s3.Client, backupFilePath string, size int64, partSums []string, s3Cfg config.S3, s3Key string, metadata, tags map[string]string, progress progressReporter) (int, error) {
+	partSize := int64(s3Cfg.MaxObjectSize)
+	index := partIndex{Size: size, SHA256: metadata["sha256"]}
+	var most int
+	for i, sum := range partSums {
+		offset := int64(i) * partSize
+		part := backupPart{Key: partKey(s3Key, i+1), Size: min(partSize, size-offset), SHA256: sum}
+		partMetadata := map[string]string{
+			"sha256":   sum,
+			"database": metadata["database"],
+			"part-of":  s3Key,
+		}
+		attempts, err := uploadRangeToS3(ctx, s3Client, backupFilePath, offset, part.Size, s3Cfg, part.Key, partMetadata, tags, progress)
+		most = max(most, attempts)
+		if err != nil {
+			return most, fmt.Errorf("failed to upload part %d of %d: %w", i+1, len(partSums), err)
+		}
+		index.Parts = append(index.Parts, part)
+	}
+
+	// The index is read before any part, so it stays in the standard
+	// storage class
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return most, fmt.Errorf("failed to encode part index: %w", err)
+	}
+	indexMetadata := maps.Clone(metadata)
+	indexMetadata["parts"] = strconv.Itoa(len(index.Parts))
+	_, err = s3Client.PutObject(ctx, withSSE(&s3.PutObjectInput{
+		Bucket:      aws.String(s3Cfg.Bucket),
+		Key:         aws.String(s3Key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+		ACL:         types.ObjectCannedACLPrivate,
+		Metadata:    indexMetadata,
+		Tagging:     tagging(tags),
+	}, s3Cfg))
+	if err != nil {
+		return most, fmt.Errorf("failed to upload part index s3://%s/%s: %w", s3Cfg.Bucket, s3Key, err)
+	}
+	fmt.Printf("Backup split into %d parts of up to %s, indexed at s3://%s/%s\n", len(index.Parts), s3Cfg.MaxObjectSize, s3Cfg.Bucket, s3Key)
+	return most, nil
+}
+
+// assembleParts replaces the part index of s3Key downloaded to path with
+// the backup it describes, once the parts found in S3 are those it lists.
+// It downloads s3Cfg.DownloadParts parts at once into their place in the
+// file, retrying each like a download, then checks every part and the
+// whole against the index.
+func assembleParts(ctx context.Context, s3Client *s3.Client, s3Cfg config.S3, s3Key, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var index partIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return fmt.Errorf("failed to read part index: %w", err)
+	}
+	if err := checkParts(ctx, s3Client, s3Cfg.Bucket, s3Key, index); err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The first failure stops the downloads of the other parts
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var mu sync.Mutex
+	var firstErr error
+	slots := make(chan struct{}, s3Cfg.DownloadParts)
+	var wg sync.WaitGroup
+	var offset int64
+	for i, part := range index.Parts {
+		slots <- struct{}{}
+		if ctx.Err() != nil {
+			<-slots
+			break
+		}
+		partOffset := offset
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := downloadPart(ctx, s3Client, s3Cfg, part.Key, io.NewOffsetWriter(file, partOffset)); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("part %d of %d: %w", i+1, len(index.Parts), err)
+					cancel()
+				}
+				mu.Unlock()
+				return
+			}
+			fmt.Printf("Downloaded part %d of %d from s3://%s/%s\n", i+1, len(index.Parts), s3Cfg.Bucket, part.Key)
+		}()
+		offset += part.Size
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	// Read the file back once, digesting the parts and the whole together
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != index.Size {
+		return fmt.Errorf("reassembled backup has %d bytes, the index records %d", info.Size(), index.Size)
+	}
+	whole := sha256.New()
+	offset = 0
+	for _, part := range index.Parts {
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(whole, h), io.NewSectionReader(file, offset, part.Size)); err != nil {
+			return err
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != part.SHA256 {
+			return fmt.Errorf("part s3://%s/%s has SHA-256 %s, the index records %s", s3Cfg.Bucket, part.Key, sum, part.SHA256)
+		}
+		offset += part.Size
+	}
+	if sum := hex.EncodeToString(whole.Sum(nil)); sum != index.SHA256 {
+		return fmt.Errorf("reassembled backup has SHA-256 %s, the index records %s", sum, index.SHA256)
+	}
+	fmt.Printf("Verified %d parts, SHA-256 %s\n", len(index.Parts), index.SHA256)
+	return file.Close()
+}
+
+// checkParts fails, listing the parts index expects and those found, when
+// parts of s3Key are missing from S3 or S3 has parts the index does not
+// list, such as those of an earlier upload split differently.
+func checkParts(ctx context.Context, s3Client *s3.Client, s3Bucket, s3Key string, index partIndex) error {
+	objects, err := listS3Objects(ctx, s3Client, s3Bucket, s3Key+".part")
+	if err != nil {
+		return err
+	}
+	var expected, found, missing, unexpected []string
+	for _, part := range index.Parts {
+		expected = append(expected, strings.TrimPrefix(part.Key, s3Key))
+	}
+	for _, object := range objects {
+		if key := aws.ToString(object.Key); isPartKey(key) && partIndexKey(key) == s3Key {
+			found = append(found, strings.TrimPrefix(key, s3Key))
+		}
+	}
+	for _, name := range expected {
+		if !slices.Contains(found, name) {
+			missing = append(missing, name)
+		}
+	}
+	for _, name := range found {
+		if !slices.Contains(expected, name) {
+			unexpected = append(unexpected, name)
+		}
+	}
+	if len(missing) == 0 && len(unexpected) == 0 {
+		return nil
+	}
+	list := func(names []string) string {
+		if len(names) == 0 {
+			return "none"
+		}
+		return strings.Join(names, ", ")
+	}
+	return fmt.Errorf("the parts of s3://%s/%s in S3 do not match its index: expected %d (%s), found %d (%s); missing %s, unexpected %s",
+		s3Bucket, s3Key, len(expected), list(expected), len(found), list(found), list(missing), list(unexpected))
+}
+
+// downloadPart downloads the part object at s3Key into w, retrying errors
+// that may be transient up to s3Cfg.DownloadAttempts times; each attempt
+// writes the part from its start again.
+func downloadPart(ctx context.Context, s3Client *s3.Client, s3Cfg config.S3, s3Key string, w io.WriterAt) error {
+	for attempt := 1; ; attempt++ {
+		err := downloadS3Object(ctx, s3Client, s3Cfg.Bucket, s3Key, "", w)
+		if err == nil {
+			return nil
+		}
+		if attempt >= s3Cfg.DownloadAttempts || !isRetryable(err) {
+			if attempt > 1 {
+				return fmt.Errorf("failed to download s3://%s/%s after %d attempts: %w", s3Cfg.Bucket, s3Key, attempt, err)
+			}
+			return err
+		}
+		delay := uploadBackoff(s3Cfg.DownloadBackoff, attempt)
+		log.Printf("Attempt %d of %d to download s3://%s/%s failed, retrying in %s: %v", attempt, s3Cfg.DownloadAttempts, s3Cfg.Bucket, s3Key, delay.Round(time.Millisecond), err)
+		pause(ctx, delay)
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// runSummary collects the outcome of every database in a run so that it can
+// be reported once the run is over.
+type runSummary struct {
+	title     string
+	settings  [][2]string
+	order     []string // databases in the order they were queued
+	succeeded []string
+	skipped   []skippedDatabase
+	failed    []string
+
+	// deduplicated lists the succeeded databases whose dump was identical to
+	// their previous backup.
+	deduplicated []string
+
+	// uploadAttempts is the number of attempts each database's upload took.
+	uploadAttempts map[string]int
+
+	// notAttempted lists the databases left when the run was cut short.
+	notAttempted []string
+
+	// created and createFailed list the databases a restore created, or
+	// failed to create, before restoring into them.
+	created      []string
+	createFailed []string
+
+	// analyzedDBs and analyzeFailed list the restored databases whose
+	// statistics were gathered, or failed to be, after their restore.
+	analyzedDBs   []string
+	analyzeFailed []string
+
+	// validations holds the outcome of each validation check of the
+	// restored databases.
+	validations []validationResult
+}
+
+// skippedDatabase is a database the run left alone, with the reason why.
+type skippedDatabase struct {
+	name, reason string
+}
+
+// setting records a run-wide setting to show in the summary.
+func (s *runSummary) setting(name, value string) {
+	s.settings = append(s.settings, [2]string{name, value})
+}
+
+func (s *runSummary) queue(dbName string)   { s.order = append(s.order, dbName) }
+func (s *runSummary) succeed(dbName string) { s.succeeded = append(s.succeeded, dbName) }
+func (s *runSummary) fail(dbName string)    { s.failed = append(s.failed, dbName) }
+func (s *runSummary) dedupe(dbName string)  { s.deduplicated = append(s.deduplicated, dbName) }
+func (s *runSummary) abandon(dbName string) { s.notAttempted = append(s.notAttempted, dbName) }
+func (s *runSummary) create(dbName string)  { s.created = append(s.created, dbName) }
+
+// failCreate records that dbName could not be created, which is reported
+// apart from failed restores.
+func (s *runSummary) failCreate(dbName string) { s.createFailed = append(s.createFailed, dbName) }
+
+// analyzed records the outcome of gathering the statistics of the restored
+// dbName, which is reported apart from the restore itself.
+func (s *runSummary) analyzed(dbName string, err error) {
+	if err != nil {
+		s.analyzeFailed = append(s.analyzeFailed, dbName)
+		return
+	}
+	s.analyzedDBs = append(s.analyzedDBs, dbName)
+}
+
+// uploaded records that the upload of dbName's backup took attempts
+// attempts, whether or not it succeeded.
+func (s *runSummary) uploaded(dbName string, attempts int) {
+	if s.uploadAttempts == nil {
+		s.uploadAttempts = make(map[string]int)
+	}
+	s.uploadAttempts[dbName] = attempts
+}
+
+// skip logs that dbName is left alone for reason and records it.
+func (s *runSummary) skip(dbName, reason string) {
+	fmt.Printf("Skipping database %s: %s\n", dbName, reason)
+	s.skipped = append(s.skipped, skippedDatabase{dbName, reason})
+}
+
+// print writes the summary to w.
+func (s *runSummary) print(w io.Writer) {
+	fmt.Fprintf(w, "%s summary:\n", s.title)
+	for _, setting := range s.settings {
+		fmt.Fprintf(w, "  %-20s %s\n", setting[0]+":", setting[1])
+	}
+	if len(s.order) > 0 {
+		positions := make([]string, len(s.order))
+		for i, dbName := range s.order {
+			positions[i] = fmt.Sprintf("%d. %s", i+1, dbName)
+		}
+		fmt.Fprintf(w, "  %-20s %s\n", "backup order:", strings.Join(positions, ", "))
+	}
+	if len(s.uploadAttempts) > 0 {
+		var attempts []string
+		for _, dbName := range s.order {
+			if n, ok := s.uploadAttempts[dbName]; ok {
+				attempts = append(attempts, fmt.Sprintf("%s %d", dbName, n))
+			}
+		}
+		fmt.Fprintf(w, "  %-20s %s\n", "upload attempts:", strings.Join(attempts, ", "))
+	}
+	fmt.Fprintf(w, "  %-20s %d\n", "succeeded:", len(s.succeeded))
+	fmt.Fprintf(w, "  %-20s %d\n", "skipped:", len(s.skipped))
+	fmt.Fprintf(w, "  %-20s %d\n", "failed:", len(s.failed))
+	// Group the skipped databases by reason, in the order reasons first occurred
+	var reasons []string
+	byReason := make(map[string][]string)
+	for _, skipped := range s.skipped {
+		if _, ok := byReason[skipped.reason]; !ok {
+			reasons = append(reasons, skipped.reason)
+		}
+		byReason[skipped.reason] = append(byReason[skipped.reason], skipped.name)
+	}
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "  skipped (%s): %s\n", reason, strings.Join(byReason[reason], ", "))
+	}
+	if len(s.deduplicated) > 0 {
+		fmt.Fprintf(w, "  %-20s %s\n", "deduplicated:", strings.Join(s.deduplicated, ", "))
+	}
+	if len(s.failed) > 0 {
+		fmt.Fprintf(w, "  %-20s %s\n", "failed databases:", strings.Join(s.failed, ", "))
+	}
+	if len(s.created) > 0 {
+		fmt.Fprintf(w, "  %-20s %s\n", "created:", strings.Join(s.created, ", "))
+	}
+	if len(s.createFailed) > 0 {
+		fmt.Fprintf(w, "  %-20s %s\n", "failed to create:", strings.Join(s.createFailed, ", "))
+	}
+	if len(s.analyzedDBs) > 0 {
+		fmt.Fprintf(w, "  %-20s %s\n", "analyzed:", strings.Join(s.analyzedDBs, ", "))
+	}
+	if len(s.analyzeFailed) > 0 {
+		fmt.Fprintf(w, "  %-20s %s\n", "failed to analyze:", strings.Join(s.analyzeFailed, ", "))
+	}
+	if len(s.validations) > 0 {
+		failed := 0
+		for _, result := range s.validations {
+			if result.err != nil {
+				failed++
+			}
+		}
+		fmt.Fprintf(w, "  %-20s %d passed, %d failed\n", "validations:", len(s.validations)-failed, failed)
+		for _, result := range s.validations {
+			if result.err != nil {
+				fmt.Fprintf(w, "    failed %s: %s: %v\n", result.database, result.check, result.err)
+			} else {
+				fmt.Fprintf(w, "    passed %s: %s\n", result.database, result.check)
+			}
+		}
+	}
+	if len(s.notAttempted) > 0 {
+		fmt.Fprintf(w, "  %-20s %s\n", "not attempted:", strings.Join(s.notAttempted, ", "))
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"dbbackup/internal/config"
+
+	"golang.org/x/time/rate"
+)
+
+// maxThrottleBurst caps the bytes an upload may read at once ahead of the
+// bandwidth limit.
+const maxThrottleBurst = 1 << 20
+
+var (
+	uploadLimiterOnce sync.Once
+	uploadLimiter     *rate.Limiter
+)
+
+// sharedUploadLimiter returns the token bucket that every upload of the
+// process draws from, so that limit applies to concurrent uploads
+// together, or nil when limit is 0. A process uploads with a single
+// configuration, so the first limit asked for is the one kept.
+func sharedUploadLimiter(limit config.Bandwidth) *rate.Limiter {
+	uploadLimiterOnce.Do(func() {
+		if limit > 0 {
+			uploadLimiter = rate.NewLimiter(rate.Limit(limit), int(min(limit, maxThrottleBurst)))
+		}
+	})
+	return uploadLimiter
+}
+
+// throttledFile reads a file no faster than its limiter allows. It keeps
+// the io.ReaderAt and io.Seeker of the file, which let the uploader read
+// parts concurrently without buffering them.
+type throttledFile struct {
+	ctx     context.Context
+	file    uploadReader
+	limiter *rate.Limiter
+}
+
+func (f *throttledFile) Read(p []byte) (int, error) {
+	n, err := f.file.Read(p)
+	if waitErr := f.wait(n); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
+
+func (f *throttledFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.file.ReadAt(p, off)
+	if waitErr := f.wait(n); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
+
+func (f *throttledFile) Seek(offset int64, whence int) (int64, error) {
+	return f.file.Seek(offset, whence)
+}
+
+// wait takes n bytes' worth of tokens from the limiter, in steps no larger
+// than its burst.
+func (f *throttledFile) wait(n int) error {
+	for n > 0 {
+		step := min(n, f.limiter.Burst())
+		if err := f.limiter.WaitN(f.ctx, step); err != nil {
+			return err
+		}
+		n -= step
+	}
+	return nil
+}
+
+// uploadReader is an upload body the uploader can read parts of
+// concurrently.
+type uploadReader interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
+// uploadBody returns the body to upload file, or a range of it, with: the
+// file itself, or the file throttled by limiter when there is one.
+func uploadBody(ctx context.Context, file uploadReader, limiter *rate.Limiter) uploadReader {
+	if limiter == nil {
+		return file
+	}
+	return &throttledFile{ctx, file, limiter}
+}
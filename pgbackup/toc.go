@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"dbbackup/internal/config"
+	"dbbackup/internal/postgres"
+)
+
+// tocEntry is an entry of the table of contents of an archive, as listed by
+// pg_restore -l -v.
+type tocEntry struct {
+	id              int
+	desc, namespace string
+	tag             string
+	deps            []int
+	line            string // the entry as listed, for a -L list
+}
+
+// tocDescs are the multi-word kinds of TOC entries, longest first, which
+// tell where an entry's kind ends and its namespace starts.
+var tocDescs = []string{
+	"MATERIALIZED VIEW DATA", "PUBLICATION TABLES IN SCHEMA", "TEXT SEARCH CONFIGURATION",
+	"TEXT SEARCH DICTIONARY", "TEXT SEARCH TEMPLATE", "FOREIGN DATA WRAPPER", "TEXT SEARCH PARSER",
+	"DATABASE PROPERTIES", "PROCEDURAL LANGUAGE", "SEQUENCE OWNED BY", "PUBLICATION TABLE",
+	"SUBSCRIPTION TABLE", "MATERIALIZED VIEW", "CHECK CONSTRAINT", "STATISTICS DATA", "OPERATOR FAMILY",
+	"OPERATOR CLASS", "BLOB METADATA", "EVENT TRIGGER", "FK CONSTRAINT", "FOREIGN TABLE", "ACCESS METHOD",
+	"LARGE OBJECT", "SEQUENCE SET", "TABLE ATTACH", "INDEX ATTACH", "USER MAPPING", "ROW SECURITY",
+	"DEFAULT ACL", "TABLE DATA", "BLOB DATA",
+}
+
+// tocLine matches the start of a listed TOC entry: its dump ID, catalog
+// table OID and OID.
+var tocLine = regexp.MustCompile(`^(\d+); \d+ \d+ `)
+
+// readTOC lists the table of contents of the archive at path.
+func readTOC(ctx context.Context, cfg *config.Config, format, path string) ([]tocEntry, error) {
+	args := []string{"-l", "-v"}
+	if format == "directory" {
+		args = append(args, "-F", "d")
+	}
+	cmd, cleanup, err := postgres.Command(ctx, cfg.Postgres, cfg.Timeouts, "pg_restore", append(args, path)...)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to list the contents of %s: %w: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+	return parseTOC(&stdout)
+}
+
+// parseTOC parses the output of pg_restore -l -v, where each entry is
+// "id; tableoid oid desc namespace tag owner", the namespace being "-" for
+// objects outside schemas, followed by a comment line listing the IDs of
+// the entries it depends on.
+func parseTOC(r io.Reader) ([]tocEntry, error) {
+	var entries []tocEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if deps, ok := strings.CutPrefix(line, ";\tdepends on:"); ok && len(entries) > 0 {
+			for _, field := range strings.Fields(deps) {
+				if id, err := strconv.Atoi(field); err == nil {
+					entries[len(entries)-1].deps = append(entries[len(entries)-1].deps, id)
+				}
+			}
+			continue
+		}
+		m := tocLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		id, _ := strconv.Atoi(m[1])
+		rest := line[len(m[0]):]
+		desc, _, _ := strings.Cut(rest, " ")
+		for _, multi := range tocDescs {
+			if strings.HasPrefix(rest, multi+" ") {
+				desc = multi
+				break
+			}
+		}
+		fields := strings.Fields(strings.TrimPrefix(rest, desc))
+		if len(fields) < 2 {
+			continue
+		}
+		// The tag may hold spaces, e.g. a constraint's table and name; the
+		// owner is last, and empty for entries without one, such as
+		// extensions, whose lines end in a space
+		tag := fields[1 : len(fields)-1]
+		if strings.HasSuffix(line, " ") {
+			tag = fields[1:]
+		}
+		entries = append(entries, tocEntry{
+			id:        id,
+			desc:      desc,
+			namespace: fields[0],
+			tag:       strings.Join(tag, " "),
+			line:      line,
+		})
+	}
+	return entries, scanner.Err()
+}
+
+// relationDescs are the kinds of entries a table name selects, as with
+// pg_restore -t.
+var relationDescs = []string{"TABLE", "VIEW", "MATERIALIZED VIEW", "FOREIGN TABLE", "SEQUENCE"}
+
+// selectTOC returns the entries restoring the tables and the schemas
+// given, with dataOnly only their data. Selecting a table also selects the
+// sequences it owns, whose current values are data, and the defaults of
+// its columns. Tables are given as schema.table, or as table in any schema.
+// It fails when one of them is not in the archive, listing those that are.
+func selectTOC(entries []tocEntry, tables, schemas []string, dataOnly bool) ([]tocEntry, error) {
+	matchTable := func(spec string, e tocEntry) bool {
+		schema, table, ok := strings.Cut(spec, ".")
+		if !ok {
+			return e.tag == spec
+		}
+		return e.namespace == schema && e.tag == table
+	}
+
+	// Find the relations and schemas asked for
+	selected := make(map[int]bool)
+	tableIDs := make(map[int]bool)
+	var missing []string
+	for _, spec := range tables {
+		found := false
+		for _, e := range entries {
+			if slices.Contains(relationDescs, e.desc) && matchTable(spec, e) {
+				tableIDs[e.id] = true
+				found = true
+			}
+		}
+		if !found {
+			missing = append(missing, "table "+spec)
+		}
+	}
+	for _, schema := range schemas {
+		found := false
+		for _, e := range entries {
+			if e.namespace == schema {
+				selected[e.id] = true
+				found = true
+			}
+		}
+		if !found {
+			missing = append(missing, "schema "+schema)
+		}
+	}
+	if len(missing) > 0 {
+		held := "no tables"
+		var relations []string
+		for _, e := range entries {
+			if slices.Contains(relationDescs, e.desc) {
+				relations = append(relations, e.namespace+"."+e.tag)
+			}
+		}
+		if len(relations) > 0 {
+			held = strings.Join(relations, ", ")
+		}
+		return nil, fmt.Errorf("%s not in the backup, which holds %s", strings.Join(missing, ", "), held)
+	}
+
+	// Take the relations with their data, the sequences they own and the
+	// defaults of their columns
+	owned := make(map[[2]string]bool)
+	for _, e := range entries {
+		dependsOnTable := slices.ContainsFunc(e.deps, func(id int) bool { return tableIDs[id] })
+		switch {
+		case tableIDs[e.id]:
+			selected[e.id] = true
+		case e.desc == "TABLE DATA" || e.desc == "MATERIALIZED VIEW DATA" || e.desc == "DEFAULT":
+			if dependsOnTable {
+				selected[e.id] = true
+			}
+		case e.desc == "SEQUENCE" || e.desc == "SEQUENCE OWNED BY":
+			if dependsOnTable {
+				selected[e.id] = true
+				owned[[2]string{e.namespace, e.tag}] = true
+			}
+		}
+	}
+	var list []tocEntry
+	for _, e := range entries {
+		if (e.desc == "SEQUENCE" || e.desc == "SEQUENCE SET") && owned[[2]string{e.namespace, e.tag}] {
+			selected[e.id] = true
+		}
+		if !selected[e.id] {
+			continue
+		}
+		if dataOnly && !slices.Contains([]string{"TABLE DATA", "SEQUENCE SET", "MATERIALIZED VIEW DATA"}, e.desc) {
+			continue
+		}
+		list = append(list, e)
+	}
+	return list, nil
+}
+
+// writeTOCList writes entries to path as a list for pg_restore -L.
+func writeTOCList(path string, entries []tocEntry) error {
+	var list strings.Builder
+	for _, e := range entries {
+		list.WriteString(e.line + "\n")
+	}
+	return os.WriteFile(path, []byte(list.String()), 0o600)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"dbbackup/internal/config"
+	"dbbackup/internal/postgres"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// skipError reports that a database was deliberately left alone, and why.
+type skipError struct{ reason string }
+
+func (e *skipError) Error() string { return e.reason }
+
+// changeMarkers returns the statistics that tell whether dbName was written
+// to: the rows inserted, updated and deleted in it, catalogs included so
+// that DDL counts, qualified by when the counters were last reset and when
+// the server started, since both zero them. Committed transactions are no
+// use, as pg_dump's own transactions count too. The markers are empty when
+// the server collects no statistics.
+func changeMarkers(ctx context.Context, cfg *config.Config, dbName string) (string, error) {
+	db, err := postgres.Open(cfg.Postgres, cfg.Timeouts, cfg.Postgres.Database)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	var (
+		trackCounts                string
+		inserted, updated, deleted int64
+		statsReset                 sql.NullTime
+		serverStart                time.Time
+	)
+	err = db.QueryRowContext(ctx, `SELECT current_setting('track_counts'), tup_inserted, tup_updated, tup_deleted, stats_reset, pg_postmaster_start_time()
+		FROM pg_stat_database WHERE datname = $1`, dbName).Scan(&trackCounts, &inserted, &updated, &deleted, &statsReset, &serverStart)
+	if err != nil {
+		return "", fmt.Errorf("failed to query the statistics of database %s: %w", dbName, err)
+	}
+	if trackCounts != "on" {
+		return "", nil
+	}
+	reset := "never"
+	if statsReset.Valid {
+		reset = statsReset.Time.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprintf("inserted=%d updated=%d deleted=%d stats-reset=%s server-start=%s",
+		inserted, updated, deleted, reset, serverStart.UTC().Format(time.RFC3339)), nil
+}
+
+// unchanged reports whether the latest backup of dbName recorded the same
+// change markers, and was taken with the same settings, logging the
+// decision.
+func (r *backupRun) unchanged(ctx context.Context, dbLog *databaseLog, dbName string, settings config.Database, markers string) bool {
+	if markers == "" {
+		dbLog.out.Printf("Backing up %s: the server collects no statistics (track_counts is off)\n", dbName)
+		return false
+	}
+	previous, ok := r.previousBackup(dbLog, dbName, settings)
+	if !ok {
+		dbLog.out.Printf("Backing up %s: no previous backup to compare with\n", dbName)
+		return false
+	}
+	s3Key := aws.ToString(previous.Key)
+	metadata, err := headS3Object(ctx, r.s3Client, r.cfg.S3.Bucket, s3Key, "")
+	if err != nil {
+		dbLog.err.Printf("Warning: failed to compare with the previous backup, backing up %s: %v", dbName, err)
+		return false
+	}
+
+	if metadata["change-markers"] == "" {
+		dbLog.out.Printf("Backing up %s: previous backup s3://%s/%s records no change markers\n", dbName, r.cfg.S3.Bucket, s3Key)
+		return false
+	}
+	if metadata["change-markers"] != markers {
+		dbLog.out.Printf("Backing up %s: changed since s3://%s/%s (%s)\n", dbName, r.cfg.S3.Bucket, s3Key, metadata["change-markers"])
+		return false
+	}
+	expected := r.settingsMetadata(settings)
+	for _, field := range backupFields {
+		if metadata[field] != expected[field] {
+			dbLog.out.Printf("Backing up %s: previous backup s3://%s/%s has %s %s, not %s\n", dbName, r.cfg.S3.Bucket, s3Key, field, metadata[field], expected[field])
+			return false
+		}
+	}
+	dbLog.out.Printf("Database %s is unchanged since s3://%s/%s\n", dbName, r.cfg.S3.Bucket, s3Key)
+	return true
+}
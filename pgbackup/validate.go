@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"dbbackup/internal/config"
+	"dbbackup/internal/postgres"
+)
+
+// validationResult is the outcome of a validation check of a restored
+// database.
+type validationResult struct {
+	database string
+	check    string
+	err      error // nil when the check passed
+}
+
+// validateDatabase runs checks against the restored dbName and returns
+// their outcomes, logging each. A check whose query fails counts as failed
+// like one whose result is not the one expected.
+func validateDatabase(ctx context.Context, cfg *config.Config, dbLog *databaseLog, dbName string, checks []config.Validation) []validationResult {
+	results := make([]validationResult, 0, len(checks))
+	db, err := postgres.Open(cfg.Postgres, cfg.Timeouts, dbName)
+	if err != nil {
+		for _, check := range checks {
+			results = append(results, validationResult{dbName, check.String(), err})
+		}
+		return results
+	}
+	defer db.Close()
+
+	for _, check := range checks {
+		err := runValidation(ctx, db, check)
+		if err != nil {
+			dbLog.err.Printf("Validation of database %s failed: %s: %v", dbName, check, err)
+		} else {
+			dbLog.out.Printf("Validation of database %s passed: %s\n", dbName, check)
+		}
+		results = append(results, validationResult{dbName, check.String(), err})
+	}
+	return results
+}
+
+// runValidation runs the query of check in db and compares what it returns
+// with what check expects: a row, or the first column of its first row.
+func runValidation(ctx context.Context, db *sql.DB, check config.Validation) error {
+	rows, err := db.QueryContext(ctx, check.Query)
+	if err != nil {
+		return fmt.Errorf("query failed: %w", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("query failed: %w", err)
+		}
+		return errors.New("query returned no rows")
+	}
+	if check.NonEmpty {
+		return nil
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return errors.New("query returned no columns")
+	}
+	values := make([]any, len(columns))
+	var first sql.NullString
+	values[0] = &first
+	for i := 1; i < len(values); i++ {
+		values[i] = new(any)
+	}
+	if err := rows.Scan(values...); err != nil {
+		return fmt.Errorf("failed to read the query's result: %w", err)
+	}
+
+	switch {
+	case check.MinRows != nil:
+		n, err := strconv.ParseFloat(first.String, 64)
+		if !first.Valid || err != nil {
+			return fmt.Errorf("query returned %q, not a number", first.String)
+		}
+		if n < float64(*check.MinRows) {
+			return fmt.Errorf("got %s, want at least %d", first.String, *check.MinRows)
+		}
+	case check.Equals != nil:
+		if !first.Valid || first.String != *check.Equals {
+			return fmt.Errorf("got %s, want %q", describeValue(first), *check.Equals)
+		}
+	}
+	return nil
+}
+
+// describeValue renders a value a query returned for messages.
+func describeValue(v sql.NullString) string {
+	if !v.Valid {
+		return "NULL"
+	}
+	return strconv.Quote(v.String)
+}
+
+// validationErrors returns the failures among results, for the exit status
+// under -validation-failure error.
+func validationErrors(results []validationResult) []error {
+	var errs []error
+	for _, result := range results {
+		if result.err != nil {
+			errs = append(errs, fmt.Errorf("database %s: validation %s failed: %w", result.database, result.check, result.err))
+		}
+	}
+	return errs
+}
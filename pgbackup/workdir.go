@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"dbbackup/internal/config"
+	"dbbackup/internal/naming"
+)
+
+// workFilePrefix starts the name of every file and directory runs create in
+// the work directory, so that cleaning up after crashed runs leaves other
+// files there alone.
+const workFilePrefix = "pgbackup-"
+
+// newRunID returns the identifier of a run started at started: the time,
+// which sorts runs chronologically, then a random suffix that tells apart
+// runs started in the same second.
+func newRunID(started time.Time) string {
+	return fmt.Sprintf("%s-%08x", started.UTC().Format(naming.TimestampLayout), rand.Uint32())
+}
+
+// flattenName escapes the slashes of a name for a flat work file, doubling
+// underscores first so that keys such as a/b_c and a_b/c stay apart.
+var flattenName = strings.NewReplacer("_", "__", "/", "_s")
+
+// workPath returns the path in dir of the file name written by the run
+// runID, which overlapping runs cannot clobber. The name may contain
+// directories; the local copy is kept flat, each name mapping to its own
+// file.
+func workPath(dir, runID, name string) string {
+	return filepath.Join(dir, workFilePrefix+runID+"-"+flattenName.Replace(name))
+}
+
+// prepareWorkDir creates the work directory with owner-only permissions if
+// it does not exist and checks that files can be written to it, so that a
+// bad work directory fails the run before any dump is started. It then
+// cleans up after earlier runs that crashed.
+func prepareWorkDir(cfg *config.Config) error {
+	dir := cfg.WorkDir
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create work directory %s: %w", dir, err)
+	}
+
+	probe, err := os.CreateTemp(dir, ".pgbackup-probe-*")
+	if err != nil {
+		return fmt.Errorf("work directory %s is not writable: %w", dir, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	cleanOrphans(dir, cfg.OrphanAge, cfg.OrphanDryRun)
+	return nil
+}
+
+// cleanOrphans removes the work files in dir last modified more than maxAge
+// ago, which runs that crashed or were killed left behind, or only logs
+// them when dryRun is set. Dumps kept for a manual upload, next to their
+// .upload.json, are left alone. A maxAge of 0 keeps everything.
+func cleanOrphans(dir string, maxAge time.Duration, dryRun bool) {
+	if maxAge <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Warning: failed to look for stale files in work directory %s: %v", dir, err)
+		return
+	}
+	names := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		names[entry.Name()] = true
+	}
+
+	cutoff := time.Now().Add(-maxAge)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, workFilePrefix) || strings.HasSuffix(name, ".upload.json") || names[name+".upload.json"] {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		modified, err := lastModified(path)
+		if err != nil {
+			log.Printf("Warning: failed to check stale file %s: %v", path, err)
+			continue
+		}
+		if modified.After(cutoff) {
+			continue
+		}
+		if dryRun {
+			fmt.Printf("Would remove stale %s (last modified %s)\n", path, modified.Local().Format(time.DateTime))
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("Warning: failed to remove stale %s: %v", path, err)
+			continue
+		}
+		fmt.Printf("Removed stale %s (last modified %s)\n", path, modified.Local().Format(time.DateTime))
+	}
+}
+
+// lastModified returns when the file at path, or anything below the
+// directory at path, was last written to.
+func lastModified(path string) (time.Time, error) {
+	var latest time.Time
+	err := filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return latest, err
+}
+
+// reserveSpace checks, before database is dumped, that the work directory
+// has room for a dump as large as the database, less the space dumps in
+// progress have claimed, and claims that space until release is called.
+// Dumps are usually smaller than their database, compressed ones much
+// smaller, so the check errs on the safe side. It is skipped when the size
+// of the database or the free space cannot be read.
+func (r *backupRun) reserveSpace(dbLog *databaseLog, database databaseInfo) (release func(), err error) {
+	release = func() {}
+	if !r.cfg.Backup.DiskCheck || database.size < 0 {
+		return release, nil
+	}
+	free, err := freeSpace(r.cfg.WorkDir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return release, nil
+	}
+	if err != nil {
+		dbLog.err.Printf("Warning: failed to read the free space of work directory %s: %v", r.cfg.WorkDir, err)
+		return release, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if database.size > free-r.reserved {
+		claimed := ""
+		if r.reserved > 0 {
+			claimed = fmt.Sprintf(", %s of it claimed by dumps in progress", formatSize(r.reserved))
+		}
+		return nil, fmt.Errorf("not enough disk space: database size %s exceeds the %s free in work directory %s%s; free up space, use another -work-dir, or pass -no-disk-check if the dump is known to be smaller",
+			formatSize(database.size), formatSize(free), r.cfg.WorkDir, claimed)
+	}
+	r.reserved += database.size
+	return func() {
+		r.mu.Lock()
+		r.reserved -= database.size
+		r.mu.Unlock()
+	}, nil
+}
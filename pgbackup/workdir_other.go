@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "errors"
+
+// freeSpace is not implemented here; the disk space check is skipped.
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}